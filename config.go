@@ -1,15 +1,22 @@
 package main
 
-import "github.com/rsksmart/liquidity-provider/providers"
+import (
+	"github.com/rsksmart/liquidity-provider-server/http"
+	"github.com/rsksmart/liquidity-provider/providers"
+)
 
 type config struct {
 	LogFile              string
 	Debug                bool
+	LogJSON              bool
+	RegtestMode          bool
 	IrisActivationHeight int
 	ErpKeys              []string
 
 	Server struct {
+		Host string
 		Port uint
+		http.Config
 	}
 	DB struct {
 		Path string
@@ -19,12 +26,27 @@ type config struct {
 		LBCAddr                     string
 		BridgeAddr                  string
 		RequiredBridgeConfirmations int64
+		GasEstimationCacheTTL       uint
+		ForceGasEstimation          bool
+		Proxy                       string
+		Retries                     int
+		RetrySleep                  uint
+		MaxRetrySleep               uint
+		WarmFedCache                bool
+		DynamicFees                 bool
+		GasPriceMarkup              int
+		MaxGasPrice                 uint64
 	}
 	BTC struct {
-		Endpoint string
-		Username string
-		Password string
-		Network  string
+		Endpoint        string
+		Username        string
+		Password        string
+		Network         string
+		MaxCalls        uint
+		Proxy           string
+		FedAddressType  string
+		ReorgDepth      uint
+		AdaptivePolling bool
 	}
 	Provider providers.ProviderConfig
 }
@@ -2,9 +2,14 @@ package connectors
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"github.com/btcsuite/btcd/btcjson"
+	"math/big"
+	"math/rand"
+	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/btcsuite/btcd/chaincfg"
@@ -13,6 +18,7 @@ import (
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
 	"github.com/btcsuite/btcutil/bloom"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 
 	"encoding/hex"
@@ -20,11 +26,27 @@ import (
 	"github.com/btcsuite/btcd/txscript"
 
 	"github.com/btcsuite/btcutil/base58"
+	"github.com/btcsuite/btcutil/bech32"
 	"github.com/ethereum/go-ethereum/crypto"
 )
 
 const unknownBtcdVersion = -1
 
+const pollJitterDivisor = 10 // poll delays vary randomly by up to a tenth
+
+// address types the federation address can have; deposit addresses are derived with the same one
+const (
+	FedAddressTypeP2SH  = "p2sh"
+	FedAddressTypeP2WSH = "p2wsh"
+)
+
+// script types DecodeBTCAddressWithType tells apart
+const (
+	BtcAddressTypeP2PKH  = "p2pkh"
+	BtcAddressTypeP2SH   = "p2sh"
+	BtcAddressTypeBech32 = "bech32"
+)
+
 type AddressWatcherCompleteCallback = func(w AddressWatcher)
 
 type AddressWatcher interface {
@@ -42,7 +64,9 @@ type BTCConnector interface {
 	SerializePMT(txHash string) ([]byte, error)
 	SerializeTx(txHash string) ([]byte, error)
 	GetBlockNumberByTx(txHash string) (int64, error)
+	BuildRegisterPegInParams(txHash string) (rawTx []byte, pmt []byte, height *big.Int, err error)
 	GetDerivedBitcoinAddress(fedInfo *FedInfo, userBtcRefundAddr []byte, lbcAddress []byte, lpBtcAddress []byte, derivationArgumentsHash []byte) (string, error)
+	RPCQueueDepth() int64
 }
 
 type BTCClient interface {
@@ -57,13 +81,20 @@ type BTCClient interface {
 }
 
 type BTC struct {
-	c      BTCClient
-	params chaincfg.Params
+	c               BTCClient
+	params          chaincfg.Params
+	maxCalls        uint
+	limiter         *limitedBTCClient
+	metrics         *btcMetrics
+	proxy           *url.URL
+	fedAddressType  string
+	reorgDepth      int64
+	adaptivePolling bool
 }
 
 func NewBTC(network string) (*BTC, error) {
 	log.Debug("initializing BTC connector")
-	btc := BTC{}
+	btc := BTC{fedAddressType: FedAddressTypeP2SH}
 	switch network {
 	case "mainnet":
 		btc.params = chaincfg.MainNetParams
@@ -87,6 +118,14 @@ func (btc *BTC) Connect(endpoint string, username string, password string) error
 		DisableTLS:   true,
 		HTTPPostMode: true,
 	}
+	// the rpc client ignores the proxy environment variables unless it's given one explicitly
+	proxy, err := proxyFunc(btc.proxy)(&http.Request{URL: &url.URL{Scheme: "http", Host: endpoint}})
+	if err != nil {
+		return fmt.Errorf("error resolving proxy: %v", err)
+	}
+	if proxy != nil {
+		config.Proxy = proxy.String()
+	}
 	c, err := rpcclient.New(&config, nil)
 	if err != nil {
 		return fmt.Errorf("RPC client error: %v", err)
@@ -103,9 +142,64 @@ func (btc *BTC) Connect(endpoint string, username string, password string) error
 	}
 
 	btc.c = c
+	if btc.metrics != nil {
+		btc.c = newMeteredBTCClient(btc.c, btc.metrics, endpoint)
+	}
+	if btc.maxCalls > 0 {
+		btc.limiter = newLimitedBTCClient(btc.c, btc.maxCalls)
+		btc.c = btc.limiter
+	}
 	return nil
 }
 
+// EnableMetrics registers the counters of the RPC calls made to the bitcoin node on reg; it must be called before
+// Connect
+func (btc *BTC) EnableMetrics(reg prometheus.Registerer) error {
+	m, err := newBTCMetrics(reg)
+	if err != nil {
+		return err
+	}
+	btc.metrics = m
+	return nil
+}
+
+// UseProxy dials the BTC node through the given proxy instead of the one set in the environment, if any; it must be
+// called before Connect
+func (btc *BTC) UseProxy(proxyURL string) error {
+	u, err := parseProxyURL(proxyURL)
+	if err != nil {
+		return err
+	}
+	btc.proxy = u
+	return nil
+}
+
+// SetReorgSafetyDepth makes address watchers ignore the last blocks confirming a deposit, so that only confirmations
+// buried at least depth blocks deep are reported, and makes them check the deposit is still in the main chain before
+// reporting them
+func (btc *BTC) SetReorgSafetyDepth(depth uint) {
+	btc.reorgDepth = int64(depth)
+}
+
+// SetAdaptivePolling makes address watchers poll less often while the deposit time is far from elapsing and more
+// often when it's close
+func (btc *BTC) SetAdaptivePolling(adaptive bool) {
+	btc.adaptivePolling = adaptive
+}
+
+// LimitConcurrentCalls bounds the amount of RPC calls in flight to the bitcoin node; it must be called before Connect
+func (btc *BTC) LimitConcurrentCalls(maxCalls uint) {
+	btc.maxCalls = maxCalls
+}
+
+// RPCQueueDepth returns the amount of RPC calls waiting for a free slot when concurrent calls are limited
+func (btc *BTC) RPCQueueDepth() int64 {
+	if btc.limiter == nil {
+		return 0
+	}
+	return btc.limiter.queueDepth()
+}
+
 func (btc *BTC) CheckConnection() error {
 	_, err := checkBtcdVersion(btc.c)
 	return err
@@ -123,14 +217,15 @@ func (btc *BTC) AddAddressWatcher(address string, minBtcAmount btcutil.Amount, i
 	}
 
 	go func(w AddressWatcher) {
-		ticker := time.NewTicker(interval)
+		timer := time.NewTimer(btc.nextPollDelay(interval, exp, time.Now()))
 		var confirmations int64
 		for {
 			select {
-			case <-ticker.C:
+			case <-timer.C:
 				_ = btc.checkBtcAddr(w, btcAddr, minBtcAmount, exp, &confirmations, time.Now)
+				timer.Reset(btc.nextPollDelay(interval, exp, time.Now()))
 			case <-w.Done():
-				ticker.Stop()
+				timer.Stop()
 				cb(w)
 				return
 			}
@@ -139,6 +234,25 @@ func (btc *BTC) AddAddressWatcher(address string, minBtcAmount btcutil.Amount, i
 	return nil
 }
 
+// nextPollDelay returns how long a watcher waits before checking its address again. With adaptive polling, watchers
+// poll at half the rate while the deposit time is far from elapsing and at four times the rate when it's close. The
+// delay is randomized a bit so that watchers added at the same time, e.g. on startup, don't poll in bursts.
+func (btc *BTC) nextPollDelay(interval time.Duration, exp time.Time, now time.Time) time.Duration {
+	d := interval
+	if btc.adaptivePolling {
+		remaining := exp.Sub(now)
+		if remaining > 0 && remaining < 4*interval {
+			d = interval / 4
+		} else if remaining > 16*interval {
+			d = 2 * interval
+		}
+	}
+	if spread := int64(d) / pollJitterDivisor; spread > 0 {
+		d += time.Duration(rand.Int63n(2*spread+1) - spread)
+	}
+	return d
+}
+
 func (btc *BTC) checkBtcAddr(w AddressWatcher, btcAddr btcutil.Address, minBtcAmount btcutil.Amount, expTime time.Time, confirmations *int64, now func() time.Time) error {
 	conf, amount, txHash, err := btc.getConfirmations(btcAddr, minBtcAmount)
 	if err != nil {
@@ -150,6 +264,14 @@ func (btc *BTC) checkBtcAddr(w AddressWatcher, btcAddr btcutil.Address, minBtcAm
 		return fmt.Errorf("time for depositing %v has elapsed; addr: %v", minBtcAmount, btcAddr)
 	}
 
+	if conf > *confirmations && btc.reorgDepth > 0 {
+		conf, err = btc.stableConfirmations(txHash, conf)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+
 	if conf > *confirmations {
 		*confirmations = conf
 		w.OnNewConfirmation(txHash, conf, amount)
@@ -159,10 +281,112 @@ func (btc *BTC) checkBtcAddr(w AddressWatcher, btcAddr btcutil.Address, minBtcAm
 	return fmt.Errorf("num of confirmations has not advanced; conf: %v", conf)
 }
 
+// stableConfirmations re-verifies the transaction is still included in a block of the main chain and returns the
+// confirmations it has beyond the reorg safety depth
+func (btc *BTC) stableConfirmations(txHash string, conf int64) (int64, error) {
+	blockHash, err := btc.getBlockHash(txHash)
+	if err != nil {
+		return 0, err
+	}
+	block, err := btc.c.GetBlockVerbose(blockHash)
+	if err != nil {
+		return 0, fmt.Errorf("error getting block %v: %v", blockHash, err)
+	}
+	if block.Confirmations < 1 {
+		return 0, fmt.Errorf("block %v including tx %v is no longer in the main chain", blockHash, txHash)
+	}
+	included := false
+	for _, id := range block.Tx {
+		if id == txHash {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return 0, fmt.Errorf("tx %v is no longer included in block %v at height %v", txHash, blockHash, block.Height)
+	}
+	if block.Confirmations < conf {
+		conf = block.Confirmations
+	}
+	if conf <= btc.reorgDepth {
+		return 0, nil
+	}
+	return conf - btc.reorgDepth, nil
+}
+
 func (btc *BTC) GetParams() chaincfg.Params {
 	return btc.params
 }
 
+// SetFedAddressType sets the type of the federation address, p2sh (the default) or p2wsh, which determines how
+// deposit addresses are derived
+func (btc *BTC) SetFedAddressType(addrType string) error {
+	switch addrType {
+	case FedAddressTypeP2SH, FedAddressTypeP2WSH:
+		btc.fedAddressType = addrType
+		return nil
+	default:
+		return fmt.Errorf("invalid federation address type: %v", addrType)
+	}
+}
+
+// CheckFedAddressType verifies the federation address returned by the bridge has the type deposit addresses are
+// derived for, since deriving with the wrong type silently produces addresses the federation doesn't control
+func (btc *BTC) CheckFedAddressType(fedAddr string) error {
+	addr, err := btcutil.DecodeAddress(fedAddr, &btc.params)
+	if err != nil {
+		return fmt.Errorf("error decoding federation address: %v", err)
+	}
+	addrType := fedAddressTypeOf(addr)
+	if addrType != btc.fedAddressType {
+		return fmt.Errorf("federation address type mismatch: expected %v, bridge returned a %v address", btc.fedAddressType, addrType)
+	}
+	return nil
+}
+
+func fedAddressTypeOf(addr btcutil.Address) string {
+	switch addr.(type) {
+	case *btcutil.AddressScriptHash:
+		return FedAddressTypeP2SH
+	case *btcutil.AddressWitnessScriptHash:
+		return FedAddressTypeP2WSH
+	default:
+		return "unsupported"
+	}
+}
+
+// scriptAddress returns the address paying to the given redeem script, according to the federation address type
+func (btc *BTC) scriptAddress(script []byte) (btcutil.Address, error) {
+	if btc.fedAddressType == FedAddressTypeP2WSH {
+		hash := sha256.Sum256(script)
+		return btcutil.NewAddressWitnessScriptHash(hash[:], &btc.params)
+	}
+	return btcutil.NewAddressScriptHash(script, &btc.params)
+}
+
+// CheckFedAddressNetwork verifies the federation address returned by the bridge belongs to the network the connector
+// is configured for
+func (btc *BTC) CheckFedAddressNetwork(fedAddr string) error {
+	addr, err := btcutil.DecodeAddress(fedAddr, &btc.params)
+	if err == nil && addr.IsForNet(&btc.params) {
+		return nil
+	}
+	for _, params := range []*chaincfg.Params{&chaincfg.MainNetParams, &chaincfg.TestNet3Params, &chaincfg.RegressionNetParams} {
+		addr, err := btcutil.DecodeAddress(fedAddr, params)
+		if err == nil && addr.IsForNet(params) {
+			return fmt.Errorf("BTC network mismatch: bridge returned a %v address but connector is %v", networkNameFromParams(params), networkNameFromParams(&btc.params))
+		}
+	}
+	return fmt.Errorf("BTC network mismatch: bridge returned address %v, which is not valid for any known network; connector is %v", fedAddr, networkNameFromParams(&btc.params))
+}
+
+func networkNameFromParams(params *chaincfg.Params) string {
+	if params.Name == chaincfg.TestNet3Params.Name {
+		return "testnet"
+	}
+	return params.Name
+}
+
 func (btc *BTC) Close() {
 	btc.c.Disconnect()
 }
@@ -213,8 +437,54 @@ func (btc *BTC) SerializeTx(txHash string) ([]byte, error) {
 	return serializeTx(rawTx)
 }
 
+// BuildRegisterPegInParams returns what registerPegIn takes to verify a deposit: the transaction serialized without
+// witness data, the serialized partial merkle tree proving its inclusion in its block (see SerializePMT) and the height
+// of that block. Unlike calling SerializeTx, SerializePMT and GetBlockNumberByTx, the block is only fetched once.
+func (btc *BTC) BuildRegisterPegInParams(txHash string) ([]byte, []byte, *big.Int, error) {
+	h, err := chainhash.NewHashFromStr(txHash)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid tx hash %v: %v", txHash, err)
+	}
+	blockHash, err := btc.getBlockHash(txHash)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	msgBlock, err := btc.c.GetBlock(blockHash)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error retrieving block %v: %v", blockHash.String(), err)
+	}
+	block := btcutil.NewBlock(msgBlock)
+	var tx *btcutil.Tx
+	for _, t := range block.Transactions() {
+		if t.Hash().IsEqual(h) {
+			tx = t
+			break
+		}
+	}
+	if tx == nil {
+		return nil, nil, nil, fmt.Errorf("tx %v not found in block %v", txHash, blockHash.String())
+	}
+	rawTx, err := serializeTx(tx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	pmt, err := serializePMT(txHash, block)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	verboseBlock, err := btc.c.GetBlockVerbose(blockHash)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error retrieving block %v: %v", blockHash.String(), err)
+	}
+	return rawTx, pmt, big.NewInt(verboseBlock.Height), nil
+}
+
 func (btc *BTC) GetDerivedBitcoinAddress(fedInfo *FedInfo, userBtcRefundAddr []byte, lbcAddress []byte, lpBtcAddress []byte, derivationArgumentsHash []byte) (string, error) {
-	derivationValue, err := getDerivationValueHash(userBtcRefundAddr, lbcAddress, lpBtcAddress, derivationArgumentsHash)
+	err := btc.CheckFedAddressType(fedInfo.FedAddress)
+	if err != nil {
+		return "", err
+	}
+	derivationValue, err := GetDerivationValueHash(userBtcRefundAddr, lbcAddress, lpBtcAddress, derivationArgumentsHash)
 	if err != nil {
 		return "", fmt.Errorf("error computing derivation value: %v", err)
 	}
@@ -222,22 +492,48 @@ func (btc *BTC) GetDerivedBitcoinAddress(fedInfo *FedInfo, userBtcRefundAddr []b
 	if err != nil {
 		return "", fmt.Errorf("error generating redeem script: %v", err)
 	}
-	addressScriptHash, err := btcutil.NewAddressScriptHash(flyoverScript, &btc.params)
+	depositAddress, err := btc.scriptAddress(flyoverScript)
 	if err != nil {
 		return "", err
 	}
-	return addressScriptHash.EncodeAddress(), nil
+	return depositAddress.EncodeAddress(), nil
 }
 
 func DecodeBTCAddressWithVersion(address string) ([]byte, error) {
+	bts, _, err := DecodeBTCAddressWithType(address)
+	return bts, err
+}
+
+// DecodeBTCAddressWithType returns the version byte followed by the hash of a base58 address, along with the script
+// type the version denotes. Bech32 addresses are detected, but rejected, since the LBC only takes versioned hashes.
+func DecodeBTCAddressWithType(address string) ([]byte, string, error) {
 	addressBts, ver, err := base58.CheckDecode(address)
 	if err != nil {
-		return nil, fmt.Errorf("the provider address is not a valid base58 encoded address. address: %v", address)
+		if _, _, err := bech32.Decode(address); err == nil {
+			return nil, BtcAddressTypeBech32, fmt.Errorf("bech32 addresses are not supported. address: %v", address)
+		}
+		return nil, "", fmt.Errorf("the provider address is not a valid base58 encoded address. address: %v", address)
+	}
+	addrType := btcAddressTypeFromVersion(ver)
+	if addrType == "" {
+		return nil, "", fmt.Errorf("unknown address version %v. address: %v", ver, address)
 	}
 	var bts bytes.Buffer
 	bts.WriteByte(ver)
 	bts.Write(addressBts)
-	return bts.Bytes(), nil
+	return bts.Bytes(), addrType, nil
+}
+
+func btcAddressTypeFromVersion(ver byte) string {
+	for _, params := range []*chaincfg.Params{&chaincfg.MainNetParams, &chaincfg.TestNet3Params, &chaincfg.RegressionNetParams} {
+		switch ver {
+		case params.PubKeyHashAddrID:
+			return BtcAddressTypeP2PKH
+		case params.ScriptHashAddrID:
+			return BtcAddressTypeP2SH
+		}
+	}
+	return ""
 }
 
 func serializeTx(tx *btcutil.Tx) ([]byte, error) {
@@ -346,7 +642,8 @@ func (btc *BTC) getBlockHash(txHash string) (*chainhash.Hash, error) {
 	return blockHash, nil
 }
 
-func getDerivationValueHash(userBtcRefundAddr []byte, lbcAddress []byte, lpBtcAddress []byte, derivationArgumentsHash []byte) ([]byte, error) {
+// GetDerivationValueHash computes the value that is prepended to the federation redeem script to derive the deposit address.
+func GetDerivationValueHash(userBtcRefundAddr []byte, lbcAddress []byte, lpBtcAddress []byte, derivationArgumentsHash []byte) ([]byte, error) {
 	var buf bytes.Buffer
 	buf.Write(derivationArgumentsHash)
 	buf.Write(userBtcRefundAddr)
@@ -359,7 +656,7 @@ func getDerivationValueHash(userBtcRefundAddr []byte, lbcAddress []byte, lpBtcAd
 }
 
 func (btc *BTC) validateRedeemScript(fedInfo *FedInfo, script []byte) error {
-	addr, err := btcutil.NewAddressScriptHash(script, &btc.params)
+	addr, err := btc.scriptAddress(script)
 	if err != nil {
 		return err
 	}
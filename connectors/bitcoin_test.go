@@ -4,6 +4,9 @@ import (
 	"encoding/hex"
 	"errors"
 	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rsksmart/liquidity-provider-server/connectors/testmocks"
 	"github.com/stretchr/testify/mock"
 	"io"
@@ -20,6 +23,7 @@ import (
 
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/stretchr/testify/assert"
 
@@ -148,6 +152,49 @@ func testPMTSerialization(t *testing.T) {
 	}
 }
 
+func testBuildRegisterPegInParams(t *testing.T) {
+	// this is block 0000000000000000000aca0460feaf0661f173b75d4cc824b57233aa7c6b7bc3, at height 696394
+	f, err := os.Open("./testdata/test_block")
+	if err != nil {
+		t.Fatalf("error opening test block file: %v", err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("error reading test file: %v", err)
+	}
+	h, err := hex.DecodeString(string(b))
+	if err != nil {
+		t.Fatalf("error decoding test file: %v", err)
+	}
+	block, err := btcutil.NewBlockFromBytes(h)
+	if err != nil {
+		t.Fatalf("error parsing test block: %v", err)
+	}
+
+	btcClientMock := new(testmocks.BTCClientMock)
+	btc, err := NewBTC("mainnet")
+	if err != nil {
+		t.Fatalf("error initializing BTC: %v", err)
+	}
+	btc.c = btcClientMock
+	blockHash := block.Hash()
+	btcClientMock.On("GetTransaction", mock.AnythingOfType("*chainhash.Hash")).Return(&btcjson.GetTransactionResult{BlockHash: blockHash.String()}, nil)
+	btcClientMock.On("GetBlock", blockHash).Return(block.MsgBlock(), nil).Times(2)
+	btcClientMock.On("GetBlockVerbose", blockHash).Return(&btcjson.GetBlockVerboseResult{Height: 696394}, nil).Once()
+
+	p := expectedPmts[0]
+	rawTx, pmt, height, err := btc.BuildRegisterPegInParams(p.h)
+	assert.Nil(t, err)
+	// the raw tx hashes to the requested one, so it was serialized without witness data
+	assert.EqualValues(t, p.h, chainhash.DoubleHashH(rawTx).String())
+	assert.EqualValues(t, p.pmt, hex.EncodeToString(pmt))
+	assert.EqualValues(t, 696394, height.Int64())
+
+	_, _, _, err = btc.BuildRegisterPegInParams("0000000000000000000000000000000000000000000000000000000000000001")
+	assert.EqualError(t, err, "tx 0000000000000000000000000000000000000000000000000000000000000001 not found in block "+blockHash.String())
+	btcClientMock.AssertExpectations(t)
+}
+
 var testQuotes = []struct {
 	BTCRefundAddr               string
 	LBCAddr                     string
@@ -252,7 +299,7 @@ func testDerivationComplete(t *testing.T) {
 			t.Errorf("Unexpected error in getBytesFromBtcAddress. error: %v", err)
 			continue
 		}
-		value, err := getDerivationValueHash(userBtcRefundAddr, lbcAddr, lpBtcAddress, hashBytes)
+		value, err := GetDerivationValueHash(userBtcRefundAddr, lbcAddr, lpBtcAddress, hashBytes)
 		if err != nil {
 			t.Errorf("Unexpected error in GetDerivationValueHash. value: %v, expected: %v, error: %v", value, tt.ExpectedDerivationValueHash, err)
 			continue
@@ -597,6 +644,53 @@ func testGetDerivedBitcoinAddress(t *testing.T) {
 	}
 }
 
+func testGetDerivedBitcoinAddressP2WSH(t *testing.T) {
+	fedAddresses := map[string]string{
+		"testnet": "tb1qudc7zupsz65tw5c3f2d855ess8m6uyjk07mssrj5a0d9p5glq7tsuqg40z",
+		"mainnet": "bc1qudc7zupsz65tw5c3f2d855ess8m6uyjk07mssrj5a0d9p5glq7tstg764d",
+	}
+	expected := []string{
+		"tb1qd6av526nea0278mltwqc2wfrphmfrwelwfm7zlgd4kvexhaatlcq5awgd7",
+		"tb1q6sxqr03fq5g5mq6y98mh4u53wpxstaac68uf86pr28ewmrqhuwfqy2ut2y",
+		"bc1qgve6vqke7m6nmsnpufhvsp80z30ta67sw5astxwdm8sr7e5d7ejsw4mvlv",
+		"bc1qj93aze3d7mcdtrjeg9qxjyanstju3kazp33u0nep4r3fzx6un48sel5hv4",
+	}
+	for i, tt := range testQuotes {
+		btc, err := NewBTC(tt.NetworkParams)
+		if err != nil {
+			t.Errorf("error initializing BTC: %v", err)
+			continue
+		}
+		fedInfo := getFakeFedInfo()
+		fedInfo.IrisActivationHeight = 1
+		fedInfo.FedAddress = fedAddresses[tt.NetworkParams]
+		lbcAddr, err := DecodeRSKAddress(tt.LBCAddr)
+		assert.Nil(t, err)
+		hashBytes, err := hex.DecodeString(tt.QuoteHash)
+		assert.Nil(t, err)
+		userBtcRefundAddr, err := DecodeBTCAddressWithVersion(tt.BTCRefundAddr)
+		assert.Nil(t, err)
+		lpBtcAddress, err := DecodeBTCAddressWithVersion(tt.LPBTCAddr)
+		assert.Nil(t, err)
+
+		_, err = btc.GetDerivedBitcoinAddress(fedInfo, userBtcRefundAddr, lbcAddr, lpBtcAddress, hashBytes)
+		assert.EqualError(t, err, "federation address type mismatch: expected p2sh, bridge returned a p2wsh address")
+
+		err = btc.SetFedAddressType(FedAddressTypeP2WSH)
+		assert.Nil(t, err)
+		addr, err := btc.GetDerivedBitcoinAddress(fedInfo, userBtcRefundAddr, lbcAddr, lpBtcAddress, hashBytes)
+		assert.Nil(t, err)
+		assert.EqualValues(t, expected[i], addr)
+
+		fedInfo.FedAddress = tt.ExpectedAddressHash
+		_, err = btc.GetDerivedBitcoinAddress(fedInfo, userBtcRefundAddr, lbcAddr, lpBtcAddress, hashBytes)
+		assert.EqualError(t, err, "federation address type mismatch: expected p2wsh, bridge returned a p2sh address")
+	}
+	btc, err := NewBTC("mainnet")
+	assert.Nil(t, err)
+	assert.NotNil(t, btc.SetFedAddressType("p2pkh"))
+}
+
 func testCheckBtcAddr(t *testing.T) {
 	btcClientMock := new(testmocks.BTCClientMock)
 	addrWatcherMock := new(testmocks.AddressWatcherMock)
@@ -683,6 +777,186 @@ func testCheckBtcAddr(t *testing.T) {
 	addrWatcherMock.AssertExpectations(t)
 }
 
+func testCheckBtcAddrReorgSafety(t *testing.T) {
+	btcClientMock := new(testmocks.BTCClientMock)
+	addrWatcherMock := new(testmocks.AddressWatcherMock)
+	amountInBtc := float64(1)
+	amount, err := btcutil.NewAmount(amountInBtc)
+	assert.Nil(t, err)
+	txHash := "4a3eca107f22707e5dbc79964f3e6c21ec5e354e0903391245d9fdbe6bd2b2f0"
+	blockHash := "000000000000000000013b8ac0c2d6b9b4b1a5b8b5ba3d7c8d4bbd1f2a3c4d5e"
+	now := func() time.Time { return time.Unix(0, 0) }
+	var confirmations int64
+
+	btc, err := NewBTC("mainnet")
+	if err != nil {
+		t.Fatalf("error initializing BTC: %v", err)
+	}
+	btc.c = btcClientMock
+	btc.SetReorgSafetyDepth(2)
+	btcAddr, err := btcutil.DecodeAddress("38r8PQdgw5vdebE9h12Eum6saVnWEXxbve", &btc.params)
+	if err != nil {
+		t.Fatalf("error initializing BTC: %v", err)
+	}
+	btcClientMock.On("GetTransaction", mock.AnythingOfType("*chainhash.Hash")).Return(&btcjson.GetTransactionResult{BlockHash: blockHash}, nil)
+
+	// only confirmations beyond the safety depth are reported
+	btcClientMock.On("ListUnspentMinMaxAddresses", 0, 9999, mock.AnythingOfType("[]btcutil.Address")).Return([]btcjson.ListUnspentResult{{TxID: txHash, Confirmations: 3, Amount: amountInBtc}}, nil).Once()
+	btcClientMock.On("GetBlockVerbose", mock.AnythingOfType("*chainhash.Hash")).Return(&btcjson.GetBlockVerboseResult{Confirmations: 3, Height: 100, Tx: []string{txHash}}, nil).Once()
+	addrWatcherMock.On("OnNewConfirmation", txHash, int64(1), amount).Once()
+	err = btc.checkBtcAddr(addrWatcherMock, btcAddr, amount, time.Unix(0, 0), &confirmations, now)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, confirmations)
+
+	// a deposit whose block was reorged out isn't reported
+	btcClientMock.On("ListUnspentMinMaxAddresses", 0, 9999, mock.AnythingOfType("[]btcutil.Address")).Return([]btcjson.ListUnspentResult{{TxID: txHash, Confirmations: 4, Amount: amountInBtc}}, nil).Once()
+	btcClientMock.On("GetBlockVerbose", mock.AnythingOfType("*chainhash.Hash")).Return(&btcjson.GetBlockVerboseResult{Confirmations: -1, Height: 100, Tx: []string{txHash}}, nil).Once()
+	err = btc.checkBtcAddr(addrWatcherMock, btcAddr, amount, time.Unix(0, 0), &confirmations, now)
+	assert.EqualError(t, err, "block "+blockHash+" including tx "+txHash+" is no longer in the main chain")
+	assert.EqualValues(t, 1, confirmations)
+
+	// neither is one that is no longer included in the block
+	btcClientMock.On("ListUnspentMinMaxAddresses", 0, 9999, mock.AnythingOfType("[]btcutil.Address")).Return([]btcjson.ListUnspentResult{{TxID: txHash, Confirmations: 4, Amount: amountInBtc}}, nil).Once()
+	btcClientMock.On("GetBlockVerbose", mock.AnythingOfType("*chainhash.Hash")).Return(&btcjson.GetBlockVerboseResult{Confirmations: 4, Height: 100}, nil).Once()
+	err = btc.checkBtcAddr(addrWatcherMock, btcAddr, amount, time.Unix(0, 0), &confirmations, now)
+	assert.EqualError(t, err, "tx "+txHash+" is no longer included in block "+blockHash+" at height 100")
+
+	// confirmations within the safety depth aren't reported
+	confirmations = 0
+	btcClientMock.On("ListUnspentMinMaxAddresses", 0, 9999, mock.AnythingOfType("[]btcutil.Address")).Return([]btcjson.ListUnspentResult{{TxID: txHash, Confirmations: 2, Amount: amountInBtc}}, nil).Once()
+	btcClientMock.On("GetBlockVerbose", mock.AnythingOfType("*chainhash.Hash")).Return(&btcjson.GetBlockVerboseResult{Confirmations: 2, Height: 100, Tx: []string{txHash}}, nil).Once()
+	err = btc.checkBtcAddr(addrWatcherMock, btcAddr, amount, time.Unix(0, 0), &confirmations, now)
+	assert.EqualError(t, err, "num of confirmations has not advanced; conf: 0")
+	btcClientMock.AssertExpectations(t)
+	addrWatcherMock.AssertExpectations(t)
+}
+
+func testNextPollDelay(t *testing.T) {
+	btc, err := NewBTC("mainnet")
+	if err != nil {
+		t.Fatalf("error initializing BTC: %v", err)
+	}
+	now := time.Unix(1000, 0)
+	interval := time.Minute
+	assertDelay := func(expected time.Duration, exp time.Time) {
+		for i := 0; i < 100; i++ {
+			d := btc.nextPollDelay(interval, exp, now)
+			assert.GreaterOrEqual(t, int64(d), int64(expected-expected/pollJitterDivisor))
+			assert.LessOrEqual(t, int64(d), int64(expected+expected/pollJitterDivisor))
+		}
+	}
+
+	assertDelay(interval, now.Add(time.Hour))
+	assertDelay(interval, now.Add(time.Minute))
+
+	btc.SetAdaptivePolling(true)
+	assertDelay(2*interval, now.Add(time.Hour))
+	assertDelay(interval, now.Add(10*time.Minute))
+	assertDelay(interval/4, now.Add(time.Minute))
+	assertDelay(interval, now.Add(-time.Minute))
+}
+
+func testLimitedBTCClient(t *testing.T) {
+	btcClientMock := new(testmocks.BTCClientMock)
+	unblock := make(chan time.Time)
+	btcClientMock.On("GetNetworkInfo").WaitUntil(unblock).Return(&btcjson.GetNetworkInfoResult{}, nil).Times(2)
+	l := newLimitedBTCClient(btcClientMock, 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := l.GetNetworkInfo()
+			assert.Nil(t, err)
+		}()
+	}
+	assert.Eventually(t, func() bool { return l.queueDepth() == 1 }, time.Second, time.Millisecond)
+	close(unblock)
+	wg.Wait()
+	assert.EqualValues(t, 0, l.queueDepth())
+	btcClientMock.AssertExpectations(t)
+}
+
+func testMeteredBTCClient(t *testing.T) {
+	btcClientMock := new(testmocks.BTCClientMock)
+	btcClientMock.On("GetNetworkInfo").Return(&btcjson.GetNetworkInfoResult{}, nil).Once()
+	btcClientMock.On("GetNetworkInfo").Return((*btcjson.GetNetworkInfoResult)(nil), errors.New("connection refused")).Once()
+	notFound := &btcjson.RPCError{Code: btcjson.ErrRPCInvalidAddressOrKey, Message: "Invalid or non-wallet transaction id"}
+	btcClientMock.On("GetTransaction", mock.Anything).Return((*btcjson.GetTransactionResult)(nil), notFound)
+	metrics, err := newBTCMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("couldn't register metrics. error: %v", err)
+	}
+	m := newMeteredBTCClient(btcClientMock, metrics, "127.0.0.1:18332")
+
+	_, err = m.GetNetworkInfo()
+	assert.Nil(t, err)
+	_, err = m.GetNetworkInfo()
+	assert.NotNil(t, err)
+	// unknown transactions are answered by a healthy node
+	_, err = m.GetTransaction(&chainhash.Hash{})
+	assert.Equal(t, notFound, err)
+	assert.EqualValues(t, 3, testutil.ToFloat64(metrics.requests.WithLabelValues("127.0.0.1:18332")))
+	assert.EqualValues(t, 1, testutil.ToFloat64(metrics.errors.WithLabelValues("127.0.0.1:18332")))
+	btcClientMock.AssertExpectations(t)
+}
+
+func testCheckFedAddressNetwork(t *testing.T) {
+	var tests = []struct {
+		network  string
+		fedAddr  string
+		expected string
+	}{
+		{"testnet", "2N5muMepJizJE1gR7FbHJU6CD18V3BpNF9p", ""},
+		{"regtest", "2N5muMepJizJE1gR7FbHJU6CD18V3BpNF9p", ""},
+		{"mainnet", "3EDhHutH7XnsotnZaTfRr9CwnnGsNNrhCL", ""},
+		{"regtest", "3EDhHutH7XnsotnZaTfRr9CwnnGsNNrhCL", "BTC network mismatch: bridge returned a mainnet address but connector is regtest"},
+		{"mainnet", "2N5muMepJizJE1gR7FbHJU6CD18V3BpNF9p", "BTC network mismatch: bridge returned a testnet address but connector is mainnet"},
+		{"mainnet", "invalid", "BTC network mismatch: bridge returned address invalid, which is not valid for any known network; connector is mainnet"},
+	}
+	for _, tt := range tests {
+		btc, err := NewBTC(tt.network)
+		if err != nil {
+			t.Fatalf("error initializing BTC connector: %v", err)
+		}
+		err = btc.CheckFedAddressNetwork(tt.fedAddr)
+		if tt.expected == "" {
+			assert.Nil(t, err)
+			continue
+		}
+		assert.EqualError(t, err, tt.expected)
+	}
+}
+
+func testDecodeBTCAddressWithType(t *testing.T) {
+	var tests = []struct {
+		addr     string
+		addrType string
+		version  byte
+		err      string
+	}{
+		{"mnxKdPFrYqLSUy2oP1eno8n5X8AwkcnPjk", BtcAddressTypeP2PKH, 0x6f, ""},
+		{"2NDjJznHgtH1rzq63eeFG3SiDi5wxE25FSz", BtcAddressTypeP2SH, 0xc4, ""},
+		{"3EDhHutH7XnsotnZaTfRr9CwnnGsNNrhCL", BtcAddressTypeP2SH, 0x05, ""},
+		{"tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", BtcAddressTypeBech32, 0,
+			"bech32 addresses are not supported. address: tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx"},
+		{"invalid", "", 0, "the provider address is not a valid base58 encoded address. address: invalid"},
+	}
+	for _, tt := range tests {
+		bts, addrType, err := DecodeBTCAddressWithType(tt.addr)
+		assert.Equal(t, tt.addrType, addrType)
+		if tt.err != "" {
+			assert.EqualError(t, err, tt.err)
+			continue
+		}
+		if assert.Nil(t, err) {
+			assert.Len(t, bts, 21)
+			assert.Equal(t, tt.version, bts[0])
+		}
+	}
+}
+
 func TestBitcoinConnector(t *testing.T) {
 	t.Run("test derivation complete", testDerivationComplete)
 	t.Run("test get powpeg redeem script", testBuildPowPegRedeemScript)
@@ -696,6 +970,14 @@ func TestBitcoinConnector(t *testing.T) {
 	t.Run("test get flyover erp address hash fallback", testBuildFlyoverErpAddressHashFallback)
 	t.Run("test pmt serialization", testPMTSerialization)
 	t.Run("test tx serialization", testSerializeTx)
+	t.Run("test build register pegin params", testBuildRegisterPegInParams)
 	t.Run("test get derived bitcoin address", testGetDerivedBitcoinAddress)
+	t.Run("test get derived bitcoin address p2wsh", testGetDerivedBitcoinAddressP2WSH)
 	t.Run("test check btc addr", testCheckBtcAddr)
+	t.Run("test check fed address network", testCheckFedAddressNetwork)
+	t.Run("test decode btc address with type", testDecodeBTCAddressWithType)
+	t.Run("test check btc addr reorg safety", testCheckBtcAddrReorgSafety)
+	t.Run("test next poll delay", testNextPollDelay)
+	t.Run("test limited btc client", testLimitedBTCClient)
+	t.Run("test metered btc client", testMeteredBTCClient)
 }
@@ -0,0 +1,84 @@
+package connectors
+
+import (
+	"sync/atomic"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// limitedBTCClient bounds the amount of RPC calls in flight to the bitcoin node, queuing the rest
+type limitedBTCClient struct {
+	c      BTCClient
+	sem    chan struct{}
+	queued int64
+}
+
+func newLimitedBTCClient(c BTCClient, maxCalls uint) *limitedBTCClient {
+	return &limitedBTCClient{
+		c:   c,
+		sem: make(chan struct{}, maxCalls),
+	}
+}
+
+func (l *limitedBTCClient) acquire() {
+	atomic.AddInt64(&l.queued, 1)
+	l.sem <- struct{}{}
+	atomic.AddInt64(&l.queued, -1)
+}
+
+func (l *limitedBTCClient) release() {
+	<-l.sem
+}
+
+func (l *limitedBTCClient) queueDepth() int64 {
+	return atomic.LoadInt64(&l.queued)
+}
+
+func (l *limitedBTCClient) ImportAddressRescan(address string, account string, rescan bool) error {
+	l.acquire()
+	defer l.release()
+	return l.c.ImportAddressRescan(address, account, rescan)
+}
+
+func (l *limitedBTCClient) GetTransaction(txHash *chainhash.Hash) (*btcjson.GetTransactionResult, error) {
+	l.acquire()
+	defer l.release()
+	return l.c.GetTransaction(txHash)
+}
+
+func (l *limitedBTCClient) GetBlockVerbose(blockHash *chainhash.Hash) (*btcjson.GetBlockVerboseResult, error) {
+	l.acquire()
+	defer l.release()
+	return l.c.GetBlockVerbose(blockHash)
+}
+
+func (l *limitedBTCClient) ListUnspentMinMaxAddresses(minConf, maxConf int, addrs []btcutil.Address) ([]btcjson.ListUnspentResult, error) {
+	l.acquire()
+	defer l.release()
+	return l.c.ListUnspentMinMaxAddresses(minConf, maxConf, addrs)
+}
+
+func (l *limitedBTCClient) GetBlock(blockHash *chainhash.Hash) (*wire.MsgBlock, error) {
+	l.acquire()
+	defer l.release()
+	return l.c.GetBlock(blockHash)
+}
+
+func (l *limitedBTCClient) GetRawTransaction(txHash *chainhash.Hash) (*btcutil.Tx, error) {
+	l.acquire()
+	defer l.release()
+	return l.c.GetRawTransaction(txHash)
+}
+
+func (l *limitedBTCClient) GetNetworkInfo() (*btcjson.GetNetworkInfoResult, error) {
+	l.acquire()
+	defer l.release()
+	return l.c.GetNetworkInfo()
+}
+
+func (l *limitedBTCClient) Disconnect() {
+	l.c.Disconnect()
+}
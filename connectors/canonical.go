@@ -0,0 +1,46 @@
+package connectors
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/rsksmart/liquidity-provider/types"
+)
+
+// CanonicalJSON serializes a quote with sorted keys, lowercase 0x-prefixed hex values and decimal amounts, so that
+// equal quotes always produce the same bytes regardless of how they were originally encoded
+func CanonicalJSON(q *types.Quote) ([]byte, error) {
+	m := map[string]interface{}{
+		"fedBTCAddr":         q.FedBTCAddr,
+		"lbcAddr":            canonicalHex(q.LBCAddr),
+		"lpRSKAddr":          canonicalHex(q.LPRSKAddr),
+		"btcRefundAddr":      q.BTCRefundAddr,
+		"rskRefundAddr":      canonicalHex(q.RSKRefundAddr),
+		"lpBTCAddr":          q.LPBTCAddr,
+		"callFee":            canonicalWei(q.CallFee),
+		"penaltyFee":         canonicalWei(q.PenaltyFee),
+		"contractAddr":       canonicalHex(q.ContractAddr),
+		"data":               canonicalHex(q.Data),
+		"gasLimit":           q.GasLimit,
+		"nonce":              q.Nonce,
+		"value":              canonicalWei(q.Value),
+		"agreementTimestamp": q.AgreementTimestamp,
+		"timeForDeposit":     q.TimeForDeposit,
+		"callTime":           q.CallTime,
+		"confirmations":      q.Confirmations,
+		"callOnRegister":     q.CallOnRegister,
+	}
+	return json.Marshal(m) // map keys are always encoded in sorted order
+}
+
+func canonicalHex(s string) string {
+	s = strings.ToLower(s)
+	return "0x" + strings.TrimPrefix(s, "0x")
+}
+
+func canonicalWei(w *types.Wei) string {
+	if w == nil {
+		return "0"
+	}
+	return w.AsBigInt().String()
+}
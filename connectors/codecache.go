@@ -0,0 +1,65 @@
+package connectors
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// codePresenceTTL is short, since an address without code can get a contract deployed at any time
+const codePresenceTTL = 30 * time.Second
+
+type codePresenceEntry struct {
+	hasCode bool
+	expires time.Time
+}
+
+// codePresenceCache keeps whether addresses have code for a short time, to avoid a CodeAt call per quote request
+// targeting the same contract. A nil codePresenceCache caches nothing.
+type codePresenceCache struct {
+	ttl     time.Duration
+	now     func() time.Time
+	mu      sync.Mutex
+	entries map[common.Address]codePresenceEntry
+}
+
+func newCodePresenceCache(ttl time.Duration, now func() time.Time) *codePresenceCache {
+	return &codePresenceCache{
+		ttl:     ttl,
+		now:     now,
+		entries: make(map[common.Address]codePresenceEntry),
+	}
+}
+
+func (c *codePresenceCache) get(addr common.Address) (hasCode bool, ok bool) {
+	if c == nil {
+		return false, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[addr]
+	if !ok {
+		return false, false
+	}
+	if !c.now().Before(e.expires) {
+		delete(c.entries, addr)
+		return false, false
+	}
+	return e.hasCode, true
+}
+
+func (c *codePresenceCache) put(addr common.Address, hasCode bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for a, e := range c.entries { // drop expired entries so the cache doesn't grow unbounded
+		if !now.Before(e.expires) {
+			delete(c.entries, a)
+		}
+	}
+	c.entries[addr] = codePresenceEntry{hasCode: hasCode, expires: now.Add(c.ttl)}
+}
@@ -0,0 +1,74 @@
+package connectors
+
+import "sync"
+
+// completeness of the federation info cache, as reported by FedCacheStatus
+const (
+	FedCacheEmpty    = "empty"
+	FedCachePartial  = "partial"
+	FedCacheComplete = "complete"
+)
+
+// fedInfoCache keeps the last federation info fetched from the bridge. A federation change always comes with a new
+// active federation creation block height, so the info stays valid while the height doesn't change, and a single
+// bridge call is enough to tell. The info may be partial when some of the bridge calls failed: the pieces that weren't
+// fetched are left zero valued, so that only those are fetched on the next attempt. The zero value is ready to use.
+type fedInfoCache struct {
+	mu   sync.Mutex
+	info *FedInfo
+}
+
+// get returns whatever is cached for the federation created at the given height, or nil, and whether it's complete
+func (c *fedInfoCache) get(activeFedBlockHeight int) (*FedInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.info == nil || c.info.ActiveFedBlockHeight != activeFedBlockHeight {
+		return nil, false
+	}
+	return copyFedInfo(c.info), isFedInfoComplete(c.info)
+}
+
+func (c *fedInfoCache) put(info *FedInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.info = copyFedInfo(info)
+}
+
+func (c *fedInfoCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.info = nil
+}
+
+func (c *fedInfoCache) status() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.info == nil:
+		return FedCacheEmpty
+	case isFedInfoComplete(c.info):
+		return FedCacheComplete
+	default:
+		return FedCachePartial
+	}
+}
+
+func isFedInfoComplete(info *FedInfo) bool {
+	if info.FedSize == 0 || info.FedThreshold == 0 || info.FedAddress == "" || len(info.PubKeys) != info.FedSize {
+		return false
+	}
+	for _, k := range info.PubKeys {
+		if k == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// copyFedInfo keeps callers from modifying the cached keys
+func copyFedInfo(info *FedInfo) *FedInfo {
+	cp := *info
+	cp.PubKeys = append([]string(nil), info.PubKeys...)
+	cp.ErpKeys = append([]string(nil), info.ErpKeys...)
+	return &cp
+}
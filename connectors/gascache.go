@@ -0,0 +1,83 @@
+package connectors
+
+import (
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+type gasEstimationKey struct {
+	addr       common.Address
+	dataHash   common.Hash
+	value      string
+	newAccount bool
+}
+
+type gasEstimationEntry struct {
+	gas     uint64
+	expires time.Time
+}
+
+// gasEstimationCache keeps recent gas estimations for a short time, since the estimation for the same call can drift
+// as the contract state changes
+type gasEstimationCache struct {
+	ttl     time.Duration
+	now     func() time.Time
+	mu      sync.Mutex
+	entries map[gasEstimationKey]gasEstimationEntry
+	hits    uint64
+	misses  uint64
+}
+
+func newGasEstimationCache(ttl time.Duration, now func() time.Time) *gasEstimationCache {
+	return &gasEstimationCache{
+		ttl:     ttl,
+		now:     now,
+		entries: make(map[gasEstimationKey]gasEstimationEntry),
+	}
+}
+
+func newGasEstimationKey(addr common.Address, value *big.Int, data []byte, newAccount bool) gasEstimationKey {
+	return gasEstimationKey{
+		addr:       addr,
+		dataHash:   crypto.Keccak256Hash(data),
+		value:      value.String(),
+		newAccount: newAccount,
+	}
+}
+
+func (c *gasEstimationCache) get(key gasEstimationKey) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok && c.now().Before(e.expires) {
+		c.hits++
+		return e.gas, true
+	}
+	if ok {
+		delete(c.entries, key)
+	}
+	c.misses++
+	return 0, false
+}
+
+func (c *gasEstimationCache) put(key gasEstimationKey, gas uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for k, e := range c.entries { // drop expired entries so the cache doesn't grow unbounded
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = gasEstimationEntry{gas: gas, expires: now.Add(c.ttl)}
+}
+
+func (c *gasEstimationCache) stats() (hits uint64, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
@@ -0,0 +1,61 @@
+package connectors
+
+import (
+	"context"
+	"math/big"
+	"sync"
+)
+
+type gasPriceCall struct {
+	done     chan struct{}
+	price    *big.Int
+	err      error
+	canceled bool
+}
+
+// gasPriceFlight deduplicates concurrent gas price fetches, so a burst of quote requests triggers a single RPC whose
+// result is shared by every caller waiting on it. The zero value is ready to use.
+type gasPriceFlight struct {
+	mu   sync.Mutex
+	call *gasPriceCall
+}
+
+// do runs fetch with the context of the first caller. Callers waiting on it return early when their own context is
+// done, and fetch again if the first caller gave up before getting a price.
+func (f *gasPriceFlight) do(ctx context.Context, fetch func(context.Context) (*big.Int, error)) (*big.Int, error) {
+	for {
+		f.mu.Lock()
+		c := f.call
+		if c == nil {
+			break
+		}
+		f.mu.Unlock()
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if !c.canceled {
+			return copyPrice(c.price), c.err
+		}
+	}
+	c := &gasPriceCall{done: make(chan struct{})}
+	f.call = c
+	f.mu.Unlock()
+
+	c.price, c.err = fetch(ctx)
+	c.canceled = c.err != nil && ctx.Err() != nil
+	f.mu.Lock()
+	f.call = nil
+	f.mu.Unlock()
+	close(c.done)
+	return copyPrice(c.price), c.err
+}
+
+// copyPrice keeps callers from modifying the price handed to the others
+func copyPrice(price *big.Int) *big.Int {
+	if price == nil {
+		return nil
+	}
+	return new(big.Int).Set(price)
+}
@@ -0,0 +1,167 @@
+package connectors
+
+import (
+	"errors"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/ethereum/go-ethereum"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// rskMetrics records every attempt of the calls made to the RSK node, by connector method, so that slow methods and
+// the ones being retried stand out. The request and error totals, by endpoint, back alerts on the node's error ratio.
+type rskMetrics struct {
+	latency  *prometheus.HistogramVec
+	retries  *prometheus.CounterVec
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	endpoint string
+}
+
+func newRSKMetrics(reg prometheus.Registerer) (*rskMetrics, error) {
+	m := &rskMetrics{
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "lps",
+			Name:      "rsk_call_duration_seconds",
+			Help:      "Duration of each attempt of the calls made to the RSK node, by method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "lps",
+			Name:      "rsk_call_retries_total",
+			Help:      "Number of attempts of the calls made to the RSK node past the first one, by method.",
+		}, []string{"method"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "lps",
+			Name:      "rsk_rpc_requests_total",
+			Help:      "Number of attempts of the calls made to the RSK node, by endpoint.",
+		}, []string{"endpoint"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "lps",
+			Name:      "rsk_rpc_errors_total",
+			Help:      "Number of attempts of the calls made to the RSK node that failed, by endpoint. Reverts and missing receipts aren't failures.",
+		}, []string{"endpoint"}),
+	}
+	for _, c := range []prometheus.Collector{m.latency, m.retries, m.requests, m.errors} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// observe records an attempt of a call that began at start and failed with err, if not nil. It's a no-op when metrics
+// aren't enabled.
+func (m *rskMetrics) observe(method string, attempt int, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.latency.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if attempt > 0 {
+		m.retries.WithLabelValues(method).Inc()
+	}
+	m.requests.WithLabelValues(m.endpoint).Inc()
+	// the node answered these, so they don't tell anything about its health
+	if err != nil && !isRevert(err) && !errors.Is(err, ethereum.NotFound) {
+		m.errors.WithLabelValues(m.endpoint).Inc()
+	}
+}
+
+// btcMetrics counts the RPC calls made to the bitcoin node, and how many of them failed, by endpoint
+type btcMetrics struct {
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+}
+
+func newBTCMetrics(reg prometheus.Registerer) (*btcMetrics, error) {
+	m := &btcMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "lps",
+			Name:      "btc_rpc_requests_total",
+			Help:      "Number of RPC calls made to the bitcoin node, by endpoint.",
+		}, []string{"endpoint"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "lps",
+			Name:      "btc_rpc_errors_total",
+			Help:      "Number of RPC calls made to the bitcoin node that failed, by endpoint. Lookups of unknown transactions or blocks aren't failures.",
+		}, []string{"endpoint"}),
+	}
+	for _, c := range []prometheus.Collector{m.requests, m.errors} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// meteredBTCClient counts the calls made through it, and their failures, under the endpoint it was created for
+type meteredBTCClient struct {
+	c        BTCClient
+	metrics  *btcMetrics
+	endpoint string
+}
+
+func newMeteredBTCClient(c BTCClient, metrics *btcMetrics, endpoint string) *meteredBTCClient {
+	return &meteredBTCClient{c: c, metrics: metrics, endpoint: endpoint}
+}
+
+func (m *meteredBTCClient) observe(err error) {
+	m.metrics.requests.WithLabelValues(m.endpoint).Inc()
+	var rpcErr *btcjson.RPCError
+	if errors.As(err, &rpcErr) && rpcErr.Code == btcjson.ErrRPCInvalidAddressOrKey {
+		return
+	}
+	if err != nil {
+		m.metrics.errors.WithLabelValues(m.endpoint).Inc()
+	}
+}
+
+func (m *meteredBTCClient) ImportAddressRescan(address string, account string, rescan bool) error {
+	err := m.c.ImportAddressRescan(address, account, rescan)
+	m.observe(err)
+	return err
+}
+
+func (m *meteredBTCClient) GetTransaction(txHash *chainhash.Hash) (*btcjson.GetTransactionResult, error) {
+	res, err := m.c.GetTransaction(txHash)
+	m.observe(err)
+	return res, err
+}
+
+func (m *meteredBTCClient) GetBlockVerbose(blockHash *chainhash.Hash) (*btcjson.GetBlockVerboseResult, error) {
+	res, err := m.c.GetBlockVerbose(blockHash)
+	m.observe(err)
+	return res, err
+}
+
+func (m *meteredBTCClient) ListUnspentMinMaxAddresses(minConf, maxConf int, addrs []btcutil.Address) ([]btcjson.ListUnspentResult, error) {
+	res, err := m.c.ListUnspentMinMaxAddresses(minConf, maxConf, addrs)
+	m.observe(err)
+	return res, err
+}
+
+func (m *meteredBTCClient) GetBlock(blockHash *chainhash.Hash) (*wire.MsgBlock, error) {
+	res, err := m.c.GetBlock(blockHash)
+	m.observe(err)
+	return res, err
+}
+
+func (m *meteredBTCClient) GetRawTransaction(txHash *chainhash.Hash) (*btcutil.Tx, error) {
+	res, err := m.c.GetRawTransaction(txHash)
+	m.observe(err)
+	return res, err
+}
+
+func (m *meteredBTCClient) GetNetworkInfo() (*btcjson.GetNetworkInfoResult, error) {
+	res, err := m.c.GetNetworkInfo()
+	m.observe(err)
+	return res, err
+}
+
+func (m *meteredBTCClient) Disconnect() {
+	m.c.Disconnect()
+}
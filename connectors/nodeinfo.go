@@ -0,0 +1,22 @@
+package connectors
+
+import "math/big"
+
+type NodeInfo struct {
+	ClientVersion string   `json:"clientVersion"`
+	ChainId       *big.Int `json:"chainId"`
+	Network       string   `json:"network"`
+}
+
+func networkName(chainId *big.Int) string {
+	switch chainId.Int64() {
+	case 30:
+		return "mainnet"
+	case 31:
+		return "testnet"
+	case 33:
+		return "regtest"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,32 @@
+package connectors
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// parseProxyURL validates the URL of a proxy the RPC connections are dialed through
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy URL: unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy URL: missing host")
+	}
+	return u, nil
+}
+
+// proxyFunc returns the explicitly configured proxy, falling back to HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+func proxyFunc(proxy *url.URL) func(*http.Request) (*url.URL, error) {
+	if proxy != nil {
+		return http.ProxyURL(proxy)
+	}
+	return http.ProxyFromEnvironment
+}
@@ -0,0 +1,61 @@
+package connectors
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultRetries    = 3
+	defaultRetrySleep = 2 * time.Second
+)
+
+// retryPolicy sets how many times the RPC calls are attempted and how long to wait between attempts. The wait doubles
+// after each failed attempt, up to maxSleep. Zero values fall back to the defaults, which retry at a fixed interval.
+type retryPolicy struct {
+	retries  int
+	sleep    time.Duration
+	maxSleep time.Duration
+}
+
+func (p retryPolicy) attempts() int {
+	if p.retries <= 0 {
+		return defaultRetries
+	}
+	return p.retries
+}
+
+// backoff returns the wait after the given failed attempt, counting from 0
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.sleep
+	if d <= 0 {
+		d = defaultRetrySleep
+	}
+	max := p.maxSleep
+	if max < d {
+		max = d
+	}
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// wait sleeps before the attempt that follows the given one, and doesn't sleep after the last attempt. It returns early
+// with the context error when the caller gives up, so that loops stop retrying on behalf of canceled requests.
+func (p retryPolicy) wait(ctx context.Context, attempt int) error {
+	if attempt >= p.attempts()-1 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(p.backoff(attempt))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
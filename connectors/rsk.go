@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/gorilla/websocket"
 	"net/http"
 	"net/url"
 
@@ -20,55 +21,135 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rsksmart/liquidity-provider/types"
 
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	retries    int = 3
-	rpcSleep       = 2 * time.Second
-	rpcTimeout     = 5 * time.Second
-	ethSleep       = 5 * time.Second
-	ethTimeout     = 5 * time.Minute
+	rpcTimeout = 5 * time.Second
+	ethSleep   = 5 * time.Second
+	ethTimeout = 5 * time.Minute
 
 	newAccountGasCost = uint64(25000)
+	plainTransferGas  = uint64(21000)
+
+	maxBtcTxSize = 100000 // max size of a standard bitcoin transaction, as relayed by bitcoin nodes
+	maxPMTSize   = 4096   // a PMT proving a single transaction is a few hundred bytes even for full blocks
+
+	wsBufferSize = 1024
+)
+
+var ErrInvalidPegInProof = errors.New("invalid peg-in proof")
+var ErrFederationUnavailable = errors.New("federation unavailable")
+
+// categories of the errors returned by the connector; the RSK node being unreachable is transient, while a call it
+// rejected or an address that couldn't be parsed will fail the same way if retried
+var ErrNodeUnavailable = errors.New("rsk node unavailable")
+var ErrContractCall = errors.New("contract call failed")
+var ErrInvalidAddress = errors.New("invalid address")
+var ErrNoBaseFee = errors.New("rsk node reports no base fee")
+var ErrTxReverted = errors.New("transaction reverted")
+var ErrTxNotMined = errors.New("transaction not mined")
+
+// CallRevertError is returned when the node reports that a call would revert. Reason holds the message the contract
+// reverted with, when it gave one. It matches ErrContractCall, since it's a call the node rejected.
+type CallRevertError struct {
+	Reason string
+	err    error
+}
+
+func (e *CallRevertError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("call would revert: %v", e.err)
+	}
+	return fmt.Sprintf("call would revert: %v: %v", e.Reason, e.err)
+}
+
+func (e *CallRevertError) Unwrap() error {
+	return ErrContractCall
+}
+
+// the LBC's encodeQuote packs the quote in two parts, since abi.encode can't take all its fields at once, and hashes
+// abi.encode(encodePart1(quote), encodePart2(quote)); these mirror it so that quotes can be hashed without an RPC call
+var (
+	quoteArgs = abi.Arguments{
+		{Type: mustNewType("bytes")},
+		{Type: mustNewType("bytes")},
+	}
+	quotePart1Args = abi.Arguments{
+		{Type: mustNewType("bytes20")},
+		{Type: mustNewType("address")},
+		{Type: mustNewType("address")},
+		{Type: mustNewType("bytes")},
+		{Type: mustNewType("address")},
+		{Type: mustNewType("bytes")},
+		{Type: mustNewType("uint256")},
+		{Type: mustNewType("uint256")},
+		{Type: mustNewType("address")},
+	}
+	quotePart2Args = abi.Arguments{
+		{Type: mustNewType("bytes")},
+		{Type: mustNewType("uint32")},
+		{Type: mustNewType("int64")},
+		{Type: mustNewType("uint256")},
+		{Type: mustNewType("uint32")},
+		{Type: mustNewType("uint32")},
+		{Type: mustNewType("uint32")},
+		{Type: mustNewType("uint16")},
+		{Type: mustNewType("bool")},
+	}
 )
 
 type RSKConnector interface {
 	Connect(endpoint string, chainId *big.Int) error
-	CheckConnection() error
+	CheckConnection(ctx context.Context) error
+	HealthCheck(ctx context.Context) (bool, error)
 	Close()
-	GetChainId() (*big.Int, error)
-	EstimateGas(addr string, value *big.Int, data []byte) (uint64, error)
-	GasPrice() (*big.Int, error)
-	HashQuote(q *types.Quote) (string, error)
+	GetChainId(ctx context.Context) (*big.Int, error)
+	EstimateGas(ctx context.Context, addr string, value *big.Int, data []byte) (uint64, error)
+	IsContract(ctx context.Context, addr string) (bool, error)
+	GasPrice(ctx context.Context) (*big.Int, error)
+	HashQuote(ctx context.Context, q *types.Quote) (string, error)
 	ParseQuote(q *types.Quote) (bindings.LiquidityBridgeContractQuote, error)
-	RegisterPegIn(opt *bind.TransactOpts, q bindings.LiquidityBridgeContractQuote, signature []byte, tx []byte, pmt []byte, height *big.Int) (*gethTypes.Transaction, error)
-	GetFedSize() (int, error)
-	GetFedThreshold() (int, error)
-	GetFedPublicKey(index int) (string, error)
-	GetFedAddress() (string, error)
-	GetActiveFederationCreationBlockHeight() (int, error)
+	RegisterPegIn(ctx context.Context, opt *bind.TransactOpts, q bindings.LiquidityBridgeContractQuote, signature []byte, tx []byte, pmt []byte, height *big.Int) (*gethTypes.Transaction, error)
+	GetFedSize(ctx context.Context) (int, error)
+	GetFedThreshold(ctx context.Context) (int, error)
+	GetFedPublicKey(ctx context.Context, index int) (string, error)
+	GetFedAddress(ctx context.Context) (string, error)
+	GetActiveFederationCreationBlockHeight(ctx context.Context) (int, error)
 	GetLBCAddress() string
+	GetBridgeAddress() string
 	GetRequiredBridgeConfirmations() int64
-	CallForUser(opt *bind.TransactOpts, q bindings.LiquidityBridgeContractQuote) (*gethTypes.Transaction, error)
-	RegisterPegInWithoutTx(q bindings.LiquidityBridgeContractQuote, signature []byte, tx []byte, pmt []byte, newInt *big.Int) error
-	GetCollateral(addr string) (*big.Int, *big.Int, error)
-	RegisterProvider(opts *bind.TransactOpts) error
-	AddCollateral(opts *bind.TransactOpts) error
-	GetLbcBalance(addr string) (*big.Int, error)
-	GetAvailableLiquidity(addr string) (*big.Int, error)
+	CallForUser(ctx context.Context, opt *bind.TransactOpts, q bindings.LiquidityBridgeContractQuote) (*gethTypes.Transaction, error)
+	RegisterPegInWithoutTx(ctx context.Context, q bindings.LiquidityBridgeContractQuote, signature []byte, tx []byte, pmt []byte, newInt *big.Int) error
+	GetCollateral(ctx context.Context, addr string) (*big.Int, *big.Int, error)
+	RegisterProvider(ctx context.Context, opts *bind.TransactOpts) error
+	AddCollateral(ctx context.Context, opts *bind.TransactOpts) error
+	GetBalance(ctx context.Context, addr string) (*big.Int, error)
+	GetLbcBalance(ctx context.Context, addr string) (*big.Int, error)
+	GetAvailableLiquidity(ctx context.Context, addr string) (*big.Int, error)
 	GetTxStatus(ctx context.Context, tx *gethTypes.Transaction) (bool, error)
-	GetMinimumLockTxValue() (*big.Int, error)
-	FetchFederationInfo() (*FedInfo, error)
+	WaitForTx(ctx context.Context, tx *gethTypes.Transaction, depth uint64, onConfirmation func(confirmations uint64)) (bool, error)
+	WaitForReceipt(ctx context.Context, txHash common.Hash) (*gethTypes.Receipt, error)
+	GetMinimumLockTxValue(ctx context.Context) (*big.Int, error)
+	FetchFederationInfo(ctx context.Context) (*FedInfo, error)
+	FedCacheStatus() string
+	NodeInfo(ctx context.Context) (NodeInfo, error)
+	GetLatestBlockTime(ctx context.Context) (time.Time, error)
+	GetBlockNumber(ctx context.Context) (uint64, error)
 }
 
 type RSK struct {
 	c                           *ethclient.Client
+	rpc                         *rpc.Client
 	lbc                         *bindings.LBC
 	lbcAddress                  common.Address
 	bridge                      *bindings.RskBridge
@@ -76,6 +157,18 @@ type RSK struct {
 	requiredBridgeConfirmations int64
 	irisActivationHeight        int
 	erpKeys                     []string
+	gasCache                    *gasEstimationCache
+	forceGasEstimation          bool
+	proxy                       *url.URL
+	gasPrice                    gasPriceFlight
+	regtest                     bool
+	dynamicFees                 bool
+	gasPriceMarkup              int
+	maxGasPrice                 *big.Int
+	codeCache                   *codePresenceCache
+	fedCache                    fedInfoCache
+	retry                       retryPolicy
+	metrics                     *rskMetrics
 }
 
 func NewRSK(lbcAddress string, bridgeAddress string, requiredBridgeConfirmations int64, irisActivationHeight int, erpKeys []string) (*RSK, error) {
@@ -92,9 +185,21 @@ func NewRSK(lbcAddress string, bridgeAddress string, requiredBridgeConfirmations
 		requiredBridgeConfirmations: requiredBridgeConfirmations,
 		irisActivationHeight:        irisActivationHeight,
 		erpKeys:                     erpKeys,
+		codeCache:                   newCodePresenceCache(codePresenceTTL, time.Now),
 	}, nil
 }
 
+// UseProxy dials the RSK node through the given proxy instead of the one set in the environment, if any; it must be
+// called before Connect
+func (rsk *RSK) UseProxy(proxyURL string) error {
+	u, err := parseProxyURL(proxyURL)
+	if err != nil {
+		return err
+	}
+	rsk.proxy = u
+	return nil
+}
+
 func (rsk *RSK) Connect(endpoint string, chainId *big.Int) error {
 	log.Debug("connecting to RSK node on ", endpoint)
 
@@ -103,39 +208,52 @@ func (rsk *RSK) Connect(endpoint string, chainId *big.Int) error {
 		return err
 	}
 
-	var ethC *ethclient.Client
+	var rpcC *rpc.Client
 	switch u.Scheme {
 	case "http", "https":
 		transport := http.DefaultTransport.(*http.Transport).Clone()
 		transport.DisableKeepAlives = true
+		transport.Proxy = proxyFunc(rsk.proxy)
 
 		httpC := new(http.Client)
 		httpC.Transport = transport
 
-		c, err := rpc.DialHTTPWithClient(endpoint, httpC)
+		rpcC, err = rpc.DialHTTPWithClient(endpoint, httpC)
+		if err != nil {
+			return err
+		}
+	case "ws", "wss":
+		dialer := websocket.Dialer{
+			ReadBufferSize:  wsBufferSize,
+			WriteBufferSize: wsBufferSize,
+			Proxy:           proxyFunc(rsk.proxy),
+		}
+		rpcC, err = rpc.DialWebsocketWithDialer(context.Background(), endpoint, "", dialer)
 		if err != nil {
 			return err
 		}
-
-		ethC = ethclient.NewClient(c)
 	default:
-		ethC, err = ethclient.Dial(endpoint)
+		rpcC, err = rpc.Dial(endpoint)
 		if err != nil {
 			return err
 		}
 	}
 
-	rsk.c = ethC
+	rsk.rpc = rpcC
+	rsk.c = ethclient.NewClient(rpcC)
+	if rsk.metrics != nil {
+		rsk.metrics.endpoint = u.Redacted()
+	}
 
 	log.Debug("verifying connection to RSK node")
 	// test connection
-	rskChainId, err := rsk.GetChainId()
+	rskChainId, err := rsk.GetChainId(context.Background())
 	if err != nil {
 		return err
 	}
-	//check chain id
-	if chainId.Cmp(rskChainId) != 0 {
-		return fmt.Errorf("chain id mismatch; expected chain id: %v, rsk node chain id: %v", chainId, rskChainId)
+	err = rsk.checkChainId(chainId, rskChainId)
+	if err != nil {
+		return err
 	}
 
 	log.Debug("initializing RSK contracts")
@@ -150,66 +268,180 @@ func (rsk *RSK) Connect(endpoint string, chainId *big.Int) error {
 	return nil
 }
 
-func (rsk *RSK) CheckConnection() error {
-	_, err := rsk.GetChainId()
+// SetRetryPolicy sets how many times each RPC call is attempted, the wait after the first failed attempt, and the cap
+// the wait doubles up to after each further failure. Zero values keep the defaults: 3 attempts, 2 seconds apart.
+func (rsk *RSK) SetRetryPolicy(retries int, sleep time.Duration, maxSleep time.Duration) {
+	rsk.retry = retryPolicy{retries: retries, sleep: sleep, maxSleep: maxSleep}
+}
+
+// EnableMetrics registers the latency and retry metrics of the calls made to the RSK node in reg.
+func (rsk *RSK) EnableMetrics(reg prometheus.Registerer) error {
+	m, err := newRSKMetrics(reg)
+	if err != nil {
+		return err
+	}
+	rsk.metrics = m
+	return nil
+}
+
+// EnableRegtestMode relaxes the checks that don't apply to single node test chains. Must be called before Connect.
+func (rsk *RSK) EnableRegtestMode() {
+	rsk.regtest = true
+}
+
+// EnableDynamicFees makes CallForUser and RegisterPegIn send dynamic fee (EIP-1559) transactions. While the node
+// reports no base fee they keep using the legacy gas price.
+func (rsk *RSK) EnableDynamicFees() {
+	rsk.dynamicFees = true
+}
+
+func (rsk *RSK) checkChainId(expected *big.Int, actual *big.Int) error {
+	if rsk.regtest && networkName(actual) == "mainnet" {
+		return fmt.Errorf("regtest mode can't be enabled against a mainnet node; rsk node chain id: %v", actual)
+	}
+	if expected.Cmp(actual) != 0 {
+		if !rsk.regtest {
+			return fmt.Errorf("chain id mismatch; expected chain id: %v, rsk node chain id: %v", expected, actual)
+		}
+		log.Warnf("regtest mode: ignoring chain id mismatch; expected chain id: %v, rsk node chain id: %v", expected, actual)
+	}
+	return nil
+}
+
+func (rsk *RSK) CheckConnection(ctx context.Context) error {
+	_, err := rsk.GetChainId(ctx)
 	return err
 }
 
+// HealthCheck tells whether the RSK node is reachable and done syncing. A node that is still syncing is reported as
+// unhealthy without an error, which is only returned when the node can't be reached.
+func (rsk *RSK) HealthCheck(ctx context.Context) (bool, error) {
+	cctx, cancel := rpcContext(ctx)
+	defer cancel()
+	progress, err := rsk.c.SyncProgress(cctx)
+	if err != nil {
+		return false, fmt.Errorf("error retrieving sync progress: %w", rpcFailure(err))
+	}
+	if progress != nil {
+		log.Warnf("rsk node is syncing; current block: %v; highest block: %v", progress.CurrentBlock, progress.HighestBlock)
+		return false, nil
+	}
+	_, err = rsk.c.BlockNumber(cctx)
+	if err != nil {
+		return false, fmt.Errorf("error retrieving block number: %w", rpcFailure(err))
+	}
+	return true, nil
+}
+
+// NodeInfo returns the client version and network of the connected RSK node
+func (rsk *RSK) NodeInfo(ctx context.Context) (NodeInfo, error) {
+	var clientVersion string
+	err := rsk.rpc.CallContext(ctx, &clientVersion, "web3_clientVersion")
+	if err != nil {
+		return NodeInfo{}, fmt.Errorf("error retrieving client version: %w", rpcFailure(err))
+	}
+	chainId, err := rsk.c.ChainID(ctx)
+	if err != nil {
+		return NodeInfo{}, fmt.Errorf("error retrieving chain id: %w", rpcFailure(err))
+	}
+	return NodeInfo{
+		ClientVersion: clientVersion,
+		ChainId:       chainId,
+		Network:       networkName(chainId),
+	}, nil
+}
+
 func (rsk *RSK) Close() {
 	log.Debug("closing RSK connection")
 	rsk.c.Close()
 }
 
-func (rsk *RSK) GetLbcBalance(addr string) (*big.Int, error) {
+// GetBalance returns the RSK balance of the given account at the latest block
+func (rsk *RSK) GetBalance(ctx context.Context, addr string) (*big.Int, error) {
+	if !common.IsHexAddress(addr) {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAddress, addr)
+	}
+	a := common.HexToAddress(addr)
+	var err error
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		cctx, cancel := rpcContext(ctx)
+		defer cancel()
+		var bal *big.Int
+		start := time.Now()
+		bal, err = rsk.c.BalanceAt(cctx, a, nil)
+		rsk.metrics.observe("GetBalance", i, start, err)
+		if err == nil {
+			return bal, nil
+		}
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("error getting balance of %v: %w", addr, rpcFailure(err))
+}
+
+func (rsk *RSK) GetLbcBalance(ctx context.Context, addr string) (*big.Int, error) {
 	if !common.IsHexAddress(addr) {
-		return nil, fmt.Errorf("invalid address: %v", addr)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAddress, addr)
 	}
 	a := common.HexToAddress(addr)
 	var err error
-	for i := 0; i < retries; i++ {
+	for i := 0; i < rsk.retry.attempts(); i++ {
 		var bal *big.Int
-		bal, err = rsk.lbc.GetBalance(&bind.CallOpts{}, a)
+		start := time.Now()
+		bal, err = rsk.lbc.GetBalance(&bind.CallOpts{Context: ctx}, a)
+		rsk.metrics.observe("GetLbcBalance", i, start, err)
 		if err == nil {
 			return bal, nil
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
-	return nil, fmt.Errorf("error getting %v balance: %v", addr, err)
+	return nil, fmt.Errorf("error getting %v balance: %w", addr, rpcFailure(err))
 }
 
-func (rsk *RSK) GetAvailableLiquidity(addr string) (*big.Int, error) {
+func (rsk *RSK) GetAvailableLiquidity(ctx context.Context, addr string) (*big.Int, error) {
 	if !common.IsHexAddress(addr) {
-		return nil, fmt.Errorf("invalid address: %v", addr)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAddress, addr)
 	}
 	a := common.HexToAddress(addr)
-	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	cctx, cancel := rpcContext(ctx)
 	defer cancel()
 	var err error
 	var liq *big.Int
-	for i := 0; i < retries; i++ {
-		liq, err = rsk.c.BalanceAt(ctx, a, nil)
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		start := time.Now()
+		liq, err = rsk.c.BalanceAt(cctx, a, nil)
+		rsk.metrics.observe("GetAvailableLiquidity", i, start, err)
 		if err == nil {
 			break
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
 	if err != nil {
-		return nil, fmt.Errorf("error getting balance of %v: %v", addr, err)
+		return nil, fmt.Errorf("error getting balance of %v: %w", addr, rpcFailure(err))
 	}
-	for i := 0; i < retries; i++ {
+	for i := 0; i < rsk.retry.attempts(); i++ {
 		var bal *big.Int
-		bal, err = rsk.lbc.GetBalance(&bind.CallOpts{}, a)
+		start := time.Now()
+		bal, err = rsk.lbc.GetBalance(&bind.CallOpts{Context: ctx}, a)
+		rsk.metrics.observe("GetAvailableLiquidity", i, start, err)
 		if err == nil {
 			return liq.Add(liq, bal), nil
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
-	return nil, fmt.Errorf("error getting %v balance: %v", addr, err)
+	return nil, fmt.Errorf("error getting %v balance: %w", addr, rpcFailure(err))
 }
 
-func (rsk *RSK) GetCollateral(addr string) (*big.Int, *big.Int, error) {
+func (rsk *RSK) GetCollateral(ctx context.Context, addr string) (*big.Int, *big.Int, error) {
 	if !common.IsHexAddress(addr) {
-		return nil, nil, fmt.Errorf("invalid address: %v", addr)
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidAddress, addr)
 	}
 	a := common.HexToAddress(addr)
 	var (
@@ -217,139 +449,365 @@ func (rsk *RSK) GetCollateral(addr string) (*big.Int, *big.Int, error) {
 		col *big.Int
 		err error
 	)
-	for i := 0; i < retries; i++ {
-		min, err = rsk.lbc.GetMinCollateral(&bind.CallOpts{})
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		start := time.Now()
+		min, err = rsk.lbc.GetMinCollateral(&bind.CallOpts{Context: ctx})
+		rsk.metrics.observe("GetCollateral", i, start, err)
 		if err == nil {
 			break
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
 	if err != nil {
-		return nil, nil, fmt.Errorf("error getting minimum collateral: %v", err)
+		return nil, nil, fmt.Errorf("error getting minimum collateral: %w", rpcFailure(err))
 	}
-	for i := 0; i < retries; i++ {
-		col, err = rsk.lbc.GetCollateral(&bind.CallOpts{}, a)
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		start := time.Now()
+		col, err = rsk.lbc.GetCollateral(&bind.CallOpts{Context: ctx}, a)
+		rsk.metrics.observe("GetCollateral", i, start, err)
 		if err == nil {
 			break
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
 	if err != nil {
-		return nil, nil, fmt.Errorf("error getting collateral: %v", err)
+		return nil, nil, fmt.Errorf("error getting collateral: %w", rpcFailure(err))
 	}
 	return col, min, nil
 }
 
-func (rsk *RSK) RegisterProvider(opts *bind.TransactOpts) error {
+func (rsk *RSK) RegisterProvider(ctx context.Context, opts *bind.TransactOpts) error {
 	var err error
 	var tx *gethTypes.Transaction
-	for i := 0; i < retries; i++ {
-		tx, err = rsk.lbc.Register(opts)
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		start := time.Now()
+		tx, err = rsk.lbc.Register(transactOpts(ctx, opts))
+		rsk.metrics.observe("RegisterProvider", i, start, err)
 		if err == nil && tx != nil {
 			break
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
 	if tx == nil || err != nil {
-		return fmt.Errorf("error registering provider: %v", err)
+		return fmt.Errorf("error registering provider: %w", rpcFailure(err))
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), ethTimeout)
+	ctx, cancel := context.WithTimeout(ctx, ethTimeout)
 	defer cancel()
-	s, err := rsk.GetTxStatus(ctx, tx)
-	if err != nil || !s {
-		return fmt.Errorf("error getting tx status while registering provider: %v", err)
+	_, err = rsk.WaitForReceipt(ctx, tx.Hash())
+	if err != nil {
+		return fmt.Errorf("error registering provider: %w", err)
 	}
 	return nil
 }
 
-func (rsk *RSK) AddCollateral(opts *bind.TransactOpts) error {
+func (rsk *RSK) AddCollateral(ctx context.Context, opts *bind.TransactOpts) error {
 	var err error
 	var tx *gethTypes.Transaction
-	for i := 0; i < retries; i++ {
-		tx, err = rsk.lbc.AddCollateral(opts)
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		start := time.Now()
+		tx, err = rsk.lbc.AddCollateral(transactOpts(ctx, opts))
+		rsk.metrics.observe("AddCollateral", i, start, err)
 		if err == nil && tx != nil {
 			break
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
 	if tx == nil || err != nil {
-		return fmt.Errorf("error adding collateral: %v", err)
+		return fmt.Errorf("error adding collateral: %w", rpcFailure(err))
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), ethTimeout)
+	ctx, cancel := context.WithTimeout(ctx, ethTimeout)
 	defer cancel()
-	s, err := rsk.GetTxStatus(ctx, tx)
-	if err != nil || !s {
-		return fmt.Errorf("error getting tx status while adding collateral: %v", err)
+	_, err = rsk.WaitForReceipt(ctx, tx.Hash())
+	if err != nil {
+		return fmt.Errorf("error adding collateral: %w", err)
 	}
 	return nil
 }
 
-func (rsk *RSK) GetChainId() (*big.Int, error) {
+func (rsk *RSK) GetChainId(ctx context.Context) (*big.Int, error) {
 	var err error
-	for i := 0; i < retries; i++ {
-		ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		cctx, cancel := rpcContext(ctx)
 		defer cancel()
 		var chainId *big.Int
-		chainId, err = rsk.c.ChainID(ctx)
+		start := time.Now()
+		chainId, err = rsk.c.ChainID(cctx)
+		rsk.metrics.observe("GetChainId", i, start, err)
 		if err == nil {
 			return chainId, nil
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
-	return nil, fmt.Errorf("error retrieving chain id: %v", err)
+	return nil, fmt.Errorf("error retrieving chain id: %w", rpcFailure(err))
 }
 
-func (rsk *RSK) EstimateGas(addr string, value *big.Int, data []byte) (uint64, error) {
+func (rsk *RSK) EstimateGas(ctx context.Context, addr string, value *big.Int, data []byte) (uint64, error) {
 	if !common.IsHexAddress(addr) {
-		return 0, fmt.Errorf("invalid address: %v", addr)
+		return 0, fmt.Errorf("%w: %v", ErrInvalidAddress, addr)
 	}
 
 	dst := common.HexToAddress(addr)
 
 	var additionalGas uint64
-	if rsk.isNewAccount(dst) {
+	hasCode, isNew := rsk.accountState(ctx, dst)
+	if isNew {
 		additionalGas = newAccountGasCost
 	}
 
+	// a value transfer to an account without code always costs the same, so there's no need to ask the node
+	if len(data) == 0 && !hasCode && !rsk.forceGasEstimation {
+		return plainTransferGas + additionalGas, nil
+	}
+
 	msg := ethereum.CallMsg{
 		To:    &dst,
 		Data:  data,
 		Value: new(big.Int).Set(value),
 	}
 
+	var key gasEstimationKey
+	if rsk.gasCache != nil {
+		key = newGasEstimationKey(dst, value, data, additionalGas > 0)
+		if gas, ok := rsk.gasCache.get(key); ok {
+			hits, misses := rsk.gasCache.stats()
+			log.Debugf("gas estimation cache hit; hits: %v; misses: %v", hits, misses)
+			return gas, nil
+		}
+	}
+
 	var err error
-	for i := 0; i < retries; i++ {
-		ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		cctx, cancel := rpcContext(ctx)
 		defer cancel()
 		var gas uint64
-		gas, err = rsk.c.EstimateGas(ctx, msg)
+		start := time.Now()
+		gas, err = rsk.c.EstimateGas(cctx, msg)
+		rsk.metrics.observe("EstimateGas", i, start, err)
 		if gas > 0 {
+			if rsk.gasCache != nil {
+				rsk.gasCache.put(key, gas+additionalGas)
+			}
 			return gas + additionalGas, nil
 		}
-		time.Sleep(rpcSleep)
+		if isRevert(err) {
+			return 0, fmt.Errorf("error estimating gas: %w", &CallRevertError{Reason: revertReason(err), err: err})
+		}
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
+	}
+	return 0, fmt.Errorf("error estimating gas: %w", rpcFailure(err))
+}
+
+// EnableGasEstimationCache makes EstimateGas reuse the estimations made for the same call during the given ttl
+func (rsk *RSK) EnableGasEstimationCache(ttl time.Duration) {
+	rsk.gasCache = newGasEstimationCache(ttl, time.Now)
+}
+
+// ForceGasEstimation makes EstimateGas ask the node even for plain value transfers to accounts without code
+func (rsk *RSK) ForceGasEstimation() {
+	rsk.forceGasEstimation = true
+}
+
+// GasEstimationCacheStats returns the amount of hits and misses of the gas estimation cache
+func (rsk *RSK) GasEstimationCacheStats() (hits uint64, misses uint64) {
+	if rsk.gasCache == nil {
+		return 0, 0
+	}
+	return rsk.gasCache.stats()
+}
+
+// SetGasPricePolicy sets the percentage GasPrice adds to the price suggested by the node, and the price neither
+// GasPriceWithMarkup nor the dynamic fees go over. A nil or zero maxPrice leaves the price uncapped.
+func (rsk *RSK) SetGasPricePolicy(markupPercent int, maxPrice *big.Int) error {
+	if markupPercent < 0 {
+		return fmt.Errorf("invalid gas price markup: %v%%", markupPercent)
 	}
-	return 0, fmt.Errorf("error estimating gas: %v", err)
+	rsk.gasPriceMarkup = markupPercent
+	rsk.maxGasPrice = nil
+	if maxPrice != nil && maxPrice.Sign() > 0 {
+		rsk.maxGasPrice = new(big.Int).Set(maxPrice)
+	}
+	return nil
+}
+
+// GasPrice returns the price suggested by the node with the configured markup, capped at the configured maximum
+func (rsk *RSK) GasPrice(ctx context.Context) (*big.Int, error) {
+	return rsk.GasPriceWithMarkup(ctx, rsk.gasPriceMarkup)
+}
+
+// GasPriceWithMarkup returns the price suggested by the node increased by percent, capped at the configured maximum
+func (rsk *RSK) GasPriceWithMarkup(ctx context.Context, percent int) (*big.Int, error) {
+	if percent < 0 {
+		return nil, fmt.Errorf("invalid gas price markup: %v%%", percent)
+	}
+	price, err := rsk.gasPrice.do(ctx, rsk.fetchGasPrice)
+	if err != nil {
+		return nil, err
+	}
+	price.Mul(price, big.NewInt(int64(100+percent)))
+	price.Div(price, big.NewInt(100))
+	return rsk.capGasPrice(price), nil
+}
+
+// capGasPrice lowers the price to the configured maximum, so that a misbehaving node can't make the provider overpay
+func (rsk *RSK) capGasPrice(price *big.Int) *big.Int {
+	if rsk.maxGasPrice == nil || price.Cmp(rsk.maxGasPrice) <= 0 {
+		return price
+	}
+	log.Warnf("gas price %v is above the max gas price; using %v", price, rsk.maxGasPrice)
+	return new(big.Int).Set(rsk.maxGasPrice)
 }
 
-func (rsk *RSK) GasPrice() (*big.Int, error) {
+func (rsk *RSK) fetchGasPrice(ctx context.Context) (*big.Int, error) {
 	var err error
-	for i := 0; i < retries; i++ {
-		ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		cctx, cancel := rpcContext(ctx)
 		defer cancel()
 		var price *big.Int
-		price, err = rsk.c.SuggestGasPrice(ctx)
+		start := time.Now()
+		price, err = rsk.c.SuggestGasPrice(cctx)
+		rsk.metrics.observe("GasPrice", i, start, err)
 		if price != nil && price.Cmp(big.NewInt(0)) >= 0 {
 			return price, nil
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("error estimating gas: %w", rpcFailure(err))
+}
+
+// DynamicFeeTransactOpts returns a copy of opts priced with maxPriorityFeePerGas and maxFeePerGas, the fee cap leaving
+// room for the base fee to double before the transaction is mined. ErrNoBaseFee is returned when the latest header
+// has no base fee.
+func (rsk *RSK) DynamicFeeTransactOpts(ctx context.Context, opts *bind.TransactOpts) (*bind.TransactOpts, error) {
+	var err error
+	var header *gethTypes.Header
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		cctx, cancel := rpcContext(ctx)
+		defer cancel()
+		start := time.Now()
+		header, err = rsk.c.HeaderByNumber(cctx, nil)
+		rsk.metrics.observe("HeaderByNumber", i, start, err)
+		if err == nil && header != nil {
+			break
+		}
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving latest block: %w", rpcFailure(err))
+	}
+	if header.BaseFee == nil {
+		return nil, ErrNoBaseFee
+	}
+
+	var tip *big.Int
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		cctx, cancel := rpcContext(ctx)
+		defer cancel()
+		start := time.Now()
+		tip, err = rsk.c.SuggestGasTipCap(cctx)
+		rsk.metrics.observe("SuggestGasTipCap", i, start, err)
+		if err == nil && tip != nil {
+			break
+		}
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error suggesting gas tip cap: %w", rpcFailure(err))
+	}
+
+	o := *opts
+	o.GasPrice = nil
+	o.GasTipCap = rsk.capGasPrice(tip)
+	o.GasFeeCap = rsk.capGasPrice(new(big.Int).Add(tip, new(big.Int).Mul(header.BaseFee, big.NewInt(2))))
+	return &o, nil
+}
+
+// pricedTransactOpts prices a transaction with dynamic fees when they're enabled and the node supports them, and with
+// the legacy gas price otherwise. Options that already carry a price are left as they are.
+func (rsk *RSK) pricedTransactOpts(ctx context.Context, opts *bind.TransactOpts) (*bind.TransactOpts, error) {
+	if opts.GasPrice != nil || opts.GasFeeCap != nil {
+		return opts, nil
+	}
+	if rsk.dynamicFees {
+		o, err := rsk.DynamicFeeTransactOpts(ctx, opts)
+		if err == nil {
+			return o, nil
+		}
+		if !errors.Is(err, ErrNoBaseFee) {
+			return nil, err
+		}
+		log.Warn("dynamic fees enabled, but the rsk node reports no base fee; falling back to legacy gas pricing")
+	}
+	price, err := rsk.GasPrice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	o := *opts
+	o.GasPrice = price
+	return &o, nil
+}
+
+// GetLatestBlockTime returns the timestamp of the latest block known by the RSK node
+func (rsk *RSK) GetLatestBlockTime(ctx context.Context) (time.Time, error) {
+	var err error
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		cctx, cancel := rpcContext(ctx)
+		defer cancel()
+		var header *gethTypes.Header
+		start := time.Now()
+		header, err = rsk.c.HeaderByNumber(cctx, nil)
+		rsk.metrics.observe("GetLatestBlockTime", i, start, err)
+		if err == nil && header != nil {
+			return time.Unix(int64(header.Time), 0), nil
+		}
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
-	return nil, fmt.Errorf("error estimating gas: %v", err)
+	return time.Time{}, fmt.Errorf("error retrieving latest block: %w", rpcFailure(err))
 }
 
-func (rsk *RSK) HashQuote(q *types.Quote) (string, error) {
-	opts := bind.CallOpts{}
+// GetBlockNumber returns the number of the latest block known by the RSK node
+func (rsk *RSK) GetBlockNumber(ctx context.Context) (uint64, error) {
+	var err error
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		cctx, cancel := rpcContext(ctx)
+		defer cancel()
+		var height uint64
+		start := time.Now()
+		height, err = rsk.c.BlockNumber(cctx)
+		rsk.metrics.observe("GetBlockNumber", i, start, err)
+		if err == nil {
+			return height, nil
+		}
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
+	}
+	return 0, fmt.Errorf("error retrieving block number: %w", rpcFailure(err))
+}
+
+func (rsk *RSK) HashQuote(ctx context.Context, q *types.Quote) (string, error) {
+	opts := bind.CallOpts{Context: ctx}
 	var results [32]byte
 
 	pq, err := rsk.ParseQuote(q)
@@ -357,33 +815,135 @@ func (rsk *RSK) HashQuote(q *types.Quote) (string, error) {
 		return "", err
 	}
 
-	for i := 0; i < retries; i++ {
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		start := time.Now()
 		results, err = rsk.lbc.HashQuote(&opts, pq)
-		if err == nil {
+		rsk.metrics.observe("HashQuote", i, start, err)
+		if err == nil || isRevert(err) {
+			break
+		}
+		if rsk.retry.wait(ctx, i) != nil {
 			break
 		}
-		time.Sleep(rpcSleep)
 	}
 	if err != nil {
-		return "", fmt.Errorf("error calling HashQuote: %v", err)
+		return "", fmt.Errorf("error calling HashQuote: %w", rpcFailure(err))
 	}
 	return hex.EncodeToString(results[:]), nil
 }
 
-func (rsk *RSK) GetFedSize() (int, error) {
+// rpcContext bounds a single RPC attempt by rpcTimeout, unless the caller already set a deadline of its own
+func rpcContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, rpcTimeout)
+}
+
+// transactOpts binds the transaction to ctx without modifying the caller's options
+func transactOpts(ctx context.Context, opts *bind.TransactOpts) *bind.TransactOpts {
+	o := *opts
+	o.Context = ctx
+	return &o
+}
+
+// isRevert checks whether the node rejected a call because the contract reverted. The call is deterministic, so
+// retrying it won't help, unlike connection errors.
+func isRevert(err error) bool {
+	var rpcErr rpc.Error
+	if !errors.As(err, &rpcErr) {
+		return false
+	}
+	return rpcErr.ErrorCode() == 3 || strings.Contains(strings.ToLower(rpcErr.Error()), "revert")
+}
+
+// revertReason decodes the Error(string) message a call reverted with from the data attached to the node's error. It
+// returns an empty string when the node didn't include it or the contract reverted without a message.
+func revertReason(err error) string {
+	var dataErr rpc.DataError
+	if !errors.As(err, &dataErr) {
+		return ""
+	}
+	data, ok := dataErr.ErrorData().(string)
+	if !ok {
+		return ""
+	}
+	b, err := hexutil.Decode(data)
+	if err != nil {
+		return ""
+	}
+	reason, err := abi.UnpackRevert(b)
+	if err != nil {
+		return ""
+	}
+	return reason
+}
+
+// rpcFailure tags an error returned by the node with its category: a JSON-RPC error or a missing contract means the
+// node answered, and anything else that it couldn't be reached
+func rpcFailure(err error) error {
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) || errors.Is(err, bind.ErrNoCode) {
+		return fmt.Errorf("%w: %v", ErrContractCall, err)
+	}
+	return fmt.Errorf("%w: %v", ErrNodeUnavailable, err)
+}
+
+// HashQuoteLocally computes the quote hash the same way LBC.hashQuote does, without calling the contract.
+func HashQuoteLocally(q bindings.LiquidityBridgeContractQuote) (string, error) {
+	part1, err := quotePart1Args.Pack(
+		q.FedBtcAddress,
+		q.LbcAddress,
+		q.LiquidityProviderRskAddress,
+		q.BtcRefundAddress,
+		q.RskRefundAddress,
+		q.LiquidityProviderBtcAddress,
+		q.CallFee,
+		q.PenaltyFee,
+		q.ContractAddress,
+	)
+	if err != nil {
+		return "", fmt.Errorf("error encoding quote: %v", err)
+	}
+	part2, err := quotePart2Args.Pack(
+		q.Data,
+		q.GasLimit,
+		q.Nonce,
+		q.Value,
+		q.AgreementTimestamp,
+		q.TimeForDeposit,
+		q.CallTime,
+		q.DepositConfirmations,
+		q.CallOnRegister,
+	)
+	if err != nil {
+		return "", fmt.Errorf("error encoding quote: %v", err)
+	}
+	encoded, err := quoteArgs.Pack(part1, part2)
+	if err != nil {
+		return "", fmt.Errorf("error encoding quote: %v", err)
+	}
+	return hex.EncodeToString(crypto.Keccak256(encoded)), nil
+}
+
+func (rsk *RSK) GetFedSize(ctx context.Context) (int, error) {
 	var err error
-	opts := bind.CallOpts{}
+	opts := bind.CallOpts{Context: ctx}
 	var results *big.Int
 
-	for i := 0; i < retries; i++ {
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		start := time.Now()
 		results, err = rsk.bridge.GetFederationSize(&opts)
+		rsk.metrics.observe("GetFedSize", i, start, err)
 		if results != nil {
 			break
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
 	if err != nil {
-		return 0, fmt.Errorf("error calling GetFederationSize: %v", err)
+		return 0, fmt.Errorf("error calling GetFederationSize: %w", rpcFailure(err))
 	}
 
 	sizeInt, err := strconv.Atoi(results.String())
@@ -393,20 +953,24 @@ func (rsk *RSK) GetFedSize() (int, error) {
 	return sizeInt, nil
 }
 
-func (rsk *RSK) GetFedThreshold() (int, error) {
+func (rsk *RSK) GetFedThreshold(ctx context.Context) (int, error) {
 	var err error
-	opts := bind.CallOpts{}
+	opts := bind.CallOpts{Context: ctx}
 	var results *big.Int
 
-	for i := 0; i < retries; i++ {
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		start := time.Now()
 		results, err = rsk.bridge.GetFederationThreshold(&opts)
+		rsk.metrics.observe("GetFedThreshold", i, start, err)
 		if results != nil {
 			break
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
 	if err != nil {
-		return 0, fmt.Errorf("error calling GetFederationThreshold: %v", err)
+		return 0, fmt.Errorf("error calling GetFederationThreshold: %w", rpcFailure(err))
 	}
 
 	sizeInt, err := strconv.Atoi(results.String())
@@ -417,56 +981,68 @@ func (rsk *RSK) GetFedThreshold() (int, error) {
 	return sizeInt, nil
 }
 
-func (rsk *RSK) GetFedPublicKey(index int) (string, error) {
+func (rsk *RSK) GetFedPublicKey(ctx context.Context, index int) (string, error) {
 	var err error
 	var results []byte
-	opts := bind.CallOpts{}
+	opts := bind.CallOpts{Context: ctx}
 
-	for i := 0; i < retries; i++ {
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		start := time.Now()
 		results, err = rsk.bridge.GetFederatorPublicKeyOfType(&opts, big.NewInt(int64(index)), "btc")
+		rsk.metrics.observe("GetFedPublicKey", i, start, err)
 		if len(results) > 0 {
 			break
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
 	if len(results) == 0 {
-		return "", fmt.Errorf("error calling GetFederatorPublicKeyOfType: %v", err)
+		return "", fmt.Errorf("error calling GetFederatorPublicKeyOfType: %w", rpcFailure(err))
 	}
 
 	return hex.EncodeToString(results), nil
 }
 
-func (rsk *RSK) GetFedAddress() (string, error) {
+func (rsk *RSK) GetFedAddress(ctx context.Context) (string, error) {
 	var err error
 	var results string
-	opts := bind.CallOpts{}
+	opts := bind.CallOpts{Context: ctx}
 
-	for i := 0; i < retries; i++ {
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		start := time.Now()
 		results, err = rsk.bridge.GetFederationAddress(&opts)
+		rsk.metrics.observe("GetFedAddress", i, start, err)
 		if results != "" {
 			break
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
 	if results == "" {
-		return "", fmt.Errorf("error calling GetFederationAddress: %v", err)
+		return "", fmt.Errorf("error calling GetFederationAddress: %w", rpcFailure(err))
 	}
 	return results, nil
 }
 
-func (rsk *RSK) GetActiveFederationCreationBlockHeight() (int, error) {
+func (rsk *RSK) GetActiveFederationCreationBlockHeight(ctx context.Context) (int, error) {
 	var err error
-	opts := bind.CallOpts{}
+	opts := bind.CallOpts{Context: ctx}
 	var results *big.Int
-	for i := 0; i < retries; i++ {
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		start := time.Now()
 		results, err = rsk.bridge.GetActiveFederationCreationBlockHeight(&opts)
+		rsk.metrics.observe("GetActiveFederationCreationBlockHeight", i, start, err)
 		if results != nil {
 			break
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
 	if results == nil {
-		return 0, fmt.Errorf("error calling getActiveFederationCreationBlockHeight: %v", err)
+		return 0, fmt.Errorf("error calling getActiveFederationCreationBlockHeight: %w", rpcFailure(err))
 	}
 	height, err := strconv.Atoi(results.String())
 	if err != nil {
@@ -482,48 +1058,92 @@ func (rsk *RSK) GetLBCAddress() string {
 	return rsk.lbcAddress.String()
 }
 
-func (rsk *RSK) CallForUser(opt *bind.TransactOpts, q bindings.LiquidityBridgeContractQuote) (*gethTypes.Transaction, error) {
-	var err error
+func (rsk *RSK) GetBridgeAddress() string {
+	return rsk.bridgeAddress.String()
+}
+
+func (rsk *RSK) CallForUser(ctx context.Context, opt *bind.TransactOpts, q bindings.LiquidityBridgeContractQuote) (*gethTypes.Transaction, error) {
+	opt, err := rsk.pricedTransactOpts(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
 	var tx *gethTypes.Transaction
-	for i := 0; i < retries; i++ {
-		tx, err = rsk.lbc.CallForUser(opt, q)
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		start := time.Now()
+		tx, err = rsk.lbc.CallForUser(transactOpts(ctx, opt), q)
+		rsk.metrics.observe("CallForUser", i, start, err)
 		if err == nil && tx != nil {
 			break
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
 	if tx == nil && err != nil {
-		return nil, fmt.Errorf("error calling callForUser: %v", err)
+		return nil, fmt.Errorf("error calling callForUser: %w", rpcFailure(err))
 	}
 	return tx, nil
 }
 
-func (rsk *RSK) RegisterPegIn(opt *bind.TransactOpts, q bindings.LiquidityBridgeContractQuote, signature []byte, tx []byte, pmt []byte, height *big.Int) (*gethTypes.Transaction, error) {
-	var err error
+func (rsk *RSK) RegisterPegIn(ctx context.Context, opt *bind.TransactOpts, q bindings.LiquidityBridgeContractQuote, signature []byte, tx []byte, pmt []byte, height *big.Int) (*gethTypes.Transaction, error) {
+	err := validatePegInProof(tx, pmt)
+	if err != nil {
+		return nil, err
+	}
+	opt, err = rsk.pricedTransactOpts(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
 	var t *gethTypes.Transaction
-	for i := 0; i < retries; i++ {
-		t, err = rsk.lbc.RegisterPegIn(opt, q, signature, tx, pmt, height)
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		start := time.Now()
+		t, err = rsk.lbc.RegisterPegIn(transactOpts(ctx, opt), q, signature, tx, pmt, height)
+		rsk.metrics.observe("RegisterPegIn", i, start, err)
 		if err == nil && t != nil {
 			break
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
 	if tx == nil && err != nil {
-		return nil, fmt.Errorf("error calling registerPegIn: %v", err)
+		return nil, fmt.Errorf("error calling registerPegIn: %w", rpcFailure(err))
 	}
 	return t, nil
 }
 
-func (rsk *RSK) RegisterPegInWithoutTx(q bindings.LiquidityBridgeContractQuote, signature []byte, tx []byte, pmt []byte, height *big.Int) error {
+func (rsk *RSK) RegisterPegInWithoutTx(ctx context.Context, q bindings.LiquidityBridgeContractQuote, signature []byte, tx []byte, pmt []byte, height *big.Int) error {
+	err := validatePegInProof(tx, pmt)
+	if err != nil {
+		return err
+	}
 	var res []interface{}
 	lbcCaller := &bindings.LBCCallerRaw{Contract: &rsk.lbc.LBCCaller}
-	err := lbcCaller.Call(&bind.CallOpts{}, &res, "registerPegIn", q, signature, tx, pmt, height)
+	err = lbcCaller.Call(&bind.CallOpts{Context: ctx}, &res, "registerPegIn", q, signature, tx, pmt, height)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// validatePegInProof checks that the btc transaction and its partial merkle tree are within the bounds accepted
+// by the bridge, so that malformed proofs are caught before spending gas on them.
+func validatePegInProof(tx []byte, pmt []byte) error {
+	if len(tx) == 0 {
+		return fmt.Errorf("%w: btc raw tx is empty", ErrInvalidPegInProof)
+	}
+	if len(tx) > maxBtcTxSize {
+		return fmt.Errorf("%w: btc raw tx size %v exceeds max size %v", ErrInvalidPegInProof, len(tx), maxBtcTxSize)
+	}
+	if len(pmt) == 0 {
+		return fmt.Errorf("%w: partial merkle tree is empty", ErrInvalidPegInProof)
+	}
+	if len(pmt) > maxPMTSize {
+		return fmt.Errorf("%w: partial merkle tree size %v exceeds max size %v", ErrInvalidPegInProof, len(pmt), maxPMTSize)
+	}
+	return nil
+}
+
 func (rsk *RSK) GetTxStatus(ctx context.Context, tx *gethTypes.Transaction) (bool, error) {
 	ticker := time.NewTicker(ethSleep)
 
@@ -543,68 +1163,237 @@ func (rsk *RSK) GetTxStatus(ctx context.Context, tx *gethTypes.Transaction) (boo
 	}
 }
 
-func (rsk *RSK) isNewAccount(addr common.Address) bool {
+// WaitForReceipt polls for the receipt of the transaction until it's mined or ctx is done. A reverted transaction
+// returns its receipt along with ErrTxReverted, and one that wasn't mined in time returns ErrTxNotMined, so dropped
+// transactions can be told apart from on-chain failures.
+func (rsk *RSK) WaitForReceipt(ctx context.Context, txHash common.Hash) (*gethTypes.Receipt, error) {
+	ticker := time.NewTicker(ethSleep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cctx, cancel := context.WithTimeout(ctx, rpcTimeout)
+			start := time.Now()
+			r, err := rsk.c.TransactionReceipt(cctx, txHash)
+			rsk.metrics.observe("TransactionReceipt", 0, start, err)
+			cancel()
+			if err != nil {
+				if !errors.Is(err, ethereum.NotFound) {
+					log.Debugf("error fetching receipt of tx %v: %v", txHash, err)
+				}
+				continue
+			}
+			if r.Status == gethTypes.ReceiptStatusFailed {
+				return r, fmt.Errorf("%w; hash: %v; block: %v", ErrTxReverted, txHash, r.BlockNumber)
+			}
+			return r, nil
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w; hash: %v: %v", ErrTxNotMined, txHash, ctx.Err())
+		}
+	}
+}
+
+// WaitForTx waits until the transaction has depth confirmations, counting the block that includes it, and returns
+// whether it succeeded. The receipt is fetched again on every check, so a transaction reorged out of the chain goes
+// back to waiting for its inclusion. onConfirmation, when given, is called whenever the confirmations change.
+func (rsk *RSK) WaitForTx(ctx context.Context, tx *gethTypes.Transaction, depth uint64, onConfirmation func(confirmations uint64)) (bool, error) {
+	if depth == 0 {
+		depth = 1
+	}
+	ticker := time.NewTicker(ethSleep)
+	defer ticker.Stop()
+	var last uint64
+	for {
+		select {
+		case <-ticker.C:
+			confirmations, ok, err := rsk.txConfirmations(ctx, tx.Hash())
+			if err != nil {
+				log.Debugf("error checking confirmations of tx %v: %v", tx.Hash(), err)
+				continue
+			}
+			if confirmations != last && onConfirmation != nil {
+				onConfirmation(confirmations)
+			}
+			last = confirmations
+			if confirmations >= depth {
+				return ok, nil
+			}
+		case <-ctx.Done():
+			return false, fmt.Errorf("operation cancelled")
+		}
+	}
+}
+
+// txConfirmations returns the blocks on top of the one including the transaction, that one included, and whether
+// the transaction succeeded. Transactions that aren't mined have no confirmations.
+func (rsk *RSK) txConfirmations(ctx context.Context, hash common.Hash) (uint64, bool, error) {
+	cctx, cancel := rpcContext(ctx)
+	defer cancel()
+	r, err := rsk.c.TransactionReceipt(cctx, hash)
+	if errors.Is(err, ethereum.NotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	height, err := rsk.GetBlockNumber(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	included := r.BlockNumber.Uint64()
+	if height < included { // the node answering is behind the one that returned the receipt
+		return 0, false, nil
+	}
+	return height - included + 1, r.Status == gethTypes.ReceiptStatusSuccessful, nil
+}
+
+// IsContract tells whether the account has code deployed
+func (rsk *RSK) IsContract(ctx context.Context, addr string) (bool, error) {
+	if !common.IsHexAddress(addr) {
+		return false, fmt.Errorf("%w: %v", ErrInvalidAddress, addr)
+	}
+	a := common.HexToAddress(addr)
+	if hasCode, ok := rsk.codeCache.get(a); ok {
+		return hasCode, nil
+	}
+	var (
+		err  error
+		code []byte
+	)
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		cctx, cancel := rpcContext(ctx)
+		start := time.Now()
+		code, err = rsk.c.CodeAt(cctx, a, nil)
+		rsk.metrics.observe("IsContract", i, start, err)
+		cancel()
+		if err == nil {
+			rsk.codeCache.put(a, len(code) > 0)
+			return len(code) > 0, nil
+		}
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
+	}
+	return false, fmt.Errorf("error retrieving code of %v: %w", addr, rpcFailure(err))
+}
+
+// accountState tells whether the account has code deployed and whether it's a new account, i.e. one without code,
+// balance nor transactions
+func (rsk *RSK) accountState(ctx context.Context, addr common.Address) (hasCode bool, isNew bool) {
 	var (
 		err  error
 		code []byte
 		bal  *big.Int
 		n    uint64
 	)
-	for i := 0; i < retries; i++ {
-		ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		cctx, cancel := rpcContext(ctx)
 		defer cancel()
-		code, err = rsk.c.CodeAt(ctx, addr, nil)
+		start := time.Now()
+		code, err = rsk.c.CodeAt(cctx, addr, nil)
+		rsk.metrics.observe("EstimateGas", i, start, err)
 		if err == nil {
 			break
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
-	for i := 0; i < retries; i++ {
-		ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		cctx, cancel := rpcContext(ctx)
 		defer cancel()
-		bal, err = rsk.c.BalanceAt(ctx, addr, nil)
+		start := time.Now()
+		bal, err = rsk.c.BalanceAt(cctx, addr, nil)
+		rsk.metrics.observe("EstimateGas", i, start, err)
 		if err == nil {
 			break
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
-	for i := 0; i < retries; i++ {
-		ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		cctx, cancel := rpcContext(ctx)
 		defer cancel()
-		n, err = rsk.c.NonceAt(ctx, addr, nil)
+		start := time.Now()
+		n, err = rsk.c.NonceAt(cctx, addr, nil)
+		rsk.metrics.observe("EstimateGas", i, start, err)
 		if err == nil {
 			break
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
-	return len(code) == 0 && bal.Cmp(common.Big0) == 0 && n == 0
+	return len(code) > 0, len(code) == 0 && bal != nil && bal.Cmp(common.Big0) == 0 && n == 0
 }
 
-func (rsk *RSK) GetMinimumLockTxValue() (*big.Int, error) {
+func (rsk *RSK) GetMinimumLockTxValue(ctx context.Context) (*big.Int, error) {
 	var err error
-	opts := bind.CallOpts{}
+	opts := bind.CallOpts{Context: ctx}
 	var value *big.Int
-	for i := 0; i < retries; i++ {
+	for i := 0; i < rsk.retry.attempts(); i++ {
+		start := time.Now()
 		value, err = rsk.bridge.GetMinimumLockTxValue(&opts)
+		rsk.metrics.observe("GetMinimumLockTxValue", i, start, err)
 		if value != nil {
 			break
 		}
-		time.Sleep(rpcSleep)
+		if rsk.retry.wait(ctx, i) != nil {
+			break
+		}
 	}
 	if value == nil {
-		return nil, fmt.Errorf("error calling GetMinimumLockTxValue: %v", err)
+		return nil, fmt.Errorf("error calling GetMinimumLockTxValue: %w", rpcFailure(err))
 	}
 	return value, nil
 }
 
+// DecodeRSKAddress decodes a hex address, with or without the 0x prefix. Mixed-case addresses must carry a valid
+// checksum.
 func DecodeRSKAddress(address string) ([]byte, error) {
-	trim := strings.TrimPrefix(address, "0x")
-	if !common.IsHexAddress(trim) {
-		return nil, fmt.Errorf("invalid address: %v", address)
+	trim := strings.TrimPrefix(strings.TrimPrefix(address, "0x"), "0X")
+	if !common.IsHexAddress(trim) || len(trim) != 2*common.AddressLength {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAddress, address)
+	}
+	if !hasValidChecksum(trim) {
+		return nil, fmt.Errorf("%w: invalid checksum: %v", ErrInvalidAddress, address)
 	}
 	return common.HexToAddress(trim).Bytes(), nil
 }
 
+// rskChecksumChainIds are the chains whose EIP-1191 checksums are accepted besides the EIP-55 one, since RSK wallets
+// checksum addresses with the chain id: mainnet, testnet and regtest
+var rskChecksumChainIds = []int64{30, 31, 33}
+
+// hasValidChecksum checks the casing of an unprefixed hex address against its checksums. Addresses all in lower or
+// upper case carry no checksum.
+func hasValidChecksum(hexAddr string) bool {
+	if strings.ToLower(hexAddr) == hexAddr || strings.ToUpper(hexAddr) == hexAddr {
+		return true
+	}
+	if common.HexToAddress(hexAddr).Hex()[2:] == hexAddr {
+		return true
+	}
+	for _, chainId := range rskChecksumChainIds {
+		if eip1191Checksum(hexAddr, chainId) == hexAddr {
+			return true
+		}
+	}
+	return false
+}
+
+func eip1191Checksum(hexAddr string, chainId int64) string {
+	res := []byte(strings.ToLower(hexAddr))
+	hash := hex.EncodeToString(crypto.Keccak256([]byte(strconv.FormatInt(chainId, 10) + "0x" + string(res))))
+	for i, c := range res {
+		if c >= 'a' && hash[i] >= '8' {
+			res[i] = c - 'a' + 'A'
+		}
+	}
+	return string(res)
+}
+
 func (rsk *RSK) ParseQuote(q *types.Quote) (bindings.LiquidityBridgeContractQuote, error) {
 	pq := bindings.LiquidityBridgeContractQuote{}
 	var err error
@@ -645,49 +1434,108 @@ func (rsk *RSK) ParseQuote(q *types.Quote) (bindings.LiquidityBridgeContractQuot
 	return pq, nil
 }
 
-func (rsk *RSK) FetchFederationInfo() (*FedInfo, error) {
-	log.Debug("getting federation info")
-	fedSize, err := rsk.GetFedSize()
+// FetchFederationInfo returns the active federation. Since it takes a bridge call per federator, the info is cached
+// until the active federation creation block height changes. When a bridge call fails, the pieces fetched until then
+// are cached all the same, so the next call only fetches the missing ones.
+func (rsk *RSK) FetchFederationInfo(ctx context.Context) (*FedInfo, error) {
+	activeFedBlockHeight, err := rsk.GetActiveFederationCreationBlockHeight(ctx)
 	if err != nil {
+		log.Error("error fetching federation creation block height: ", err.Error())
 		return nil, err
 	}
+	info, complete := rsk.fedCache.get(activeFedBlockHeight)
+	if complete {
+		return info, nil
+	}
+	if info == nil {
+		info = &FedInfo{
+			ActiveFedBlockHeight: activeFedBlockHeight,
+			IrisActivationHeight: rsk.irisActivationHeight,
+			ErpKeys:              rsk.erpKeys,
+		}
+	}
+
+	log.Debug("getting federation info")
+	keep := true
+	defer func() {
+		if keep {
+			rsk.fedCache.put(info)
+		}
+	}()
+
+	if info.FedSize == 0 {
+		info.FedSize, err = rsk.GetFedSize(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	var pubKeys []string
-	for i := 0; i < fedSize; i++ {
-		pubKey, err := rsk.GetFedPublicKey(i)
+	if len(info.PubKeys) != info.FedSize {
+		info.PubKeys = make([]string, info.FedSize)
+	}
+	for i := range info.PubKeys {
+		if info.PubKeys[i] != "" {
+			continue
+		}
+		pubKey, err := rsk.GetFedPublicKey(ctx, i)
 		if err != nil {
 			log.Error("error fetching fed public key: ", err.Error())
 			return nil, err
 		}
-		pubKeys = append(pubKeys, pubKey)
+		info.PubKeys[i] = pubKey
 	}
 
-	fedThreshold, err := rsk.GetFedThreshold()
-	if err != nil {
-		log.Error("error fetching federation size: ", err.Error())
-		return nil, err
+	if info.FedThreshold == 0 {
+		info.FedThreshold, err = rsk.GetFedThreshold(ctx)
+		if err != nil {
+			log.Error("error fetching federation size: ", err.Error())
+			return nil, err
+		}
 	}
 
-	fedAddress, err := rsk.GetFedAddress()
+	err = validateFederation(info.FedSize, info.FedThreshold, len(info.PubKeys))
 	if err != nil {
+		// nothing fetched for a degenerate federation is worth keeping
+		keep = false
+		rsk.fedCache.clear()
+		log.Errorf("bridge returned an invalid federation; deposit addresses can't be derived: %v", err)
 		return nil, err
 	}
 
-	activeFedBlockHeight, err := rsk.GetActiveFederationCreationBlockHeight()
-	if err != nil {
-		log.Error("error fetching federation address: ", err.Error())
-		return nil, err
+	if info.FedAddress == "" {
+		info.FedAddress, err = rsk.GetFedAddress(ctx)
+		if err != nil {
+			return nil, err
+		}
 	}
+	return copyFedInfo(info), nil
+}
 
-	return &FedInfo{
-		FedThreshold:         fedThreshold,
-		FedSize:              fedSize,
-		PubKeys:              pubKeys,
-		FedAddress:           fedAddress,
-		ActiveFedBlockHeight: activeFedBlockHeight,
-		IrisActivationHeight: rsk.irisActivationHeight,
-		ErpKeys:              rsk.erpKeys,
-	}, nil
+// WarmFederationCache fetches the active federation ahead of the first accept. A failure isn't fatal: whatever was
+// fetched stays cached and the rest is fetched when a quote is accepted.
+func (rsk *RSK) WarmFederationCache(ctx context.Context) error {
+	_, err := rsk.FetchFederationInfo(ctx)
+	return err
+}
+
+// FedCacheStatus tells whether the federation info cache is empty, partially populated or complete
+func (rsk *RSK) FedCacheStatus() string {
+	return rsk.fedCache.status()
+}
+
+// validateFederation guards the derivation of deposit addresses against degenerate federations, since deriving from
+// empty or inconsistent key material would produce an address nobody can spend from
+func validateFederation(size int, threshold int, pubKeys int) error {
+	if size < 1 {
+		return fmt.Errorf("%w: federation size is %v", ErrFederationUnavailable, size)
+	}
+	if pubKeys != size {
+		return fmt.Errorf("%w: got %v public keys for a federation of size %v", ErrFederationUnavailable, pubKeys, size)
+	}
+	if threshold < 1 || threshold > size {
+		return fmt.Errorf("%w: threshold %v is invalid for a federation of size %v", ErrFederationUnavailable, threshold, size)
+	}
+	return nil
 }
 
 func copyBtcAddr(addr string, dst []byte) error {
@@ -715,3 +1563,11 @@ func parseHex(str string) ([]byte, error) {
 	}
 	return bts, nil
 }
+
+func mustNewType(t string) abi.Type {
+	typ, err := abi.NewType(t, "", nil)
+	if err != nil {
+		panic(err)
+	}
+	return typ
+}
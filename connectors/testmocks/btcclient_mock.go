@@ -28,7 +28,10 @@ func (B *BTCClientMock) GetTransaction(txHash *chainhash.Hash) (*btcjson.GetTran
 }
 
 func (B *BTCClientMock) GetBlockVerbose(blockHash *chainhash.Hash) (*btcjson.GetBlockVerboseResult, error) {
-	B.Called(blockHash)
+	args := B.Called(blockHash)
+	if len(args) > 0 {
+		return args.Get(0).(*btcjson.GetBlockVerboseResult), args.Error(1)
+	}
 	return new(btcjson.GetBlockVerboseResult), nil
 }
 
@@ -38,7 +41,10 @@ func (B *BTCClientMock) ListUnspentMinMaxAddresses(minConf, maxConf int, addrs [
 }
 
 func (B *BTCClientMock) GetBlock(blockHash *chainhash.Hash) (*wire.MsgBlock, error) {
-	B.Called(blockHash)
+	args := B.Called(blockHash)
+	if len(args) > 0 {
+		return args.Get(0).(*wire.MsgBlock), args.Error(1)
+	}
 	return new(wire.MsgBlock), nil
 }
 
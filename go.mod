@@ -9,7 +9,9 @@ require (
 	github.com/felixge/httpsnoop v1.0.2 // indirect
 	github.com/gorilla/handlers v1.5.1
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/jmoiron/sqlx v1.3.4
+	github.com/prometheus/client_golang v1.11.0
 	github.com/rsksmart/liquidity-provider v0.0.0-20220407085629-6b03864a1079
 	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/objx v0.3.0 // indirect
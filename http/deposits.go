@@ -0,0 +1,185 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	depositEventConfirmation = "confirmation"
+	depositEventReady        = "ready"
+
+	depositSubscriberBuffer = 64
+	wsWriteTimeout          = 10 * time.Second
+	wsMaxMessageSize        = 64 * 1024
+)
+
+// depositEvent reports a new confirmation of the deposit made for an accepted quote. The event is ready once the
+// deposit has the confirmations the bridge requires to register the peg-in.
+type depositEvent struct {
+	Type          string `json:"type"`
+	QuoteHash     string `json:"quoteHash"`
+	TxHash        string `json:"txHash"`
+	Confirmations int64  `json:"confirmations"`
+}
+
+func newDepositEvent(quoteHash string, txHash string, confirmations int64, requiredConfirmations int64) depositEvent {
+	e := depositEvent{Type: depositEventConfirmation, QuoteHash: quoteHash, TxHash: txHash, Confirmations: confirmations}
+	if confirmations >= requiredConfirmations {
+		e.Type = depositEventReady
+	}
+	return e
+}
+
+// depositEventBus delivers the deposit events to every subscriber, synchronously, so subscribers must not block.
+// Unlike the tx events, subscribers come and go with the websocket connections. A nil depositEventBus drops the events.
+type depositEventBus struct {
+	mu          sync.RWMutex
+	nextID      int
+	subscribers map[int]func(depositEvent)
+}
+
+func newDepositEventBus() *depositEventBus {
+	return &depositEventBus{subscribers: make(map[int]func(depositEvent))}
+}
+
+// subscribe adds a subscriber, returning the func that removes it
+func (b *depositEventBus) subscribe(f func(depositEvent)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextID
+	b.nextID++
+	b.subscribers[id] = f
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, id)
+	}
+}
+
+func (b *depositEventBus) publish(e depositEvent) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, f := range b.subscribers {
+		f(e)
+	}
+}
+
+// depositSubscription keeps the quote hashes a websocket client asked for and queues their events. Events that don't
+// fit in the queue are dropped, so that a slow client can't hold up the watchers publishing them.
+type depositSubscription struct {
+	mu     sync.Mutex
+	hashes map[string]bool
+	events chan depositEvent
+}
+
+func newDepositSubscription() *depositSubscription {
+	return &depositSubscription{
+		hashes: make(map[string]bool),
+		events: make(chan depositEvent, depositSubscriberBuffer),
+	}
+}
+
+func (s *depositSubscription) add(hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hashes[hash] = true
+}
+
+func (s *depositSubscription) deliver(e depositEvent) {
+	s.mu.Lock()
+	subscribed := s.hashes[strings.ToLower(e.QuoteHash)]
+	s.mu.Unlock()
+	if !subscribed {
+		return
+	}
+	select {
+	case s.events <- e:
+	default:
+		log.Warnf("deposit subscriber is too slow; dropping event for quote %v at %v confirmations", e.QuoteHash, e.Confirmations)
+	}
+}
+
+// depositSubscribeReq is sent by websocket clients to add the quotes whose deposits they want to follow
+type depositSubscribeReq struct {
+	QuoteHashes []string `json:"quoteHashes"`
+}
+
+var wsUpgrader = websocket.Upgrader{}
+
+// depositsWSHandler streams the deposit events of the quotes the client subscribes to, until it disconnects
+func (s *Server) depositsWSHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already answered the request
+		logger.Error("error upgrading deposits connection: ", err.Error())
+		return
+	}
+	defer func(conn *websocket.Conn) {
+		_ = conn.Close()
+	}(conn)
+	conn.SetReadLimit(wsMaxMessageSize)
+
+	sub := newDepositSubscription()
+	unsubscribe := s.depositEvents.subscribe(sub.deliver)
+	defer unsubscribe()
+
+	// only this goroutine writes to the connection, so the reader hands its errors over
+	errs := make(chan errorRes, 1)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			var req depositSubscribeReq
+			err := conn.ReadJSON(&req)
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				errs <- errorRes{Message: "invalid subscription; expected {\"quoteHashes\": [...]}"}
+				return
+			} else if err != nil { // the client went away
+				return
+			}
+			for _, h := range req.QuoteHashes {
+				hash, err := normalizeQuoteHash(h)
+				if err != nil {
+					errs <- errorRes{Message: "invalid quote hash: " + h}
+					return
+				}
+				sub.add(hash)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case e := <-sub.events:
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteJSON(e); err != nil {
+				logger.Error("error writing deposit event: ", err.Error())
+				return
+			}
+		case <-closed:
+			// the reader stops on invalid subscriptions too, which are answered before closing
+			select {
+			case res := <-errs:
+				_ = conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+				_ = conn.WriteJSON(res)
+				_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseUnsupportedData, res.Message))
+			default:
+			}
+			return
+		}
+	}
+}
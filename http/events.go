@@ -0,0 +1,72 @@
+package http
+
+import (
+	"math/big"
+	"sync"
+	"time"
+
+	gethTypes "github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	txTypeCallForUser   = "callForUser"
+	txTypeRegisterPegIn = "registerPegIn"
+)
+
+// txSubmittedEvent describes a transaction sent to the LBC on behalf of a quote, at the moment it's submitted
+type txSubmittedEvent struct {
+	QuoteHash string   `json:"quoteHash"`
+	TxHash    string   `json:"txHash"`
+	TxType    string   `json:"txType"`
+	GasPrice  *big.Int `json:"gasPrice"`
+	Nonce     uint64   `json:"nonce"`
+	Timestamp int64    `json:"timestamp"`
+}
+
+// txEventBus delivers the submitted transaction events to every subscriber, synchronously and in subscription order,
+// so subscribers must not block. A nil txEventBus drops the events.
+type txEventBus struct {
+	mu          sync.RWMutex
+	subscribers []func(txSubmittedEvent)
+}
+
+func (b *txEventBus) subscribe(f func(txSubmittedEvent)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, f)
+}
+
+func (b *txEventBus) publish(e txSubmittedEvent) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, f := range b.subscribers {
+		f(e)
+	}
+}
+
+// newTxEventBus returns a bus whose events are logged and counted in the metrics
+func newTxEventBus(m *metrics) *txEventBus {
+	b := &txEventBus{}
+	b.subscribe(func(e txSubmittedEvent) {
+		log.Infof("%v tx submitted; quote hash: %v; tx hash: %v; gas price: %v; nonce: %v", e.TxType, e.QuoteHash, e.TxHash, e.GasPrice, e.Nonce)
+	})
+	b.subscribe(func(e txSubmittedEvent) {
+		m.submittedTxs.WithLabelValues(e.TxType).Inc()
+	})
+	return b
+}
+
+func newTxSubmittedEvent(hash string, txType string, tx *gethTypes.Transaction) txSubmittedEvent {
+	return txSubmittedEvent{
+		QuoteHash: hash,
+		TxHash:    tx.Hash().Hex(),
+		TxType:    txType,
+		GasPrice:  tx.GasPrice(),
+		Nonce:     tx.Nonce(),
+		Timestamp: time.Now().Unix(),
+	}
+}
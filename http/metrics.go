@@ -0,0 +1,103 @@
+package http
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	quoteErrorProviderDeclined = "provider_declined"
+	quoteErrorStoreFailed      = "store_failed"
+	quoteErrorGasTooHigh       = "gas_too_high"
+	quoteErrorRateLimited      = "rate_limited"
+	quoteErrorFeeTooHigh       = "fee_too_high"
+	quoteErrorCallReverts      = "call_reverts"
+	quoteErrorNoLiquidity      = "no_liquidity"
+	quoteErrorFeeBelowGasCost  = "fee_below_gas_cost"
+)
+
+type metrics struct {
+	quoteRequests  prometheus.Counter
+	quotes         prometheus.Counter
+	quoteErrors    *prometheus.CounterVec
+	acceptedQuotes prometheus.Counter
+	expiredQuotes  prometheus.Counter
+	stateChanges   *prometheus.CounterVec
+	btcQueueDepth  prometheus.GaugeFunc
+	gasPrice       prometheus.Gauge
+	maxGasPrice    prometheus.Gauge
+	submittedTxs   *prometheus.CounterVec
+	watchers       prometheus.Gauge
+	handlerTime    *prometheus.HistogramVec
+}
+
+func newMetrics(reg prometheus.Registerer, btcQueueDepth func() int64, maxGasPrice uint64) *metrics {
+	m := &metrics{
+		quoteRequests: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "lps",
+			Name:      "quote_requests_total",
+			Help:      "Number of requests received by getQuote.",
+		}),
+		quotes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "lps",
+			Name:      "quotes_total",
+			Help:      "Number of quotes returned by getQuote.",
+		}),
+		quoteErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "lps",
+			Name:      "quote_errors_total",
+			Help:      "Number of quotes getQuote couldn't return, by reason.",
+		}, []string{"reason"}),
+		acceptedQuotes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "lps",
+			Name:      "accepted_quotes_total",
+			Help:      "Number of quotes accepted through acceptQuote.",
+		}),
+		expiredQuotes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "lps",
+			Name:      "quotes_expired_total",
+			Help:      "Number of accepted quotes whose deposit time elapsed without a deposit.",
+		}),
+		stateChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "lps",
+			Name:      "quote_state_changes_total",
+			Help:      "Number of retained quotes that reached each state.",
+		}, []string{"state"}),
+		btcQueueDepth: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "lps",
+			Name:      "btc_rpc_queue_depth",
+			Help:      "Number of BTC RPC calls waiting for a free connection slot.",
+		}, func() float64 {
+			return float64(btcQueueDepth())
+		}),
+		gasPrice: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "lps",
+			Name:      "rsk_gas_price_wei",
+			Help:      "RSK gas price seen by the latest quote request.",
+		}),
+		maxGasPrice: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "lps",
+			Name:      "max_acceptable_gas_price_wei",
+			Help:      "RSK gas price above which quotes are declined; 0 when there's no limit.",
+		}),
+		submittedTxs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "lps",
+			Name:      "pegin_txs_submitted_total",
+			Help:      "Number of callForUser and registerPegIn transactions submitted to the LBC.",
+		}, []string{"type"}),
+		watchers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "lps",
+			Name:      "deposit_watchers",
+			Help:      "Number of deposit addresses being watched.",
+		}),
+		handlerTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "lps",
+			Name:      "handler_duration_seconds",
+			Help:      "Time spent answering getQuote and acceptQuote requests, by handler.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"handler"}),
+	}
+	m.maxGasPrice.Set(float64(maxGasPrice))
+	reg.MustRegister(m.quoteRequests, m.quotes, m.quoteErrors, m.acceptedQuotes, m.expiredQuotes, m.stateChanges, m.btcQueueDepth,
+		m.gasPrice, m.maxGasPrice, m.submittedTxs, m.watchers, m.handlerTime)
+	return m
+}
@@ -0,0 +1,187 @@
+package http
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idle client buckets are dropped once they'd be full again, at most this often
+const clientBucketSweepInterval = 1 * time.Minute
+
+// QuoteRateLimit caps the quotes a provider generates, regardless of how many requests the server gets
+type QuoteRateLimit struct {
+	Rate  float64 // quotes per second; 0 disables the limit
+	Burst uint    // quotes that can be generated at once after an idle period (default: 1)
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket for the time elapsed since the last call and takes a token, if there's one
+func (b *tokenBucket) take(now time.Time) bool {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// retryAfter returns how long until the bucket has a token again, as of its last take
+func (b *tokenBucket) retryAfter() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// quoteRateLimiter keeps a token bucket per provider address. Providers without a limit are always allowed.
+type quoteRateLimiter struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	buckets map[string]*tokenBucket
+}
+
+func newQuoteRateLimiter(limits map[string]QuoteRateLimit, now func() time.Time) *quoteRateLimiter {
+	l := &quoteRateLimiter{
+		now:     now,
+		buckets: make(map[string]*tokenBucket),
+	}
+	start := now()
+	for addr, limit := range limits {
+		if limit.Rate <= 0 {
+			continue
+		}
+		burst := float64(limit.Burst)
+		if burst < 1 {
+			burst = 1
+		}
+		l.buckets[strings.ToLower(addr)] = &tokenBucket{
+			rate:   limit.Rate,
+			burst:  burst,
+			tokens: burst,
+			last:   start,
+		}
+	}
+	return l
+}
+
+func (l *quoteRateLimiter) allow(addr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[strings.ToLower(addr)]
+	if !ok {
+		return true
+	}
+	return b.take(l.now())
+}
+
+// ClientRateLimit caps the getQuote and acceptQuote requests each client IP makes, since every one of them costs calls
+// to the RSK node
+type ClientRateLimit struct {
+	Rate            float64 // requests per second; 0 disables the limit
+	Burst           uint    // requests that can be made at once after an idle period (default: 1)
+	TrustForwarding bool    // when set, the client IP is the last one in X-Forwarded-For; only safe behind a proxy that sets it
+}
+
+// clientRateLimiter keeps a token bucket per client IP, created on the client's first request
+type clientRateLimiter struct {
+	mu        sync.Mutex
+	cfg       ClientRateLimit
+	burst     float64
+	now       func() time.Time
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newClientRateLimiter(cfg ClientRateLimit, now func() time.Time) *clientRateLimiter {
+	burst := float64(cfg.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &clientRateLimiter{
+		cfg:       cfg,
+		burst:     burst,
+		now:       now,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: now(),
+	}
+}
+
+// allow takes a token from the client's bucket. When there's none, it returns how long the client should wait.
+func (l *clientRateLimiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{rate: l.cfg.Rate, burst: l.burst, tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	if b.take(now) {
+		return true, 0
+	}
+	return false, b.retryAfter()
+}
+
+// sweep drops the buckets that refilled since their last use, which behave the same as new ones
+func (l *clientRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < clientBucketSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+func (l *clientRateLimiter) clientIP(r *http.Request) string {
+	if l.cfg.TrustForwarding {
+		// the last hop is the one added by our proxy; the ones before it are up to the client
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			hops := strings.Split(fwd, ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limit answers 429 to the clients that exhausted their bucket. It's a no-op when the limit is disabled.
+func (l *clientRateLimiter) limit(next http.HandlerFunc) http.HandlerFunc {
+	if l.cfg.Rate <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := l.clientIP(r)
+		ok, wait := l.allow(client)
+		if !ok {
+			requestLogger(r).Warnf("rate limiting client %v on %v", client, r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			jsonError(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
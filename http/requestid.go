@@ -0,0 +1,66 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/handlers"
+	log "github.com/sirupsen/logrus"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// ids given by clients or proxies are kept only if they can't garble the logs
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withRequestID tags each request with a correlation id, taken from the X-Request-Id header when the client or a proxy
+// already set one. The id is returned in the response header, where jsonError also picks it up, and kept in the request
+// context, where requestLogger adds it to the handler logs, so that a client can quote it and the matching server logs
+// can be found.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Error("error generating request id: ", err)
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestLogger returns a logger that tags every entry with the id of the request, if it went through withRequestID
+func requestLogger(r *http.Request) *log.Entry {
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return log.WithField("requestId", id)
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// logAccess is the access log formatter. It logs through the request logger rather than writing a line in the common
+// log format, so that access logs carry the request id and are formatted like the rest.
+func logAccess(_ io.Writer, p handlers.LogFormatterParams) {
+	requestLogger(p.Request).WithFields(log.Fields{
+		"remoteAddr": p.Request.RemoteAddr,
+		"method":     p.Request.Method,
+		"path":       p.URL.Path,
+		"status":     p.StatusCode,
+		"size":       p.Size,
+		"duration":   time.Since(p.TimeStamp).String(),
+	}).Debug("request served")
+}
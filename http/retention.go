@@ -0,0 +1,54 @@
+package http
+
+import (
+	"time"
+
+	"github.com/rsksmart/liquidity-provider/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// RetentionConfig holds how long quotes are kept after their deposit time elapsed, by how far they got. Records of
+// accepted quotes back audits and disputes, so only the unaccepted ones are pruned unless told otherwise.
+type RetentionConfig struct {
+	Created   uint // seconds unaccepted quotes are kept (default: 300)
+	Expired   uint // seconds accepted quotes that never got a deposit are kept; 0 keeps them forever
+	Completed uint // seconds peg-ins registered on the LBC are kept; 0 keeps them forever
+	Failed    uint // seconds quotes whose callForUser or registerPegIn failed are kept; 0 keeps them forever
+}
+
+type retentionClass struct {
+	name   string
+	states []types.RQState
+	ttl    uint
+}
+
+func (s *Server) createdQuoteTTL() time.Duration {
+	if s.cfg.Retention.Created == 0 {
+		return quoteExpTimeThreshold
+	}
+	return time.Duration(s.cfg.Retention.Created) * time.Second
+}
+
+// pruneRetainedQuotes deletes the accepted quotes that outlived the retention of their state. Quotes still in flight
+// are never pruned.
+func (s *Server) pruneRetainedQuotes() error {
+	classes := []retentionClass{
+		{"expired", []types.RQState{types.RQStateTimeForDepositElapsed}, s.cfg.Retention.Expired},
+		{"completed", []types.RQState{types.RQStateRegisterPegInSucceeded}, s.cfg.Retention.Completed},
+		{"failed", []types.RQState{types.RQStateCallForUserFailed, types.RQStateRegisterPegInFailed}, s.cfg.Retention.Failed},
+	}
+	now := s.now()
+	for _, c := range classes {
+		if c.ttl == 0 {
+			continue
+		}
+		n, err := s.db.DeleteRetainedQuotes(c.states, now.Add(-time.Duration(c.ttl)*time.Second))
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Debugf("pruned %v %v quotes", n, c.name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package http
+
+import "time"
+
+// retryWithBackoff calls f until it succeeds or the retries are exhausted, doubling the wait between attempts.
+// The last error is returned.
+func retryWithBackoff(retries uint, backoff time.Duration, sleep func(time.Duration), f func() error) error {
+	var err error
+	for i := uint(0); i <= retries; i++ {
+		if i > 0 {
+			sleep(backoff)
+			backoff *= 2
+		}
+		err = f()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
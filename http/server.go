@@ -1,6 +1,7 @@
 package http
 
 import (
+	"bytes"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -9,7 +10,11 @@ import (
 	"io"
 	"math"
 	"math/big"
+	"net"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,6 +24,8 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rsksmart/liquidity-provider-server/connectors"
 	"github.com/rsksmart/liquidity-provider-server/storage"
 	"github.com/rsksmart/liquidity-provider/providers"
@@ -30,21 +37,89 @@ const (
 	svcStatusOk          = "ok"
 	svcStatusDegraded    = "degraded"
 	svcStatusUnreachable = "unreachable"
+	svcStatusSyncing     = "syncing"
 )
 
-const quoteCleaningInterval = 1 * time.Hour
+const defaultQuoteCleaningInterval = 1 * time.Hour
 const quoteExpTimeThreshold = 5 * time.Minute
+const signRetryBackoff = 1 * time.Second
+const defaultDepositPollInterval = 1 * time.Minute
+const defaultRskConfirmations = 6
+const defaultMaxCallDataSize = 32 * 1024
+const defaultQuotesPageSize = 50
+const maxQuotesPageSize = 500
+const idempotencyKeyTTL = 24 * time.Hour
+const idempotencyKeyHeader = "Idempotency-Key"
+const nodeUnavailableRetryAfter = 10 // seconds clients are told to wait before retrying when the RSK node is unreachable
+
+var validIdempotencyKey = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+var ErrSigningUnavailable = errors.New("signing unavailable")
+var ErrQuoteHashCollision = errors.New("quote hash collision")
+var ErrNoProviders = errors.New("no liquidity providers registered")
+var ErrInvalidListenAddress = errors.New("invalid listen address")
+var ErrDuplicateProvider = errors.New("provider already added")
+
+// Config holds the settings of the http server that can be tuned by the operator
+type Config struct {
+	VerifyQuoteHash           bool // when set, quote hashes computed locally are checked against LBC.hashQuote
+	ClockSkewTolerance        uint // seconds a quote is still accepted after its deposit time elapsed, to absorb clock differences between instances
+	DepositWindowOffset       uint // seconds between an accept and the start of the deposit window it leaves the user; shortens the window, never extends it
+	FutureQuoteTolerance      uint // seconds a quote's agreement timestamp may be ahead of the clock at accept time; 0 disables the check
+	Webhook                   WebhookConfig
+	Retention                 RetentionConfig
+	SignRetries               uint                      // retries on quote signing failures; only useful with remote signers, whose failures can be transient
+	QuoteExpiration           bool                      // when set, quotes include the seconds left to accept them and to deposit, computed against the RSK block time
+	AllowReservedCalls        bool                      // when set, quotes can target the zero, LBC and bridge addresses
+	ServerTiming              bool                      // when set, quote responses include a Server-Timing header with the time spent on each backend
+	LenientEndpoints          []string                  // endpoints whose request bodies may contain unknown fields; the rest reject them
+	PartialQuotes             bool                      // when set, quotes that couldn't be stored are left out of getQuote's response instead of failing it
+	MaxAcceptableGasPrice     uint64                    // gas price (in wei) above which getQuote declines to quote; 0 disables the limit
+	RejectContractRefunds     bool                      // when set, quote requests whose RSK refund address is a contract are rejected
+	DepositPollInterval       uint                      // seconds between checks of each deposit address (default: 60)
+	ExpiredQuoteSweepInterval uint                      // seconds between sweeps moving accepted quotes past their deposit time to the expired state; 0 disables it
+	ExpiredQuoteCleanInterval uint                      // seconds between deletions of the quotes that expired without being accepted (default: 3600)
+	RskConfirmations          uint64                    // RSK confirmations callForUser and registerPegIn must reach before the quote moves on (default: 6)
+	AcceptQuoteTimeout        uint                      // seconds acceptQuote may take before it's abandoned with a 504; 0 leaves it bounded by the request only
+	AllowDataToAccounts       bool                      // when set, quote requests can send call data to addresses without code
+	QuoteRateLimits           map[string]QuoteRateLimit // quotes each provider may generate, by provider address; providers not listed aren't limited
+	ClientRateLimit           ClientRateLimit           // getQuote and acceptQuote requests each client IP may make
+	AllowedOrigins            []string                  // origins browsers may call the api from; empty disables CORS
+	RequireGasCoverage        bool                      // when set, quotes whose call fee doesn't cover the estimated gas at the current gas price are left out
+	MaxWatchers               uint                      // deposits that can be watched at once; acceptQuote answers 503 beyond it. 0 disables the limit
+	MaxCallFeeRatio           float64                   // fraction of the value above which a provider's call fee is declined; 0 disables the limit
+	MaxCallFee                uint64                    // call fee (in wei) above which a provider's quote is declined; 0 disables the limit
+	ReportCallReverts         bool                      // when set, getQuote answers 422 with the revert reason when the requested call would revert
+	BtcRefundAddressTypes     []string                  // script types (p2pkh, p2sh) accepted as bitcoinRefundAddress; empty accepts any the LBC supports
+	MaxCallDataSize           uint                      // bytes of callContractArguments getQuote estimates gas for; larger requests get a 413 (default: 32768)
+	RegtestMode               bool                      `json:"-"` // set from the top level regtestMode setting; relaxes the checks that don't apply to test chains
+}
 
 type Server struct {
 	srv             http.Server
+	cfg             Config
 	providers       []providers.LiquidityProvider
+	providersByAddr map[string]providers.LiquidityProvider
+	providersMu     sync.RWMutex
 	rsk             connectors.RSKConnector
 	btc             connectors.BTCConnector
 	db              storage.DBConnector
 	now             func() time.Time
+	sleep           func(time.Duration)
+	webhook         *webhookNotifier
+	metrics         *metrics
+	txEvents        *txEventBus
+	depositEvents   *depositEventBus
+	quoteLimiter    *quoteRateLimiter
+	clientLimiter   *clientRateLimiter
+	gatherer        prometheus.Gatherer
 	watchers        map[string]*BTCAddressWatcher
+	pendingWatchers uint
 	addWatcherMu    sync.Mutex
 	sharedWatcherMu sync.Mutex
+	reserveLiqMu    sync.Mutex
+	statusMu        sync.Mutex
+	status          *serverStatus
 }
 
 type QuoteRequest struct {
@@ -56,29 +131,106 @@ type QuoteRequest struct {
 	BitcoinRefundAddress  string     `json:"bitcoinRefundAddress"`
 }
 
+type quoteRes struct {
+	*types.Quote
+	RequiredBridgeConfirmations int64 `json:"requiredBridgeConfirmations"`
+	*quoteExpiration
+}
+
+// providerQuoteRes attributes a quote to the provider that issued it
+type providerQuoteRes struct {
+	ProviderID   string   `json:"providerId"`
+	ProviderName string   `json:"providerName,omitempty"`
+	QuoteHash    string   `json:"quoteHash"`
+	Quote        quoteRes `json:"quote"`
+}
+
+// namedProvider is implemented by the providers that have a display name
+type namedProvider interface {
+	Name() string
+}
+
+// limitedProvider is implemented by the providers that only quote values within a range
+type limitedProvider interface {
+	MinTransactionValue() *types.Wei
+	MaxTransactionValue() *types.Wei
+}
+
+// pricedProvider is implemented by the providers that publish the fees they charge
+type pricedProvider interface {
+	CallFee() *types.Wei
+	PenaltyFee() *types.Wei
+}
+
+type quoteExpiration struct {
+	AcceptExpiresInSeconds  int64 `json:"acceptExpiresInSeconds"`
+	DepositExpiresInSeconds int64 `json:"depositExpiresInSeconds"`
+}
+
 type acceptReq struct {
 	QuoteHash string
 }
 
-func New(rsk connectors.RSKConnector, btc connectors.BTCConnector, db storage.DBConnector) Server {
-	return newServer(rsk, btc, db, time.Now)
+type errorRes struct {
+	Message   string `json:"message"`
+	Reason    string `json:"declineReason,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
 }
 
-func newServer(rsk connectors.RSKConnector, btc connectors.BTCConnector, db storage.DBConnector, now func() time.Time) Server {
+// reasons given to clients when getQuote declines to quote because of the request itself
+const (
+	declineContractWouldRevert = "ContractWouldRevert"
+	declineNoQuotesAvailable   = "NoQuotesAvailable"
+	declineNodeUnavailable     = "NodeUnavailable"
+)
+
+// New creates a server whose metrics are registered on reg. When reg is nil, the global prometheus registry is used.
+func New(rsk connectors.RSKConnector, btc connectors.BTCConnector, db storage.DBConnector, cfg Config, reg prometheus.Registerer) Server {
+	return newServer(rsk, btc, db, cfg, reg, time.Now)
+}
+
+func newServer(rsk connectors.RSKConnector, btc connectors.BTCConnector, db storage.DBConnector, cfg Config, reg prometheus.Registerer, now func() time.Time) Server {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	gatherer, ok := reg.(prometheus.Gatherer)
+	if !ok {
+		gatherer = prometheus.DefaultGatherer
+	}
+	m := newMetrics(reg, btc.RPCQueueDepth, cfg.MaxAcceptableGasPrice)
 	return Server{
-		rsk:       rsk,
-		btc:       btc,
-		db:        db,
-		providers: make([]providers.LiquidityProvider, 0),
-		now:       now,
-		watchers:  make(map[string]*BTCAddressWatcher),
+		cfg:             cfg,
+		rsk:             rsk,
+		btc:             btc,
+		db:              db,
+		providers:       make([]providers.LiquidityProvider, 0),
+		providersByAddr: make(map[string]providers.LiquidityProvider),
+		now:             now,
+		sleep:           time.Sleep,
+		webhook:         newWebhookNotifier(cfg.Webhook, now),
+		metrics:         m,
+		txEvents:        newTxEventBus(m),
+		depositEvents:   newDepositEventBus(),
+		quoteLimiter:    newQuoteRateLimiter(cfg.QuoteRateLimits, now),
+		clientLimiter:   newClientRateLimiter(cfg.ClientRateLimit, now),
+		gatherer:        gatherer,
+		watchers:        make(map[string]*BTCAddressWatcher),
 	}
 }
 
+// AddProvider adds a provider to the ones quoting through the server, registering it in the LBC or topping up its
+// collateral when needed. Each address can only be added once.
 func (s *Server) AddProvider(lp providers.LiquidityProvider) error {
+	s.providersMu.Lock()
+	if getProviderByAddress(s.providersByAddr, lp.Address()) != nil {
+		s.providersMu.Unlock()
+		return fmt.Errorf("%w: %v", ErrDuplicateProvider, lp.Address())
+	}
 	s.providers = append(s.providers, lp)
+	s.providersByAddr = indexProviders(s.providers)
+	s.providersMu.Unlock()
 	addrStr := lp.Address()
-	c, m, err := s.rsk.GetCollateral(addrStr)
+	c, m, err := s.rsk.GetCollateral(context.Background(), addrStr)
 	if err != nil {
 		return err
 	}
@@ -90,7 +242,7 @@ func (s *Server) AddProvider(lp providers.LiquidityProvider) error {
 			From:   addr,
 			Signer: lp.SignTx,
 		}
-		err := s.rsk.RegisterProvider(opts)
+		err := s.rsk.RegisterProvider(context.Background(), opts)
 		if err != nil {
 			return err
 		}
@@ -100,7 +252,7 @@ func (s *Server) AddProvider(lp providers.LiquidityProvider) error {
 			From:   addr,
 			Signer: lp.SignTx,
 		}
-		err := s.rsk.AddCollateral(opts)
+		err := s.rsk.AddCollateral(context.Background(), opts)
 		if err != nil {
 			return err
 		}
@@ -109,29 +261,73 @@ func (s *Server) AddProvider(lp providers.LiquidityProvider) error {
 	return nil
 }
 
-func (s *Server) Start(port uint) error {
+func (s *Server) newRouter() *mux.Router {
 	r := mux.NewRouter()
 	r.Path("/health").Methods(http.MethodGet).HandlerFunc(s.checkHealthHandler)
-	r.Path("/getQuote").Methods(http.MethodPost).HandlerFunc(s.getQuoteHandler)
-	r.Path("/acceptQuote").Methods(http.MethodPost).HandlerFunc(s.acceptQuoteHandler)
-	w := log.StandardLogger().WriterLevel(log.DebugLevel)
-	h := handlers.LoggingHandler(w, r)
-	defer func(w *io.PipeWriter) {
-		_ = w.Close()
-	}(w)
+	r.Path("/readyz").Methods(http.MethodGet).HandlerFunc(s.readyHandler)
+	r.Path("/getQuote").Methods(http.MethodPost).HandlerFunc(s.clientLimiter.limit(s.getQuoteHandler))
+	r.Path("/acceptQuote").Methods(http.MethodPost).HandlerFunc(s.clientLimiter.limit(s.acceptQuoteHandler))
+	r.Path("/ws/deposits").Methods(http.MethodGet).HandlerFunc(s.depositsWSHandler)
+	r.Path("/providers").Methods(http.MethodGet).HandlerFunc(s.providersHandler)
+	r.Path("/providers/balance").Methods(http.MethodGet).HandlerFunc(s.providerBalanceHandler)
+	r.Path("/quotes").Methods(http.MethodGet).HandlerFunc(s.listQuotesHandler)
+	r.Path("/admin/node").Methods(http.MethodGet).HandlerFunc(s.nodeInfoHandler)
+	r.Path("/admin/status").Methods(http.MethodGet).HandlerFunc(s.statusHandler)
+	r.Path("/admin/confirmations").Methods(http.MethodGet).HandlerFunc(s.confirmationsHandler)
+	r.Path("/admin/invalidateQuotes").Methods(http.MethodPost).HandlerFunc(s.invalidateQuotesHandler)
+	r.Path("/metrics").Methods(http.MethodGet).Handler(promhttp.HandlerFor(s.gatherer, promhttp.HandlerOpts{}))
+	r.MethodNotAllowedHandler = methodNotAllowedHandler(r)
+	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	return r
+}
+
+// withCORS answers the preflight requests of the allowed origins, without reaching the handlers, and lets browsers
+// read the responses to their requests. It's a no-op when no origin is allowed.
+func (s *Server) withCORS(next http.Handler) http.Handler {
+	if len(s.cfg.AllowedOrigins) == 0 {
+		return next
+	}
+	return handlers.CORS(
+		handlers.AllowedOrigins(s.cfg.AllowedOrigins),
+		handlers.AllowedMethods([]string{http.MethodPost, http.MethodOptions}),
+		handlers.AllowedHeaders([]string{"Content-Type", requestIDHeader}),
+		handlers.ExposedHeaders([]string{requestIDHeader, "Retry-After"}),
+	)(next)
+}
+
+// Start serves the api on the given host and port. An empty host listens on all interfaces.
+func (s *Server) Start(host string, port uint) error {
+	// without providers the server would answer every quote request with an empty list
+	if len(s.Providers()) == 0 {
+		return ErrNoProviders
+	}
+	addr, err := listenAddress(host, port)
+	if err != nil {
+		return err
+	}
+	// a misspelled type would otherwise make getQuote reject every refund address
+	for _, t := range s.cfg.BtcRefundAddressTypes {
+		if !containsFold([]string{connectors.BtcAddressTypeP2PKH, connectors.BtcAddressTypeP2SH}, t) {
+			return fmt.Errorf("unsupported btc refund address type: %v", t)
+		}
+	}
+
+	r := s.newRouter()
+	h := withRequestID(handlers.CustomLoggingHandler(io.Discard, s.withCORS(r), logAccess))
 
-	err := s.initBtcWatchers()
+	err = s.initBtcWatchers()
 	if err != nil {
 		return err
 	}
 
 	s.initExpiredQuotesCleaner()
+	s.initExpiredQuotesSweeper()
 
 	s.srv = http.Server{
-		Addr:    ":" + fmt.Sprint(port),
+		Addr:    addr,
 		Handler: h,
 	}
-	log.Info("server started at localhost:", s.srv.Addr)
+	log.Info("server started at ", s.srv.Addr)
 
 	err = s.srv.ListenAndServe()
 	if err != http.ErrServerClosed {
@@ -140,6 +336,19 @@ func (s *Server) Start(port uint) error {
 	return nil
 }
 
+// listenAddress joins the bind host and port. Hosts are resolved, so that a mistyped one is reported at startup
+// instead of silently listening somewhere else.
+func listenAddress(host string, port uint) (string, error) {
+	addr := net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+	if host == "" {
+		return addr, nil
+	}
+	if _, err := net.ResolveTCPAddr("tcp", addr); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidListenAddress, err)
+	}
+	return addr, nil
+}
+
 func (s *Server) initBtcWatchers() error {
 	quoteStatesToWatch := []types.RQState{types.RQStateWaitingForDeposit, types.RQStateCallForUserSucceeded}
 	retainedQuotes, err := s.db.GetRetainedQuotes(quoteStatesToWatch)
@@ -148,15 +357,16 @@ func (s *Server) initBtcWatchers() error {
 	}
 
 	for _, entry := range retainedQuotes {
-		quote, err := s.db.GetQuote(entry.QuoteHash)
+		stored, err := s.db.GetQuote(entry.QuoteHash)
 		if err != nil {
 			return err
 		}
-		if quote == nil {
+		if stored == nil {
 			return errors.New(fmt.Sprintf("initBtcWatchers: quote not found for hash: %s", entry.QuoteHash))
 		}
+		quote := stored.Quote
 
-		p := getProviderByAddress(s.providers, quote.LPRSKAddr)
+		p := s.getProvider(quote.LPRSKAddr)
 		if p == nil {
 			return errors.New(fmt.Sprintf("initBtcWatchers: provider not found for LPRSKAddr: %s", quote.LPRSKAddr))
 		}
@@ -187,38 +397,168 @@ func (s *Server) addAddressWatcher(quote *types.Quote, hash string, depositAddr
 	sat, _ := new(types.Wei).Add(quote.Value, quote.CallFee).ToSatoshi().Float64()
 	minBtcAmount := btcutil.Amount(uint64(math.Ceil(sat)))
 	expTime := getQuoteExpTime(quote)
-	watcher := NewBTCAddressWatcher(hash, s.btc, s.rsk, provider, s.db, quote, signB, state, &s.sharedWatcherMu)
-	err := s.btc.AddAddressWatcher(depositAddr, minBtcAmount, time.Minute, expTime, watcher, func(w connectors.AddressWatcher) {
+	watcher := NewBTCAddressWatcher(hash, s.btc, s.rsk, provider, s.db, quote, signB, state, &s.sharedWatcherMu, s.webhook, s.metrics, s.txEvents, s.depositEvents, s.rskConfirmations())
+	err := s.btc.AddAddressWatcher(depositAddr, minBtcAmount, s.depositPollInterval(), expTime, watcher, func(w connectors.AddressWatcher) {
 		s.addWatcherMu.Lock()
 		defer s.addWatcherMu.Unlock()
 		delete(s.watchers, hash)
+		s.metrics.watchers.Set(float64(len(s.watchers)))
 	})
 	if err == nil {
 		log.Info("added watcher for quote: : ", hash, "; deposit addr: ", depositAddr)
 		s.watchers[hash] = watcher
+		s.metrics.watchers.Set(float64(len(s.watchers)))
 	}
 	return err
 }
 
+// reserveWatcher claims room for the watcher of a quote being accepted, so that concurrent accepts can't go past
+// MaxWatchers. The slot must be released once the accept is done, whether the watcher was added or not.
+func (s *Server) reserveWatcher() bool {
+	s.addWatcherMu.Lock()
+	defer s.addWatcherMu.Unlock()
+	if s.cfg.MaxWatchers > 0 && uint(len(s.watchers))+s.pendingWatchers >= s.cfg.MaxWatchers {
+		return false
+	}
+	s.pendingWatchers++
+	return true
+}
+
+func (s *Server) releaseWatcher() {
+	s.addWatcherMu.Lock()
+	defer s.addWatcherMu.Unlock()
+	s.pendingWatchers--
+}
+
 func (s *Server) initExpiredQuotesCleaner() {
+	interval := defaultQuoteCleaningInterval
+	if s.cfg.ExpiredQuoteCleanInterval > 0 {
+		interval = time.Duration(s.cfg.ExpiredQuoteCleanInterval) * time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			err := s.cleanExpiredQuotes()
+			if err != nil {
+				log.Error("error deleting expired quotes: ", err)
+			}
+			err = s.pruneRetainedQuotes()
+			if err != nil {
+				log.Error("error pruning accepted quotes: ", err)
+			}
+			_, err = s.db.DeleteIdempotentResponses(s.now().Add(-idempotencyKeyTTL))
+			if err != nil {
+				log.Error("error deleting idempotency keys: ", err)
+			}
+		}
+	}()
+}
+
+// storeIdempotentResponse stores the response to an accept made with an idempotency key. The quote is already accepted
+// by then, so failing to store it only makes a retry go through the accept again, which returns the same signature.
+func (s *Server) storeIdempotentResponse(key string, hash string, response string) {
+	err := s.db.InsertIdempotentResponse(&storage.IdempotentResponse{
+		Key:       key,
+		QuoteHash: hash,
+		Response:  response,
+		CreatedAt: s.now().Unix(),
+	})
+	if err != nil {
+		log.Error("error storing idempotent response: ", err.Error())
+	}
+}
+
+// cleanExpiredQuotes deletes the quotes whose deposit time elapsed a while ago without them being accepted. Accepted
+// quotes are left alone; pruneRetainedQuotes applies their retention.
+func (s *Server) cleanExpiredQuotes() error {
+	cutoff := s.now().Add(-1 * s.createdQuoteTTL())
+	hashes, err := s.db.GetExpiredQuotes(cutoff)
+	if err != nil {
+		return err
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	log.Debug("deleting expired quotes: ", strings.Join(hashes, ", "))
+	return s.db.DeleteExpiredQuotes(cutoff.Unix())
+}
+
+func (s *Server) rskConfirmations() uint64 {
+	if s.cfg.RskConfirmations == 0 {
+		return defaultRskConfirmations
+	}
+	return s.cfg.RskConfirmations
+}
+
+func (s *Server) depositWindowOffset() time.Duration {
+	return time.Duration(s.cfg.DepositWindowOffset) * time.Second
+}
+
+func (s *Server) maxCallDataSize() uint {
+	if s.cfg.MaxCallDataSize == 0 {
+		return defaultMaxCallDataSize
+	}
+	return s.cfg.MaxCallDataSize
+}
+
+func (s *Server) depositPollInterval() time.Duration {
+	if s.cfg.DepositPollInterval == 0 {
+		return defaultDepositPollInterval
+	}
+	return time.Duration(s.cfg.DepositPollInterval) * time.Second
+}
+
+// initExpiredQuotesSweeper periodically moves the accepted quotes whose deposit time elapsed to the expired state.
+// Unlike the cleaner, which deletes quotes nobody accepted, the sweeper keeps the records for later reconciliation.
+func (s *Server) initExpiredQuotesSweeper() {
+	if s.cfg.ExpiredQuoteSweepInterval == 0 {
+		return
+	}
 	go func() {
-		ticker := time.NewTicker(quoteCleaningInterval)
-		quit := make(chan struct{})
-		for {
-			select {
-			case <-ticker.C:
-				err := s.db.DeleteExpiredQuotes(time.Now().Add(-1 * quoteExpTimeThreshold).Unix())
-				if err != nil {
-					log.Error("error deleting expired quites: ", err)
-				}
-			case <-quit:
-				ticker.Stop()
-				return
+		ticker := time.NewTicker(time.Duration(s.cfg.ExpiredQuoteSweepInterval) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			err := s.sweepExpiredQuotes()
+			if err != nil {
+				log.Error("error sweeping expired quotes: ", err)
 			}
 		}
 	}()
 }
 
+func (s *Server) sweepExpiredQuotes() error {
+	rqs, err := s.db.GetRetainedQuotes([]types.RQState{types.RQStateWaitingForDeposit})
+	if err != nil {
+		return err
+	}
+	for _, rq := range rqs {
+		s.addWatcherMu.Lock()
+		_, watched := s.watchers[rq.QuoteHash]
+		s.addWatcherMu.Unlock()
+		if watched { // the watcher expires the quote itself
+			continue
+		}
+		stored, err := s.db.GetQuote(rq.QuoteHash)
+		if err != nil {
+			return err
+		}
+		if stored == nil || !s.now().After(getQuoteExpTime(stored.Quote)) {
+			continue
+		}
+		err = s.db.UpdateRetainedQuoteState(rq.QuoteHash, types.RQStateWaitingForDeposit, types.RQStateTimeForDepositElapsed)
+		if err != nil {
+			log.Errorf("error expiring quote; hash: %v; error: %v", rq.QuoteHash, err)
+			continue
+		}
+		log.Debugf("time has expired for quote: %v", rq.QuoteHash)
+		s.webhook.notify(rq.QuoteHash, types.RQStateTimeForDepositElapsed)
+		s.metrics.stateChanges.WithLabelValues(strconv.Itoa(int(types.RQStateTimeForDepositElapsed))).Inc()
+		s.metrics.expiredQuotes.Inc()
+	}
+	return nil
+}
+
 func (s *Server) Shutdown() {
 	log.Info("stopping server...")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -229,7 +569,76 @@ func (s *Server) Shutdown() {
 	log.Info("server stopped")
 }
 
-func (s *Server) checkHealthHandler(w http.ResponseWriter, _ *http.Request) {
+func methodNotAllowedHandler(r *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		allowed := allowedMethods(r, req.URL.Path)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		jsonError(w, fmt.Sprintf("method %v not allowed; allowed methods: %v", req.Method, strings.Join(allowed, ", ")), http.StatusMethodNotAllowed)
+	})
+}
+
+func notFoundHandler(w http.ResponseWriter, req *http.Request) {
+	jsonError(w, fmt.Sprintf("path not found: %v", req.URL.Path), http.StatusNotFound)
+}
+
+func allowedMethods(r *mux.Router, path string) []string {
+	var allowed []string
+	_ = r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		pathRegexp, err := route.GetPathRegexp()
+		if err != nil {
+			return nil
+		}
+		if matched, _ := regexp.MatchString(pathRegexp, path); !matched {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		allowed = append(allowed, methods...)
+		return nil
+	})
+	return allowed
+}
+
+// connectorError replies to a request that failed because of the RSK connector, telling clients apart whether it's
+// worth retrying (503, with the NodeUnavailable reason), their request was wrong (400) or neither (500)
+func connectorError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, connectors.ErrNodeUnavailable):
+		w.Header().Set("Retry-After", strconv.Itoa(nodeUnavailableRetryAfter))
+		declineError(w, declineNodeUnavailable, "service unavailable; rsk node unreachable", http.StatusServiceUnavailable)
+	case errors.Is(err, connectors.ErrInvalidAddress):
+		http.Error(w, "bad request; invalid address", http.StatusBadRequest)
+	default:
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
+
+func jsonError(w http.ResponseWriter, message string, code int) {
+	declineError(w, "", message, code)
+}
+
+// declineError answers with a JSON error that tells the client why its request can't be quoted
+func declineError(w http.ResponseWriter, reason string, message string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(errorRes{Message: message, Reason: reason, RequestID: w.Header().Get(requestIDHeader)})
+	if err != nil {
+		log.Error("error encoding error response: ", err.Error())
+	}
+}
+
+func revertMessage(err *connectors.CallRevertError) string {
+	if err.Reason == "" {
+		return "call would revert"
+	}
+	return "call would revert: " + err.Reason
+}
+
+func (s *Server) checkHealthHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
 	type services struct {
 		Db  string `json:"db"`
 		Rsk string `json:"rsk"`
@@ -246,24 +655,33 @@ func (s *Server) checkHealthHandler(w http.ResponseWriter, _ *http.Request) {
 	btcSvcStatus := svcStatusOk
 
 	if err := s.db.CheckConnection(); err != nil {
-		log.Error("error checking db connection status: ", err.Error())
+		logger.Error("error checking db connection status: ", err.Error())
 		dbSvcStatus = svcStatusUnreachable
 		lpsSvcStatus = svcStatusDegraded
 	}
 
-	if err := s.rsk.CheckConnection(); err != nil {
-		log.Error("error checking rsk connection status: ", err.Error())
+	// the server can't serve quotes without both nodes, so it's reported as unavailable when either is unhealthy
+	code := http.StatusOK
+	if healthy, err := s.rsk.HealthCheck(r.Context()); err != nil {
+		logger.Error("error checking rsk connection status: ", err.Error())
 		rskSvcStatus = svcStatusUnreachable
 		lpsSvcStatus = svcStatusDegraded
+		code = http.StatusServiceUnavailable
+	} else if !healthy {
+		rskSvcStatus = svcStatusSyncing
+		lpsSvcStatus = svcStatusDegraded
+		code = http.StatusServiceUnavailable
 	}
 
 	if err := s.btc.CheckConnection(); err != nil {
-		log.Error("error checking btcd connection status: ", err.Error())
+		logger.Error("error checking btcd connection status: ", err.Error())
 		btcSvcStatus = svcStatusUnreachable
 		lpsSvcStatus = svcStatusDegraded
+		code = http.StatusServiceUnavailable
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
 	enc := json.NewEncoder(w)
 	response := healthRes{
 		Status: lpsSvcStatus,
@@ -275,222 +693,927 @@ func (s *Server) checkHealthHandler(w http.ResponseWriter, _ *http.Request) {
 	}
 	err := enc.Encode(response)
 	if err != nil {
-		log.Error("error encoding response: ", err.Error())
+		logger.Error("error encoding response: ", err.Error())
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 	}
 }
 
-func (s *Server) getQuoteHandler(w http.ResponseWriter, r *http.Request) {
-	qr := QuoteRequest{}
-	dec := json.NewDecoder(r.Body)
-	dec.DisallowUnknownFields()
-	err := dec.Decode(&qr)
+// readyHandler tells whether the server can take quote requests. The federation info cache doesn't need to be complete
+// for that, since accepts fetch whatever is missing, but its state is reported so a failed warmup can be noticed.
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	type readyRes struct {
+		Ready           bool   `json:"ready"`
+		FederationCache string `json:"federationCache"`
+	}
+	res := readyRes{
+		Ready:           len(s.Providers()) > 0,
+		FederationCache: s.rsk.FedCacheStatus(),
+	}
+	code := http.StatusOK
+	if !res.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(&res)
 	if err != nil {
-		log.Error("error decoding request: ", err.Error())
-		http.Error(w, "bad request", http.StatusBadRequest)
-		return
+		logger.Error("error encoding response: ", err.Error())
 	}
-	log.Debug("received quote request: ", fmt.Sprintf("%+v", qr))
+}
 
-	gas, err := s.rsk.EstimateGas(qr.CallContractAddress, qr.ValueToTransfer.Copy().AsBigInt(), []byte(qr.CallContractArguments))
+// confirmationsHandler reports, by quote hash, the LBC transactions still waiting for the RSK confirmation depth
+func (s *Server) confirmationsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	res := make(map[string]*pendingTx)
+	s.addWatcherMu.Lock()
+	for hash, watcher := range s.watchers {
+		if p := watcher.pendingConfirmations(); p != nil {
+			res[hash] = p
+		}
+	}
+	s.addWatcherMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(res)
 	if err != nil {
-		log.Error("error estimating gas: ", err.Error())
+		logger.Error("error encoding response: ", err.Error())
 		http.Error(w, "internal server error", http.StatusInternalServerError)
-		return
 	}
+}
 
-	price, err := s.rsk.GasPrice()
+func (s *Server) nodeInfoHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	info, err := s.rsk.NodeInfo(ctx)
 	if err != nil {
-		log.Error("error estimating gas price: ", err.Error())
+		logger.Error("error retrieving rsk node info: ", err.Error())
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	var quotes []*types.Quote
-	fedAddress, err := s.rsk.GetFedAddress()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	err = enc.Encode(&info)
 	if err != nil {
-		log.Error("error retrieving federation address: ", err.Error())
+		logger.Error("error encoding node info: ", err.Error())
 		http.Error(w, "internal server error", http.StatusInternalServerError)
-		return
 	}
+}
 
-	minLockTxValueInSatoshi, err := s.rsk.GetMinimumLockTxValue()
-	if err != nil {
-		log.Error("error retrieving minimum lock tx value: ", err.Error())
-		http.Error(w, "internal server error", http.StatusInternalServerError)
-		return
+// providerBalanceHandler returns the RSK balance of the registered providers, or of the one given by the address
+// query parameter
+func (s *Server) providerBalanceHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	type balanceRes struct {
+		Address string   `json:"address"`
+		Balance *big.Int `json:"balance"`
+		RBTC    string   `json:"rbtc"`
 	}
-	minLockTxValueInWei := types.SatoshiToWei(minLockTxValueInSatoshi.Uint64())
 
-	getQuoteFailed := false
-	amountBelowMinLockTxValue := false
-	q := parseReqToQuote(qr, s.rsk.GetLBCAddress(), fedAddress)
-	for _, p := range s.providers {
-		pq, err := p.GetQuote(q, gas, types.NewBigWei(price))
-		if err != nil {
-			log.Error("error getting quote: ", err)
-			getQuoteFailed = true
-			continue
+	lps := s.Providers()
+	if addr := r.URL.Query().Get("address"); addr != "" {
+		if !common.IsHexAddress(addr) {
+			logger.Error("invalid provider address: ", addr)
+			http.Error(w, "bad request; invalid address", http.StatusBadRequest)
+			return
 		}
-		if pq != nil {
-			if new(types.Wei).Add(pq.Value, pq.CallFee).Cmp(minLockTxValueInWei) < 0 {
-				log.Error("error getting quote; requested amount below bridge's min pegin tx value: ", qr.ValueToTransfer)
-				amountBelowMinLockTxValue = true
-				continue
-			}
-			err = s.storeQuote(pq)
-
-			if err != nil {
-				log.Error(err)
-				http.Error(w, "internal server error", http.StatusInternalServerError)
-				return
-			} else {
-				quotes = append(quotes, pq)
-			}
+		p := s.getProvider(addr)
+		if p == nil {
+			http.Error(w, "provider not found", http.StatusNotFound)
+			return
 		}
+		lps = []providers.LiquidityProvider{p}
 	}
 
-	if len(quotes) == 0 {
-		if amountBelowMinLockTxValue {
-			http.Error(w, "bad request; requested amount below bridge's min pegin tx value", http.StatusBadRequest)
-			return
-		}
-		if getQuoteFailed {
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	res := make([]balanceRes, 0, len(lps))
+	for _, p := range lps {
+		bal, err := s.rsk.GetBalance(ctx, p.Address())
+		if err != nil {
+			logger.Error("error retrieving provider balance: ", err.Error())
+			connectorError(w, err)
 			return
 		}
+		res = append(res, balanceRes{
+			Address: p.Address(),
+			Balance: bal,
+			RBTC:    types.NewBigWei(bal).ToRbtc().Text('f', -1),
+		})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
-	err = enc.Encode(&quotes)
+	err := enc.Encode(&res)
 	if err != nil {
-		log.Error("error encoding quote list: ", err.Error())
+		logger.Error("error encoding provider balances: ", err.Error())
 		http.Error(w, "internal server error", http.StatusInternalServerError)
-		return
 	}
 }
 
-func (s *Server) acceptQuoteHandler(w http.ResponseWriter, r *http.Request) {
-	type acceptRes struct {
-		Signature                 string `json:"signature"`
-		BitcoinDepositAddressHash string `json:"bitcoinDepositAddressHash"`
+// invalidateQuotesHandler deletes the quotes that weren't accepted of a provider that is no longer registered, e.g.
+// after rotating its key, since they can't be signed anymore
+// listQuotesHandler pages through the stored quotes, optionally only those of a provider or issued after a time
+func (s *Server) listQuotesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	type listedQuoteRes struct {
+		QuoteHash string       `json:"quoteHash"`
+		Quote     *types.Quote `json:"quote"`
+	}
+	type listQuotesRes struct {
+		Quotes []listedQuoteRes `json:"quotes"`
+		Total  int              `json:"total"`
+		Limit  uint             `json:"limit"`
+		Offset uint             `json:"offset"`
 	}
-	returnQuoteSignFunc := func(w http.ResponseWriter, signature string, depositAddr string) {
-		enc := json.NewEncoder(w)
-		response := acceptRes{
-			Signature:                 signature,
-			BitcoinDepositAddressHash: depositAddr,
-		}
 
-		err := enc.Encode(response)
+	query := r.URL.Query()
+	filter := storage.QuoteFilter{}
+	if addr := query.Get("lpRskAddress"); addr != "" {
+		if !common.IsHexAddress(addr) {
+			logger.Error("invalid provider address: ", addr)
+			http.Error(w, "bad request; invalid lpRskAddress", http.StatusBadRequest)
+			return
+		}
+		filter.LpRskAddr = addr
+	}
+	if v := query.Get("createdAfter"); v != "" {
+		secs, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || secs < 0 {
+			logger.Error("invalid createdAfter: ", v)
+			http.Error(w, "bad request; createdAfter must be a unix timestamp", http.StatusBadRequest)
+			return
+		}
+		filter.CreatedAfter = time.Unix(secs, 0)
+	}
+	limit := uint(defaultQuotesPageSize)
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || n == 0 || n > maxQuotesPageSize {
+			logger.Error("invalid limit: ", v)
+			http.Error(w, fmt.Sprintf("bad request; limit must be between 1 and %v", maxQuotesPageSize), http.StatusBadRequest)
+			return
+		}
+		limit = uint(n)
+	}
+	offset := uint(0)
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
 		if err != nil {
-			log.Error("error encoding response: ", err.Error())
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+			logger.Error("invalid offset: ", v)
+			http.Error(w, "bad request; offset must be a non-negative integer", http.StatusBadRequest)
+			return
 		}
+		offset = uint(n)
 	}
 
-	req := acceptReq{}
-	w.Header().Set("Content-Type", "application/json")
-	dec := json.NewDecoder(r.Body)
-	err := dec.Decode(&req)
+	quotes, total, err := s.db.ListQuotes(filter, limit, offset)
 	if err != nil {
-		log.Error("error decoding request: ", err.Error())
-		http.Error(w, "bad request", http.StatusBadRequest)
+		logger.Error("error listing quotes: ", err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
-
-	hashBytes, err := hex.DecodeString(req.QuoteHash)
-	if err != nil {
-		log.Error("error decoding quote hash: ", err.Error())
-		http.Error(w, "bad request", http.StatusBadRequest)
-		return
+	res := listQuotesRes{Quotes: make([]listedQuoteRes, 0, len(quotes)), Total: total, Limit: limit, Offset: offset}
+	for _, q := range quotes {
+		quote := q.Quote
+		res.Quotes = append(res.Quotes, listedQuoteRes{QuoteHash: q.Hash, Quote: &quote})
 	}
 
-	quote, err := s.db.GetQuote(req.QuoteHash)
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	err = enc.Encode(res)
 	if err != nil {
-		log.Error("error retrieving quote from db: ", err.Error())
+		logger.Error("error encoding response: ", err.Error())
 		http.Error(w, "internal server error", http.StatusInternalServerError)
-		return
-	}
-	if quote == nil {
-		log.Error("quote not found for hash: ", req.QuoteHash)
-		http.Error(w, "quote not found", http.StatusNotFound)
-		return
 	}
+}
 
-	expTime := getQuoteExpTime(quote)
-	if s.now().After(expTime) {
-		log.Error("quote deposit time has elapsed; hash: ", req.QuoteHash)
-		http.Error(w, "forbidden; quote deposit time has elapsed", http.StatusForbidden)
-		return
+func (s *Server) invalidateQuotesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	type invalidateReq struct {
+		ProviderAddress string `json:"providerAddress"`
+	}
+	type invalidateRes struct {
+		Deleted int64 `json:"deleted"`
 	}
 
-	rq, err := s.db.GetRetainedQuote(req.QuoteHash)
+	req := invalidateReq{}
+	err := s.decodeRequest(r, "invalidateQuotes", &req)
 	if err != nil {
-		log.Error("error fetching retained quote: ", err.Error())
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		logger.Error("error decoding request: ", err.Error())
+		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
-	if rq != nil { // if the quote has already been accepted, just return signature and deposit addr
-		returnQuoteSignFunc(w, rq.Signature, rq.DepositAddr)
+	if !common.IsHexAddress(req.ProviderAddress) {
+		logger.Error("invalid provider address: ", req.ProviderAddress)
+		http.Error(w, "bad request; invalid providerAddress", http.StatusBadRequest)
 		return
 	}
-
-	btcRefAddr, lpBTCAddr, lbcAddr, err := decodeAddresses(quote.BTCRefundAddr, quote.LPBTCAddr, quote.LBCAddr)
-	if err != nil {
-		log.Error("error decoding addresses: ", err.Error())
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+	if s.getProvider(req.ProviderAddress) != nil {
+		logger.Error("refusing to invalidate the quotes of a registered provider: ", req.ProviderAddress)
+		http.Error(w, "conflict; provider is still registered", http.StatusConflict)
 		return
 	}
 
-	fedInfo, err := s.rsk.FetchFederationInfo()
+	deleted, err := s.db.DeleteProviderQuotes(req.ProviderAddress)
 	if err != nil {
-		log.Error("error fetching fed info: ", err.Error())
+		logger.Error("error deleting provider quotes: ", err.Error())
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	depositAddress, err := s.btc.GetDerivedBitcoinAddress(fedInfo, btcRefAddr, lbcAddr, lpBTCAddr, hashBytes)
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	err = enc.Encode(invalidateRes{Deleted: deleted})
 	if err != nil {
-		log.Error("error getting derived bitcoin address: ", err.Error())
+		logger.Error("error encoding response: ", err.Error())
 		http.Error(w, "internal server error", http.StatusInternalServerError)
-		return
 	}
+}
 
-	p := getProviderByAddress(s.providers, quote.LPRSKAddr)
-	gasPrice, err := s.rsk.GasPrice()
+func (s *Server) getQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	defer prometheus.NewTimer(s.metrics.handlerTime.WithLabelValues("getQuote")).ObserveDuration()
+	s.metrics.quoteRequests.Inc()
+	qr := QuoteRequest{}
+	err := s.decodeRequest(r, "getQuote", &qr)
 	if err != nil {
-		log.Error("error getting provider by address: ", err.Error())
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		logger.Error("error decoding request: ", err.Error())
+		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
+	logger.Debug("received quote request: ", fmt.Sprintf("%+v", qr))
+	timing := s.newServerTiming()
+	ctx := r.Context()
 
-	adjustedGasLimit := types.NewUWei(uint64(CFUExtraGas) + uint64(quote.GasLimit))
-	gasCost := new(types.Wei).Mul(adjustedGasLimit, types.NewBigWei(gasPrice))
-	reqLiq := new(types.Wei).Add(gasCost, quote.Value)
-	signB, err := p.SignQuote(hashBytes, depositAddress, reqLiq)
-	if err != nil {
-		log.Error("error signing quote: ", err.Error())
-		http.Error(w, "internal server error", http.StatusInternalServerError)
-		return
+	byProvider := false
+	if v := r.URL.Query().Get("byProvider"); v != "" {
+		byProvider, err = strconv.ParseBool(v)
+		if err != nil {
+			logger.Error("error parsing byProvider: ", err.Error())
+			http.Error(w, "bad request; byProvider must be a boolean", http.StatusBadRequest)
+			return
+		}
 	}
 
-	err = s.addAddressWatcher(quote, req.QuoteHash, depositAddress, signB, p, types.RQStateWaitingForDeposit)
-	if err != nil {
-		log.Error("error adding address watcher: ", err.Error())
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+	if err := validateQuoteRequest(&qr, s.cfg.BtcRefundAddressTypes); err != nil {
+		logger.Error("invalid quote request: ", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the node pays for every byte of call data while estimating, so huge payloads are turned down before any call
+	if size := uint(len(strings.TrimPrefix(qr.CallContractArguments, "0x")) / 2); size > s.maxCallDataSize() {
+		logger.Error("quote request call data too large: ", size, " bytes")
+		http.Error(w, fmt.Sprintf("request entity too large; callContractArguments exceeds %v bytes", s.maxCallDataSize()), http.StatusRequestEntityTooLarge)
 		return
 	}
 
-	signature := hex.EncodeToString(signB)
-	returnQuoteSignFunc(w, signature, depositAddress)
-}
+	lbcAddr := s.rsk.GetLBCAddress()
+	if !s.cfg.AllowReservedCalls && isReservedCallTarget(qr.CallContractAddress, lbcAddr, s.rsk.GetBridgeAddress()) {
+		logger.Error("quote request targets a reserved address: ", qr.CallContractAddress)
+		http.Error(w, "bad request; invalid callContractAddress", http.StatusBadRequest)
+		return
+	}
 
-func parseReqToQuote(qr QuoteRequest, lbcAddr string, fedAddr string) *types.Quote {
-	return &types.Quote{
-		LBCAddr:       lbcAddr,
-		FedBTCAddr:    fedAddr,
+	// call data sent to an account without code is silently ignored, so it's most likely a client mistake
+	if !s.cfg.AllowDataToAccounts && qr.CallContractArguments != "" {
+		isContract, err := s.rsk.IsContract(ctx, qr.CallContractAddress)
+		if err != nil {
+			logger.Error("error checking call contract address: ", err.Error())
+			connectorError(w, err)
+			return
+		}
+		if !isContract {
+			logger.Error("quote request sends call data to an address without code: ", qr.CallContractAddress)
+			http.Error(w, "bad request; callContractArguments given, but callContractAddress has no code", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if s.cfg.RejectContractRefunds {
+		isContract, err := s.rsk.IsContract(ctx, qr.RskRefundAddress)
+		if err != nil {
+			logger.Error("error checking rsk refund address: ", err.Error())
+			connectorError(w, err)
+			return
+		}
+		if isContract {
+			logger.Error("quote request refunds to a contract: ", qr.RskRefundAddress)
+			http.Error(w, "bad request; rskRefundAddress must not be a contract", http.StatusBadRequest)
+			return
+		}
+	}
+
+	stop := timing.measure("rsk")
+	gas, err := s.rsk.EstimateGas(ctx, qr.CallContractAddress, qr.ValueToTransfer.Copy().AsBigInt(), []byte(qr.CallContractArguments))
+	var revertErr *connectors.CallRevertError
+	if s.cfg.ReportCallReverts && errors.As(err, &revertErr) {
+		logger.Warn("declining quote; requested call would revert: ", err.Error())
+		s.metrics.quoteErrors.WithLabelValues(quoteErrorCallReverts).Inc()
+		declineError(w, declineContractWouldRevert, revertMessage(revertErr), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		logger.Error("error estimating gas: ", err.Error())
+		connectorError(w, err)
+		return
+	}
+
+	price, err := s.rsk.GasPrice(ctx)
+	if err != nil {
+		logger.Error("error estimating gas price: ", err.Error())
+		connectorError(w, err)
+		return
+	}
+	s.metrics.gasPrice.Set(float64(price.Uint64()))
+	if s.cfg.MaxAcceptableGasPrice > 0 && price.Cmp(new(big.Int).SetUint64(s.cfg.MaxAcceptableGasPrice)) > 0 {
+		logger.Warnf("declining quote; gas price %v is above the max acceptable gas price %v", price, s.cfg.MaxAcceptableGasPrice)
+		s.metrics.quoteErrors.WithLabelValues(quoteErrorGasTooHigh).Inc()
+		jsonError(w, "quotes unavailable; gas price too high", http.StatusServiceUnavailable)
+		return
+	}
+
+	var quotes []*types.Quote
+	var issuers []providers.LiquidityProvider
+	var hashes []string
+	fedAddress, err := s.rsk.GetFedAddress(ctx)
+	if err != nil {
+		logger.Error("error retrieving federation address: ", err.Error())
+		connectorError(w, err)
+		return
+	}
+
+	minLockTxValueInSatoshi, err := s.rsk.GetMinimumLockTxValue(ctx)
+	if err != nil {
+		logger.Error("error retrieving minimum lock tx value: ", err.Error())
+		connectorError(w, err)
+		return
+	}
+	minLockTxValueInWei := types.SatoshiToWei(minLockTxValueInSatoshi.Uint64())
+	stop()
+
+	getQuoteFailed := false
+	amountBelowMinLockTxValue := false
+	rateLimited := false
+	feeTooHigh := false
+	feeBelowGasCost := false
+	gasCost := new(big.Int).Mul(new(big.Int).SetUint64(gas), price)
+	q := parseReqToQuote(qr, lbcAddr, fedAddress)
+	for _, p := range s.Providers() {
+		if !s.quoteLimiter.allow(p.Address()) {
+			logger.Warn("provider rate limited; skipping quote: ", p.Address())
+			s.metrics.quoteErrors.WithLabelValues(quoteErrorRateLimited).Inc()
+			rateLimited = true
+			continue
+		}
+		pq, err := p.GetQuote(q, gas, types.NewBigWei(price))
+		if err != nil {
+			logger.Errorf("provider %v declined quote: %v", p.Address(), err)
+			s.metrics.quoteErrors.WithLabelValues(quoteErrorProviderDeclined).Inc()
+			getQuoteFailed = true
+			continue
+		}
+		if pq == nil {
+			// providers answer nil without an error when they can't cover the requested value
+			logger.Warnf("provider %v returned no quote; not enough liquidity for value %v", p.Address(), q.Value)
+			s.metrics.quoteErrors.WithLabelValues(quoteErrorNoLiquidity).Inc()
+			continue
+		}
+		if s.cfg.RequireGasCoverage && pq.CallFee.AsBigInt().Cmp(gasCost) < 0 {
+			logger.Warnf("declining quote; provider %v call fee %v doesn't cover the gas cost %v (%v gas at %v wei)", p.Address(), pq.CallFee, gasCost, gas, price)
+			s.metrics.quoteErrors.WithLabelValues(quoteErrorFeeBelowGasCost).Inc()
+			feeBelowGasCost = true
+			continue
+		}
+		if new(types.Wei).Add(pq.Value, pq.CallFee).Cmp(minLockTxValueInWei) < 0 {
+			logger.Error("error getting quote; requested amount below bridge's min pegin tx value: ", qr.ValueToTransfer)
+			amountBelowMinLockTxValue = true
+			continue
+		}
+		exceeded, ratio := s.callFeeExceeded(pq)
+		if exceeded {
+			logger.Warnf("declining quote; provider %v call fee %v is too high for value %v (fee to value ratio: %v)", p.Address(), pq.CallFee, pq.Value, ratio)
+			s.metrics.quoteErrors.WithLabelValues(quoteErrorFeeTooHigh).Inc()
+			feeTooHigh = true
+			continue
+		}
+		logger.Debugf("provider %v quoted call fee %v for value %v (fee to value ratio: %v)", p.Address(), pq.CallFee, pq.Value, ratio)
+		hash, err := s.storeQuote(ctx, pq, timing)
+
+		if err != nil {
+			logger.Error("error storing quote: ", err)
+			s.metrics.quoteErrors.WithLabelValues(quoteErrorStoreFailed).Inc()
+		}
+		// a quote that wasn't stored can't be accepted, so unless partial responses are allowed it's better to
+		// fail the whole request than to silently return fewer quotes
+		if errors.Is(err, ErrQuoteHashCollision) || (err != nil && s.cfg.PartialQuotes) {
+			getQuoteFailed = true
+			continue
+		} else if err != nil {
+			connectorError(w, err)
+			return
+		} else {
+			quotes = append(quotes, pq)
+			issuers = append(issuers, p)
+			hashes = append(hashes, hash)
+		}
+	}
+
+	if len(quotes) == 0 {
+		if amountBelowMinLockTxValue {
+			http.Error(w, "bad request; requested amount below bridge's min pegin tx value", http.StatusBadRequest)
+			return
+		}
+		if feeTooHigh {
+			http.Error(w, "bad request; call fee too high for the requested value", http.StatusBadRequest)
+			return
+		}
+		if rateLimited {
+			jsonError(w, "quotes unavailable; rate limited", http.StatusServiceUnavailable)
+			return
+		}
+		if feeBelowGasCost {
+			jsonError(w, "quotes unavailable; call fee doesn't cover the gas cost", http.StatusServiceUnavailable)
+			return
+		}
+		if getQuoteFailed {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		declineError(w, declineNoQuotesAvailable, "no quotes available; no provider has liquidity for the requested value", http.StatusNotFound)
+		return
+	}
+
+	s.metrics.quotes.Add(float64(len(quotes)))
+
+	res := s.newQuoteResponses(quotes)
+	if s.cfg.QuoteExpiration {
+		stop = timing.measure("rsk")
+		err = s.addQuoteExpiration(ctx, res)
+		stop()
+		if err != nil {
+			logger.Error("error computing quote expiration: ", err.Error())
+			connectorError(w, err)
+			return
+		}
+	}
+
+	timing.writeHeader(w)
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if byProvider {
+		err = enc.Encode(attributeQuotes(res, issuers, hashes))
+	} else {
+		err = enc.Encode(&res)
+	}
+	if err != nil {
+		logger.Error("error encoding quote list: ", err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) acceptQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	defer prometheus.NewTimer(s.metrics.handlerTime.WithLabelValues("acceptQuote")).ObserveDuration()
+	type acceptRes struct {
+		Signature                 string `json:"signature,omitempty"`
+		BitcoinDepositAddressHash string `json:"bitcoinDepositAddressHash"`
+		DerivationValueHash       string `json:"derivationValueHash,omitempty"`
+	}
+	timing := s.newServerTiming()
+	var req acceptReq
+	var dryRun bool
+	idempotencyKey := r.Header.Get(idempotencyKeyHeader)
+	returnQuoteSignFunc := func(w http.ResponseWriter, signature string, depositAddr string, derivationValueHash string) {
+		timing.writeHeader(w)
+		response := acceptRes{
+			Signature:                 signature,
+			BitcoinDepositAddressHash: depositAddr,
+			DerivationValueHash:       derivationValueHash,
+		}
+
+		var buf bytes.Buffer
+		err := json.NewEncoder(&buf).Encode(response)
+		if err != nil {
+			logger.Error("error encoding response: ", err.Error())
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if idempotencyKey != "" && !dryRun {
+			s.storeIdempotentResponse(idempotencyKey, req.QuoteHash, buf.String())
+		}
+		_, _ = w.Write(buf.Bytes())
+	}
+
+	ctx := r.Context()
+	if s.cfg.AcceptQuoteTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(s.cfg.AcceptQuoteTimeout)*time.Second)
+		defer cancel()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := s.decodeRequest(r, "acceptQuote", &req)
+	if err != nil {
+		logger.Error("error decoding request: ", err.Error())
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	req.QuoteHash, err = normalizeQuoteHash(req.QuoteHash)
+	if err != nil {
+		logger.Error("error decoding quote hash: ", err.Error())
+		jsonError(w, "quoteHash must be 64 hex characters", http.StatusBadRequest)
+		return
+	}
+	hashBytes, _ := hex.DecodeString(req.QuoteHash)
+
+	includeDerivationValueHash := false
+	if v := r.URL.Query().Get("includeDerivationValueHash"); v != "" {
+		includeDerivationValueHash, err = strconv.ParseBool(v)
+		if err != nil {
+			logger.Error("error parsing includeDerivationValueHash: ", err.Error())
+			http.Error(w, "bad request; includeDerivationValueHash must be a boolean", http.StatusBadRequest)
+			return
+		}
+	}
+	// dry runs derive the deposit address like a real accept would, but neither sign nor retain the quote, so that
+	// integrators can check their derivation without consuming quotes
+	if v := r.URL.Query().Get("dryRun"); v != "" {
+		dryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			logger.Error("error parsing dryRun: ", err.Error())
+			http.Error(w, "bad request; dryRun must be a boolean", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if idempotencyKey != "" && !dryRun {
+		if !validIdempotencyKey.MatchString(idempotencyKey) {
+			jsonError(w, "Idempotency-Key must be 1 to 128 letters, digits, dots, dashes or underscores", http.StatusBadRequest)
+			return
+		}
+		cached, err := s.db.GetIdempotentResponse(idempotencyKey)
+		if err != nil {
+			logger.Error("error retrieving idempotent response: ", err.Error())
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if cached != nil && cached.QuoteHash != req.QuoteHash {
+			logger.Error("idempotency key reused for another quote; key: ", idempotencyKey, "; hash: ", req.QuoteHash, "; stored hash: ", cached.QuoteHash)
+			jsonError(w, "Idempotency-Key was already used to accept another quote", http.StatusConflict)
+			return
+		} else if cached != nil {
+			logger.Info("repeated idempotency key; returning the stored response. hash: ", req.QuoteHash)
+			_, _ = w.Write([]byte(cached.Response))
+			return
+		}
+	}
+
+	stop := timing.measure("db")
+	stored, err := s.db.GetQuote(req.QuoteHash)
+	if err != nil {
+		logger.Error("error retrieving quote from db: ", err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	stop()
+	if stored == nil {
+		logger.Error("quote not found for hash: ", req.QuoteHash)
+		http.Error(w, "quote not found", http.StatusNotFound)
+		return
+	}
+	quote := stored.Quote
+
+	// quotes are issued by instances sharing the db, so a quote from the future means one of their clocks is off, or the
+	// record was tampered with; either way its deadline can't be trusted
+	if s.cfg.FutureQuoteTolerance > 0 && time.Unix(int64(quote.AgreementTimestamp), 0).After(s.now().Add(time.Duration(s.cfg.FutureQuoteTolerance)*time.Second)) {
+		logger.Errorf("quote agreement timestamp %v is ahead of the clock %v; hash: %v", quote.AgreementTimestamp, s.now().Unix(), req.QuoteHash)
+		http.Error(w, "quote agreement timestamp is in the future; the clocks of the server instances may be out of sync", http.StatusConflict)
+		return
+	}
+	expTime := getQuoteExpTime(quote)
+	if s.now().Add(s.depositWindowOffset()).After(expTime.Add(time.Duration(s.cfg.ClockSkewTolerance) * time.Second)) {
+		logger.Error("quote deposit time has elapsed; hash: ", req.QuoteHash)
+		http.Error(w, "quote expired; its deposit time has elapsed, please request a new quote", http.StatusConflict)
+		return
+	}
+
+	btcRefAddr, lpBTCAddr, lbcAddr, err := decodeAddresses(quote.BTCRefundAddr, quote.LPBTCAddr, quote.LBCAddr)
+	if err != nil {
+		logger.Error("error decoding addresses: ", err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	// the deposit address commits to the LBC, so a quote for a contract other than the one the server calls would
+	// lock the user's funds where the LP can't claim them
+	if common.HexToAddress(quote.LBCAddr) != common.HexToAddress(s.rsk.GetLBCAddress()) {
+		logger.Error("quote was issued for another LBC; hash: ", req.QuoteHash, "; quote LBC: ", quote.LBCAddr, "; configured LBC: ", s.rsk.GetLBCAddress())
+		http.Error(w, "quote was issued for another LBC", http.StatusConflict)
+		return
+	}
+
+	derivationValueHash := ""
+	if includeDerivationValueHash {
+		dvh, err := connectors.GetDerivationValueHash(btcRefAddr, lbcAddr, lpBTCAddr, hashBytes)
+		if err != nil {
+			logger.Error("error computing derivation value hash: ", err.Error())
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		derivationValueHash = hex.EncodeToString(dvh)
+	}
+
+	if stored.Accepted && !dryRun { // if the quote has already been accepted, just return signature and deposit addr
+		returnQuoteSignFunc(w, stored.Signature, stored.DepositAddress, derivationValueHash)
+		return
+	}
+
+	// watchers added on startup for quotes accepted before aren't limited, only new accepts are turned down
+	if !dryRun {
+		if !s.reserveWatcher() {
+			logger.Error("too many deposits being watched to accept quote: ", req.QuoteHash, "; max watchers: ", s.cfg.MaxWatchers)
+			http.Error(w, "service unavailable; too many deposits being watched", http.StatusServiceUnavailable)
+			return
+		}
+		defer s.releaseWatcher()
+	}
+
+	if acceptDeadlineExceeded(w, ctx.Err(), req.QuoteHash) {
+		return
+	}
+
+	stop = timing.measure("rsk")
+	var fedInfo *connectors.FedInfo
+	ctxErr := withinDeadline(ctx, func() {
+		fedInfo, err = s.rsk.FetchFederationInfo(ctx)
+	})
+	if acceptDeadlineExceeded(w, ctxErr, req.QuoteHash) {
+		return
+	}
+	if errors.Is(err, connectors.ErrFederationUnavailable) {
+		logger.Error("error fetching fed info: ", err.Error())
+		http.Error(w, "federation unavailable", http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		logger.Error("error fetching fed info: ", err.Error())
+		connectorError(w, err)
+		return
+	}
+	stop()
+	// the deposit address is derived from the current federation, which must be the one the quote was issued for
+	if fedInfo.FedAddress != quote.FedBTCAddr && s.cfg.RegtestMode {
+		logger.Warn("regtest mode: ignoring federation change since quote was issued; hash: ", req.QuoteHash)
+	} else if fedInfo.FedAddress != quote.FedBTCAddr {
+		logger.Error("federation changed since quote was issued; hash: ", req.QuoteHash, "; quote federation: ", quote.FedBTCAddr, "; current federation: ", fedInfo.FedAddress)
+		http.Error(w, "federation changed since quote was issued", http.StatusConflict)
+		return
+	}
+
+	stop = timing.measure("btc")
+	var depositAddress string
+	ctxErr = withinDeadline(ctx, func() {
+		depositAddress, err = s.btc.GetDerivedBitcoinAddress(fedInfo, btcRefAddr, lbcAddr, lpBTCAddr, hashBytes)
+	})
+	if acceptDeadlineExceeded(w, ctxErr, req.QuoteHash) {
+		return
+	}
+	if err != nil {
+		s.logDerivationFailure(req.QuoteHash, fedInfo, btcRefAddr, lbcAddr, lpBTCAddr, hashBytes, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	stop()
+	if dryRun {
+		logger.Debug("dry run; returning the deposit address without signing. hash: ", req.QuoteHash)
+		returnQuoteSignFunc(w, "", depositAddress, derivationValueHash)
+		return
+	}
+
+	// quotes issued under a key the provider rotated away from can't be signed anymore
+	p := s.getProvider(quote.LPRSKAddr)
+	if p == nil {
+		logger.Error("provider of the quote is no longer registered; hash: ", req.QuoteHash, "; provider: ", quote.LPRSKAddr)
+		http.Error(w, "provider key rotated, please request a new quote", http.StatusGone)
+		return
+	}
+	stop = timing.measure("rsk")
+	var gasPrice *big.Int
+	ctxErr = withinDeadline(ctx, func() {
+		gasPrice, err = s.rsk.GasPrice(ctx)
+	})
+	if acceptDeadlineExceeded(w, ctxErr, req.QuoteHash) {
+		return
+	}
+	if err != nil {
+		logger.Error("error retrieving gas price: ", err.Error())
+		connectorError(w, err)
+		return
+	}
+	// recorded with the quote, so that the depth of the transactions made for it can be told later on
+	var acceptedHeight uint64
+	ctxErr = withinDeadline(ctx, func() {
+		acceptedHeight, err = s.rsk.GetBlockNumber(ctx)
+	})
+	if acceptDeadlineExceeded(w, ctxErr, req.QuoteHash) {
+		return
+	}
+	if err != nil {
+		logger.Error("error getting block number: ", err.Error())
+		connectorError(w, err)
+		return
+	}
+	stop()
+
+	adjustedGasLimit := types.NewUWei(uint64(CFUExtraGas) + uint64(quote.GasLimit))
+	gasCost := new(types.Wei).Mul(adjustedGasLimit, types.NewBigWei(gasPrice))
+	reqLiq := new(types.Wei).Add(gasCost, quote.Value)
+
+	// the liquidity check and the signature (which retains the quote, reserving its liquidity) must happen atomically,
+	// otherwise concurrent accepts could commit the same liquidity more than once
+	s.reserveLiqMu.Lock()
+	// a concurrent accept of the same quote may have signed it since it was read above, in which case its result is
+	// returned rather than signing the quote, and reserving its liquidity, twice
+	retained, err := s.db.GetRetainedQuote(req.QuoteHash)
+	if err != nil {
+		s.reserveLiqMu.Unlock()
+		logger.Error("error retrieving retained quote: ", err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if retained != nil {
+		s.reserveLiqMu.Unlock()
+		logger.Info("quote was accepted concurrently; returning its signature. hash: ", req.QuoteHash)
+		returnQuoteSignFunc(w, retained.Signature, retained.DepositAddr, derivationValueHash)
+		return
+	}
+	hasLiq, err := s.hasUncommittedLiquidity(ctx, p, reqLiq)
+	if err != nil {
+		s.reserveLiqMu.Unlock()
+		logger.Error("error checking provider liquidity: ", err.Error())
+		connectorError(w, err)
+		return
+	}
+	if !hasLiq {
+		s.reserveLiqMu.Unlock()
+		logger.Error("insufficient liquidity to accept quote: ", req.QuoteHash, "; provider: ", p.Address(), "; required: ", reqLiq)
+		http.Error(w, "insufficient liquidity", http.StatusConflict)
+		return
+	}
+	signB, err := s.signQuote(p, hashBytes, depositAddress, reqLiq)
+	s.reserveLiqMu.Unlock()
+	if errors.Is(err, ErrSigningUnavailable) {
+		logger.Error("error signing quote: ", err.Error())
+		http.Error(w, "service unavailable; signer unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		logger.Error("error signing quote: ", err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// the quote is already retained, so failing to record the height isn't worth failing the accept
+	err = s.db.SetAcceptedHeight(req.QuoteHash, acceptedHeight)
+	if err != nil {
+		logger.Errorf("error recording accepted height; hash: %v; height: %v; error: %v", req.QuoteHash, acceptedHeight, err)
+	}
+
+	err = s.addAddressWatcher(quote, req.QuoteHash, depositAddress, signB, p, types.RQStateWaitingForDeposit)
+	if err != nil {
+		logger.Error("error adding address watcher: ", err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.webhook.notify(req.QuoteHash, types.RQStateWaitingForDeposit)
+	s.metrics.acceptedQuotes.Inc()
+
+	signature := hex.EncodeToString(signB)
+	returnQuoteSignFunc(w, signature, depositAddress, derivationValueHash)
+}
+
+// logDerivationFailure logs everything the deposit address derivation depends on, keyed by the quote hash, so that a
+// failed derivation can be reproduced from the logs. The inputs are public, but they are still kept out of the response.
+func (s *Server) logDerivationFailure(hash string, fedInfo *connectors.FedInfo, btcRefAddr []byte, lbcAddr []byte, lpBTCAddr []byte, hashBytes []byte, err error) {
+	fields := log.Fields{
+		"quoteHash":            hash,
+		"btcRefundAddr":        hex.EncodeToString(btcRefAddr),
+		"lbcAddr":              hex.EncodeToString(lbcAddr),
+		"lpBtcAddr":            hex.EncodeToString(lpBTCAddr),
+		"network":              s.btc.GetParams().Name,
+		"fedAddress":           fedInfo.FedAddress,
+		"fedSize":              fedInfo.FedSize,
+		"fedThreshold":         fedInfo.FedThreshold,
+		"fedPubKeys":           fedInfo.PubKeys,
+		"activeFedBlockHeight": fedInfo.ActiveFedBlockHeight,
+		"irisActivationHeight": fedInfo.IrisActivationHeight,
+		"erpKeys":              fedInfo.ErpKeys,
+	}
+	dvh, dvhErr := connectors.GetDerivationValueHash(btcRefAddr, lbcAddr, lpBTCAddr, hashBytes)
+	if dvhErr == nil {
+		fields["derivationValueHash"] = hex.EncodeToString(dvh)
+	}
+	log.WithFields(fields).Error("error getting derived bitcoin address: ", err.Error())
+}
+
+// withinDeadline runs f, giving up on waiting for it once ctx is done. Not every connector takes a context, so f may
+// keep running in the background, but the caller must discard its results.
+func withinDeadline(ctx context.Context, f func()) error {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// acceptDeadlineExceeded responds with a 504 when the accept flow ran out of time
+func acceptDeadlineExceeded(w http.ResponseWriter, ctxErr error, hash string) bool {
+	if ctxErr == nil {
+		return false
+	}
+	log.Error("accept quote deadline exceeded; hash: ", hash, "; error: ", ctxErr.Error())
+	http.Error(w, "gateway timeout; accept quote deadline exceeded", http.StatusGatewayTimeout)
+	return true
+}
+
+// validateQuoteRequest checks the fields of a quote request that would otherwise fail deep inside the connectors. The
+// error message names the offending field, so it can be returned to the client as is.
+func validateQuoteRequest(qr *QuoteRequest, btcRefundAddressTypes []string) error {
+	if !common.IsHexAddress(qr.CallContractAddress) {
+		return errors.New("bad request; invalid callContractAddress")
+	}
+	if _, err := hex.DecodeString(strings.TrimPrefix(qr.CallContractArguments, "0x")); err != nil {
+		return errors.New("bad request; callContractArguments must be hex encoded")
+	}
+	if !common.IsHexAddress(qr.RskRefundAddress) {
+		return errors.New("bad request; invalid rskRefundAddress")
+	}
+	// the refund goes to whatever script the address decodes to, so anything the LBC can't encode is rejected upfront
+	_, addrType, err := connectors.DecodeBTCAddressWithType(qr.BitcoinRefundAddress)
+	if err != nil {
+		if addrType == connectors.BtcAddressTypeBech32 {
+			return errors.New("bad request; bech32 bitcoinRefundAddress is not supported")
+		}
+		return errors.New("bad request; invalid bitcoinRefundAddress")
+	}
+	if len(btcRefundAddressTypes) > 0 && !containsFold(btcRefundAddressTypes, addrType) {
+		return fmt.Errorf("bad request; %v bitcoinRefundAddress is not accepted, only %v", addrType, strings.Join(btcRefundAddressTypes, ", "))
+	}
+	return nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func isReservedCallTarget(addr string, reserved ...string) bool {
+	a := common.HexToAddress(addr)
+	if a == (common.Address{}) {
+		return true
+	}
+	for _, r := range reserved {
+		if r != "" && a == common.HexToAddress(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) decodeRequest(r *http.Request, endpoint string, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	if !s.isLenientEndpoint(endpoint) {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
+
+func (s *Server) isLenientEndpoint(endpoint string) bool {
+	for _, e := range s.cfg.LenientEndpoints {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+func parseReqToQuote(qr QuoteRequest, lbcAddr string, fedAddr string) *types.Quote {
+	return &types.Quote{
+		LBCAddr:       lbcAddr,
+		FedBTCAddr:    fedAddr,
 		BTCRefundAddr: qr.BitcoinRefundAddress,
 		RSKRefundAddr: qr.RskRefundAddress,
 		ContractAddr:  qr.CallContractAddress,
@@ -516,28 +1639,281 @@ func decodeAddresses(btcRefundAddr string, lpBTCAddr string, lbcAddr string) ([]
 	return btcRefAddrB, lpBTCAddrB, lbcAddrB, nil
 }
 
-func getProviderByAddress(liquidityProviders []providers.LiquidityProvider, addr string) (ret providers.LiquidityProvider) {
+// indexProviders maps the providers by their lowercased RSK address, so lookups don't depend on the address casing
+func indexProviders(liquidityProviders []providers.LiquidityProvider) map[string]providers.LiquidityProvider {
+	byAddr := make(map[string]providers.LiquidityProvider, len(liquidityProviders))
 	for _, p := range liquidityProviders {
-		if p.Address() == addr {
-			return p
+		byAddr[strings.ToLower(p.Address())] = p
+	}
+	return byAddr
+}
+
+func getProviderByAddress(byAddr map[string]providers.LiquidityProvider, addr string) providers.LiquidityProvider {
+	return byAddr[strings.ToLower(addr)]
+}
+
+func (s *Server) getProvider(addr string) providers.LiquidityProvider {
+	s.providersMu.RLock()
+	defer s.providersMu.RUnlock()
+	return getProviderByAddress(s.providersByAddr, addr)
+}
+
+// Providers returns a snapshot of the registered providers, safe to iterate while providers are being added
+func (s *Server) Providers() []providers.LiquidityProvider {
+	s.providersMu.RLock()
+	defer s.providersMu.RUnlock()
+	return append([]providers.LiquidityProvider(nil), s.providers...)
+}
+
+// RemoveProvider stops the provider with the given address from quoting, returning whether it was registered. Deposits
+// already being watched for its quotes are still processed, while its quotes that weren't accepted can no longer be.
+func (s *Server) RemoveProvider(addr string) bool {
+	s.providersMu.Lock()
+	defer s.providersMu.Unlock()
+	for i, p := range s.providers {
+		if strings.EqualFold(p.Address(), addr) {
+			s.providers = append(s.providers[:i:i], s.providers[i+1:]...)
+			s.providersByAddr = indexProviders(s.providers)
+			return true
 		}
 	}
-	return nil
+	return false
 }
 
-func (s *Server) storeQuote(q *types.Quote) error {
-	h, err := s.rsk.HashQuote(q)
-	if err != nil {
+// callFeeExceeded checks the call fee of a quote against the configured caps, so that users aren't handed quotes whose
+// fee dwarfs the value transferred. It also returns the fee to value ratio, which is infinite for a fee on no value.
+func (s *Server) callFeeExceeded(q *types.Quote) (bool, float64) {
+	fee := q.CallFee.AsBigInt()
+	ratio := 0.0
+	if fee.Sign() > 0 && q.Value.AsBigInt().Sign() <= 0 {
+		ratio = math.Inf(1)
+	} else if fee.Sign() > 0 {
+		ratio, _ = new(big.Float).Quo(new(big.Float).SetInt(fee), new(big.Float).SetInt(q.Value.AsBigInt())).Float64()
+	}
+	if s.cfg.MaxCallFee > 0 && fee.Cmp(new(big.Int).SetUint64(s.cfg.MaxCallFee)) > 0 {
+		return true, ratio
+	}
+	return s.cfg.MaxCallFeeRatio > 0 && ratio > s.cfg.MaxCallFeeRatio, ratio
+}
+
+// hasUncommittedLiquidity checks that the provider's available liquidity, minus the liquidity already reserved
+// by quotes accepted and not yet completed or expired, covers the given amount.
+func (s *Server) signQuote(p providers.LiquidityProvider, hash []byte, depositAddr string, reqLiq *types.Wei) ([]byte, error) {
+	if s.cfg.SignRetries == 0 {
+		return p.SignQuote(hash, depositAddr, reqLiq)
+	}
+	var signB []byte
+	err := retryWithBackoff(s.cfg.SignRetries, signRetryBackoff, s.sleep, func() error {
+		var err error
+		signB, err = p.SignQuote(hash, depositAddr, reqLiq)
+		if err != nil {
+			log.Debug("error signing quote, retrying: ", err.Error())
+		}
 		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSigningUnavailable, err)
 	}
+	return signB, nil
+}
 
+func (s *Server) hasUncommittedLiquidity(ctx context.Context, p providers.LiquidityProvider, amount *types.Wei) (bool, error) {
+	availableLiq, err := s.rsk.GetAvailableLiquidity(ctx, p.Address())
+	if err != nil {
+		return false, err
+	}
+	lockedLiq, err := s.db.GetLockedLiquidity(p.Address())
+	if err != nil {
+		return false, err
+	}
+	uncommittedLiq := new(types.Wei).Sub(types.NewBigWei(availableLiq), lockedLiq)
+	return uncommittedLiq.Cmp(amount) >= 0, nil
+}
+
+// storeQuote stores the quote under its hash, which is returned
+func (s *Server) storeQuote(ctx context.Context, q *types.Quote, timing *serverTiming) (string, error) {
+	stop := timing.measure("rsk")
+	h, err := s.rsk.HashQuote(ctx, q)
+	if err != nil {
+		return "", err
+	}
+
+	if s.cfg.VerifyQuoteHash {
+		err = s.verifyQuoteHash(q, h)
+		if err != nil {
+			return "", err
+		}
+	}
+	stop()
+
+	stop = timing.measure("db")
+	defer stop()
+	existing, err := s.db.GetQuote(h)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		// the hash covers every field of the quote, so an existing entry for the same provider is the very same quote;
+		// one for another provider must never be overwritten, or the signature would be attributed to the wrong LP
+		if !strings.EqualFold(existing.Quote.LPRSKAddr, q.LPRSKAddr) {
+			log.Errorf("quote hash collision; hash: %v; stored LP: %v; new LP: %v", h, existing.Quote.LPRSKAddr, q.LPRSKAddr)
+			return "", fmt.Errorf("%w: %v", ErrQuoteHashCollision, h)
+		}
+		return h, nil
+	}
 	err = s.db.InsertQuote(h, q)
 	if err != nil {
-		log.Fatalf("error inserting quote: %v", err)
+		return "", fmt.Errorf("error inserting quote: %v", err)
+	}
+	return h, nil
+}
+
+func (s *Server) verifyQuoteHash(q *types.Quote, onChainHash string) error {
+	pq, err := s.rsk.ParseQuote(q)
+	if err != nil {
+		return err
+	}
+	localHash, err := connectors.HashQuoteLocally(pq)
+	if err != nil {
+		return err
+	}
+	if localHash != onChainHash {
+		cq, err := connectors.CanonicalJSON(q)
+		if err != nil {
+			return err
+		}
+		log.Errorf("quote hash mismatch; on-chain hash: %v; local hash: %v; quote: %s", onChainHash, localHash, cq)
+		return fmt.Errorf("quote hash mismatch; on-chain hash: %v; local hash: %v", onChainHash, localHash)
+	}
+	return nil
+}
+
+// providersHandler lists the registered providers, along with the values they accept and the fees they charge when
+// they expose them, so that clients know upfront which values can be quoted
+func (s *Server) providersHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	type providerRes struct {
+		Address             string   `json:"address"`
+		Name                string   `json:"name,omitempty"`
+		MinTransactionValue *big.Int `json:"minTransactionValue,omitempty"`
+		MaxTransactionValue *big.Int `json:"maxTransactionValue,omitempty"`
+		CallFee             *big.Int `json:"callFee,omitempty"`
+		PenaltyFee          *big.Int `json:"penaltyFee,omitempty"`
+	}
+
+	lps := s.Providers()
+	res := make([]providerRes, 0, len(lps))
+	for _, p := range lps {
+		pr := providerRes{Address: p.Address()}
+		if np, ok := p.(namedProvider); ok {
+			pr.Name = np.Name()
+		}
+		if lp, ok := p.(limitedProvider); ok {
+			pr.MinTransactionValue = weiToBigInt(lp.MinTransactionValue())
+			pr.MaxTransactionValue = weiToBigInt(lp.MaxTransactionValue())
+		}
+		if pp, ok := p.(pricedProvider); ok {
+			pr.CallFee = weiToBigInt(pp.CallFee())
+			pr.PenaltyFee = weiToBigInt(pp.PenaltyFee())
+		}
+		res = append(res, pr)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	err := enc.Encode(&res)
+	if err != nil {
+		logger.Error("error encoding providers: ", err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
+
+// weiToBigInt converts an amount a provider exposes, leaving it nil when the provider doesn't set it
+func weiToBigInt(w *types.Wei) *big.Int {
+	if w == nil {
+		return nil
+	}
+	return w.AsBigInt()
+}
+
+// attributeQuotes wraps each quote response with the provider that issued it and the quote hash to accept it with
+func attributeQuotes(res []quoteRes, issuers []providers.LiquidityProvider, hashes []string) []providerQuoteRes {
+	if res == nil {
+		return nil
+	}
+	attributed := make([]providerQuoteRes, 0, len(res))
+	for i := range res {
+		pr := providerQuoteRes{
+			ProviderID: issuers[i].Address(),
+			QuoteHash:  hashes[i],
+			Quote:      res[i],
+		}
+		if np, ok := issuers[i].(namedProvider); ok {
+			pr.ProviderName = np.Name()
+		}
+		attributed = append(attributed, pr)
+	}
+	return attributed
+}
+
+// newQuoteResponses pairs each quote with the confirmations the bridge requires before the peg-in can be registered,
+// on top of the confirmations the LP requires before making the call
+func (s *Server) newQuoteResponses(quotes []*types.Quote) []quoteRes {
+	if quotes == nil {
+		return nil
+	}
+	bridgeConfirmations := s.rsk.GetRequiredBridgeConfirmations()
+	res := make([]quoteRes, 0, len(quotes))
+	for _, q := range quotes {
+		res = append(res, quoteRes{
+			Quote:                       q,
+			RequiredBridgeConfirmations: bridgeConfirmations,
+		})
+	}
+	return res
+}
+
+func (s *Server) addQuoteExpiration(ctx context.Context, res []quoteRes) error {
+	blockTime, err := s.rsk.GetLatestBlockTime(ctx)
+	if err != nil {
+		return err
+	}
+	// an accept made now opens the deposit window after the offset, which the deadline of the quote doesn't move
+	windowStart := blockTime.Add(s.depositWindowOffset())
+	for i := range res {
+		expTime := getQuoteExpTime(res[i].Quote)
+		res[i].quoteExpiration = &quoteExpiration{
+			AcceptExpiresInSeconds:  secondsUntil(windowStart, expTime.Add(time.Duration(s.cfg.ClockSkewTolerance)*time.Second)),
+			DepositExpiresInSeconds: secondsUntil(windowStart, expTime),
+		}
 	}
 	return nil
 }
 
+func secondsUntil(from time.Time, to time.Time) int64 {
+	secs := int64(to.Sub(from).Seconds())
+	if secs < 0 {
+		return 0
+	}
+	return secs
+}
+
+// normalizeQuoteHash checks the hash is 32 bytes of hex, optionally 0x-prefixed, and returns it in the lowercase,
+// unprefixed form quotes are stored with
+func normalizeQuoteHash(hash string) (string, error) {
+	if strings.HasPrefix(hash, "0x") || strings.HasPrefix(hash, "0X") {
+		hash = hash[2:]
+	}
+	b, err := hex.DecodeString(hash)
+	if err != nil {
+		return "", err
+	}
+	if len(b) != 32 {
+		return "", fmt.Errorf("invalid quote hash length: %v bytes", len(b))
+	}
+	return strings.ToLower(hash), nil
+}
+
 func getQuoteExpTime(q *types.Quote) time.Time {
 	return time.Unix(int64(q.AgreementTimestamp+q.TimeForDeposit), 0)
 }
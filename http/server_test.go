@@ -2,13 +2,18 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"math/big"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,9 +22,16 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	gethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rsksmart/liquidity-provider-server/http/testmocks"
+	"github.com/rsksmart/liquidity-provider-server/storage"
 	"github.com/rsksmart/liquidity-provider/providers"
 	"github.com/rsksmart/liquidity-provider/types"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	http2 "github.com/stretchr/testify/http"
 	"github.com/stretchr/testify/mock"
@@ -48,6 +60,74 @@ func (lp LiquidityProviderMock) SignQuote(_ []byte, _ string, _ *types.Wei) ([]b
 	return nil, nil
 }
 
+// feeProviderMock charges a fixed call fee on every quote
+type feeProviderMock struct {
+	LiquidityProviderMock
+	fee int64
+}
+
+func (lp feeProviderMock) GetQuote(quote *types.Quote, gas uint64, price *types.Wei) (*types.Quote, error) {
+	res, err := lp.LiquidityProviderMock.GetQuote(quote, gas, price)
+	if res != nil {
+		res.CallFee = types.NewWei(lp.fee)
+	}
+	return res, err
+}
+
+// drainedProviderMock has no liquidity left, so it never quotes
+type drainedProviderMock struct {
+	LiquidityProviderMock
+}
+
+func (lp drainedProviderMock) GetQuote(_ *types.Quote, _ uint64, _ *types.Wei) (*types.Quote, error) {
+	return nil, nil
+}
+
+type namedProviderMock struct {
+	LiquidityProviderMock
+	name string
+}
+
+func (lp namedProviderMock) Name() string {
+	return lp.name
+}
+
+// limitedProviderMock only quotes values within a range, and publishes its fees
+type limitedProviderMock struct {
+	LiquidityProviderMock
+	min, max int64
+}
+
+func (lp limitedProviderMock) MinTransactionValue() *types.Wei {
+	return types.NewWei(lp.min)
+}
+
+func (lp limitedProviderMock) MaxTransactionValue() *types.Wei {
+	return types.NewWei(lp.max)
+}
+
+func (lp limitedProviderMock) CallFee() *types.Wei {
+	return types.NewWei(1000)
+}
+
+func (lp limitedProviderMock) PenaltyFee() *types.Wei {
+	return nil
+}
+
+type flakySignerMock struct {
+	LiquidityProviderMock
+	failures int
+	calls    int
+}
+
+func (lp *flakySignerMock) SignQuote(_ []byte, _ string, _ *types.Wei) ([]byte, error) {
+	lp.calls++
+	if lp.calls <= lp.failures {
+		return nil, errors.New("signer timeout")
+	}
+	return []byte{1}, nil
+}
+
 var providerMocks = []LiquidityProviderMock{
 	{address: "123"},
 	{address: "0x00d80aA033fb51F191563B08Dc035fA128e942C5"},
@@ -81,8 +161,11 @@ func testGetProviderByAddress(t *testing.T) {
 		liquidityProviders = append(liquidityProviders, providerMock)
 	}
 
+	byAddr := indexProviders(liquidityProviders)
 	for _, tt := range liquidityProviders {
-		result := getProviderByAddress(liquidityProviders, tt.Address())
+		result := getProviderByAddress(byAddr, tt.Address())
+		assert.EqualValues(t, tt.Address(), result.Address())
+		result = getProviderByAddress(byAddr, strings.ToUpper(tt.Address()))
 		assert.EqualValues(t, tt.Address(), result.Address())
 	}
 }
@@ -94,7 +177,7 @@ func testGetProviderByAddressWhenNotFoundShouldReturnNull(t *testing.T) {
 	}
 
 	var nonLiquidityProviderAddress = "0xa554d96413FF72E93437C4072438302C38350EE3"
-	result := getProviderByAddress(liquidityProviders, nonLiquidityProviderAddress)
+	result := getProviderByAddress(indexProviders(liquidityProviders), nonLiquidityProviderAddress)
 	assert.Empty(t, result)
 }
 
@@ -102,7 +185,7 @@ func testCheckHealth(t *testing.T) {
 	rsk := new(testmocks.RskMock)
 	btc := new(testmocks.BtcMock)
 	db := testmocks.NewDbMock("", testQuotes[0])
-	srv := New(rsk, btc, db)
+	srv := New(rsk, btc, db, Config{}, prometheus.NewRegistry())
 
 	w := http2.TestResponseWriter{}
 	req, err := http.NewRequest("GET", "health", bytes.NewReader([]byte{}))
@@ -110,7 +193,7 @@ func testCheckHealth(t *testing.T) {
 		t.Fatalf("couldn't instantiate request. error: %v", err)
 	}
 	db.On("CheckConnection").Return(nil).Times(1)
-	rsk.On("CheckConnection").Return(nil).Times(1)
+	rsk.On("HealthCheck").Return(true, nil).Times(1)
 	btc.On("CheckConnection").Return(nil).Times(1)
 	srv.checkHealthHandler(&w, req)
 	db.AssertExpectations(t)
@@ -126,7 +209,7 @@ func testCheckHealth(t *testing.T) {
 		t.Fatalf("couldn't instantiate request. error: %v", err)
 	}
 	db.On("CheckConnection").Return(errors.New("db error")).Times(1)
-	rsk.On("CheckConnection").Return(nil).Times(1)
+	rsk.On("HealthCheck").Return(true, nil).Times(1)
 	btc.On("CheckConnection").Return(nil).Times(1)
 	srv.checkHealthHandler(&w, req)
 	db.AssertExpectations(t)
@@ -142,15 +225,39 @@ func testCheckHealth(t *testing.T) {
 		t.Fatalf("couldn't instantiate request. error: %v", err)
 	}
 	db.On("CheckConnection").Return(errors.New("db error")).Times(1)
-	rsk.On("CheckConnection").Return(errors.New("rsk error")).Times(1)
+	rsk.On("HealthCheck").Return(false, errors.New("rsk error")).Times(1)
 	btc.On("CheckConnection").Return(errors.New("btc error")).Times(1)
 	srv.checkHealthHandler(&w, req)
 	db.AssertExpectations(t)
 	rsk.AssertExpectations(t)
 	btc.AssertExpectations(t)
-	assert.EqualValues(t, 200, w.StatusCode)
+	assert.EqualValues(t, 503, w.StatusCode)
 	assert.EqualValues(t, "application/json", w.Header().Get("Content-Type"))
 	assert.EqualValues(t, "{\"status\":\"degraded\",\"services\":{\"db\":\"unreachable\",\"rsk\":\"unreachable\",\"btc\":\"unreachable\"}}\n", w.Output)
+
+	w = http2.TestResponseWriter{}
+	req, err = http.NewRequest("GET", "health", bytes.NewReader([]byte{}))
+	if err != nil {
+		t.Fatalf("couldn't instantiate request. error: %v", err)
+	}
+	db.On("CheckConnection").Return(nil).Times(1)
+	rsk.On("HealthCheck").Return(false, nil).Times(1)
+	btc.On("CheckConnection").Return(nil).Times(1)
+	srv.checkHealthHandler(&w, req)
+	assert.EqualValues(t, 503, w.StatusCode)
+	assert.EqualValues(t, "{\"status\":\"degraded\",\"services\":{\"db\":\"ok\",\"rsk\":\"syncing\",\"btc\":\"ok\"}}\n", w.Output)
+
+	w = http2.TestResponseWriter{}
+	req, err = http.NewRequest("GET", "health", bytes.NewReader([]byte{}))
+	if err != nil {
+		t.Fatalf("couldn't instantiate request. error: %v", err)
+	}
+	db.On("CheckConnection").Return(nil).Times(1)
+	rsk.On("HealthCheck").Return(true, nil).Times(1)
+	btc.On("CheckConnection").Return(errors.New("btc error")).Times(1)
+	srv.checkHealthHandler(&w, req)
+	assert.EqualValues(t, 503, w.StatusCode)
+	assert.EqualValues(t, "{\"status\":\"degraded\",\"services\":{\"db\":\"ok\",\"rsk\":\"ok\",\"btc\":\"unreachable\"}}\n", w.Output)
 }
 
 func testGetQuoteComplete(t *testing.T) {
@@ -159,7 +266,7 @@ func testGetQuoteComplete(t *testing.T) {
 		btc := new(testmocks.BtcMock)
 		db := testmocks.NewDbMock("", quote)
 
-		srv := New(rsk, btc, db)
+		srv := New(rsk, btc, db, Config{}, prometheus.NewRegistry())
 
 		for _, lp := range providerMocks {
 			rsk.On("GetCollateral", lp.address).Return(nil)
@@ -211,15 +318,24 @@ func testGetQuoteComplete(t *testing.T) {
 		rsk.On("GasPrice").Times(1)
 		rsk.On("GetFedAddress").Times(1)
 		rsk.On("GetLBCAddress").Times(1)
+		rsk.On("GetBridgeAddress").Times(1)
 		rsk.On("GetMinimumLockTxValue").Return(big.NewInt(0), nil).Times(1)
 		rsk.On("HashQuote", &tq).Times(len(providerMocks)).Return("", nil)
+		db.On("GetQuote", "").Times(len(providerMocks)).Return((*types.Quote)(nil))
 		db.On("InsertQuote", "", &tq).Times(len(providerMocks)).Return(quote)
+		rsk.On("GetRequiredBridgeConfirmations").Return(int64(10)).Times(1)
 
 		srv.getQuoteHandler(&w, req)
 		db.AssertExpectations(t)
 		rsk.AssertExpectations(t)
 		btc.AssertExpectations(t)
 		assert.EqualValues(t, "application/json", w.Header().Get("Content-Type"))
+		var res []map[string]interface{}
+		err = json.Unmarshal([]byte(w.Output), &res)
+		assert.Nil(t, err)
+		assert.Len(t, res, len(providerMocks))
+		assert.EqualValues(t, 10, res[0]["requiredBridgeConfirmations"])
+		assert.NotContains(t, res[0], "acceptExpiresInSeconds")
 
 		req, err = http.NewRequest("POST", "getQuote", bytes.NewReader([]byte(body)))
 		if err != nil {
@@ -230,6 +346,7 @@ func testGetQuoteComplete(t *testing.T) {
 		rsk.On("GasPrice").Times(1)
 		rsk.On("GetFedAddress").Times(1)
 		rsk.On("GetLBCAddress").Times(1)
+		rsk.On("GetBridgeAddress").Times(1)
 		rsk.On("GetMinimumLockTxValue").Return(new(big.Int).Add(big.NewInt(-1), new(big.Int).Add(quote.Value.AsBigInt(), quote.CallFee.AsBigInt())), nil).Times(1)
 		rsk.On("HashQuote", &tq).Times(len(providerMocks)).Return("", nil)
 		db.On("InsertQuote", "", &tq).Times(len(providerMocks)).Return(quote)
@@ -238,114 +355,2310 @@ func testGetQuoteComplete(t *testing.T) {
 	}
 }
 
-func testAcceptQuoteComplete(t *testing.T) {
-	for _, quote := range testQuotes {
-		hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+func testGetQuoteByProvider(t *testing.T) {
+	body := "{\"callContractAddress\":\"0x63C46fBf3183B0a230833a7076128bdf3D5Bc03F\",\"callContractArguments\":\"\"," +
+		"\"valueToTransfer\":250,\"gaslimit\":500000,\"RskRefundAddress\":\"0x2428E03389e9db669698E0Ffa16FD66DC8156b3c\"," +
+		"\"bitcoinRefundAddress\":\"myCqdohiF3cvopyoPMB2rGTrJZx9jJ2ihT\"}"
+	rsk := new(testmocks.RskMock)
+	db := testmocks.NewDbMock("", nil)
+	srv := New(rsk, new(testmocks.BtcMock), db, Config{}, prometheus.NewRegistry())
+	lps := []providers.LiquidityProvider{providerMocks[0], namedProviderMock{providerMocks[1], "Acme"}}
+	for _, lp := range lps {
+		rsk.On("GetCollateral", lp.Address()).Return(nil)
+		err := srv.AddProvider(lp)
+		if err != nil {
+			t.Fatalf("couldn't add provider. error: %v", err)
+		}
+	}
+	rsk.On("EstimateGas", mock.Anything, mock.Anything, mock.Anything)
+	rsk.On("GasPrice")
+	rsk.On("GetFedAddress")
+	rsk.On("GetLBCAddress")
+	rsk.On("GetBridgeAddress")
+	rsk.On("GetMinimumLockTxValue").Return(big.NewInt(0), nil)
+	rsk.On("HashQuote", mock.Anything)
+	rsk.On("GetRequiredBridgeConfirmations").Return(int64(10))
+	db.On("GetQuote", "").Return((*types.Quote)(nil))
+	db.On("InsertQuote", "", mock.Anything)
+
+	req, err := http.NewRequest("POST", "getQuote?byProvider=true", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatalf("couldn't instantiate request. error: %v", err)
+	}
+	w := http2.TestResponseWriter{}
+	srv.getQuoteHandler(&w, req)
+	assert.EqualValues(t, http.StatusOK, w.StatusCode)
+	var res []map[string]interface{}
+	err = json.Unmarshal([]byte(w.Output), &res)
+	assert.Nil(t, err)
+	assert.Len(t, res, 2)
+	assert.EqualValues(t, providerMocks[0].address, res[0]["providerId"])
+	assert.NotContains(t, res[0], "providerName")
+	assert.EqualValues(t, providerMocks[1].address, res[1]["providerId"])
+	assert.EqualValues(t, "Acme", res[1]["providerName"])
+	for _, r := range res {
+		assert.Contains(t, r, "quoteHash")
+		quote, ok := r["quote"].(map[string]interface{})
+		assert.True(t, ok)
+		assert.EqualValues(t, 10, quote["requiredBridgeConfirmations"])
+	}
+
+	req, err = http.NewRequest("POST", "getQuote?byProvider=maybe", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatalf("couldn't instantiate request. error: %v", err)
+	}
+	w = http2.TestResponseWriter{}
+	srv.getQuoteHandler(&w, req)
+	assert.EqualValues(t, http.StatusBadRequest, w.StatusCode)
+}
+
+func testGetQuoteInvalidBtcRefundAddress(t *testing.T) {
+	var tests = []struct {
+		addr     string
+		expected string
+	}{
+		{"", "bad request; invalid bitcoinRefundAddress\n"},
+		{"myCqdohiF3cvopyoPMB2rGTrJZx9jJ2ihX", "bad request; invalid bitcoinRefundAddress\n"},
+		{"tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", "bad request; bech32 bitcoinRefundAddress is not supported\n"},
+	}
+	for _, tt := range tests {
+		body := fmt.Sprintf("{\"callContractAddress\":\"0x63C46fBf3183B0a230833a7076128bdf3D5Bc03F\",\"callContractArguments\":\"\","+
+			"\"valueToTransfer\":250,\"gaslimit\":500000,\"RskRefundAddress\":\"0x2428E03389e9db669698E0Ffa16FD66DC8156b3c\","+
+			"\"bitcoinRefundAddress\":\"%v\"}", tt.addr)
 		rsk := new(testmocks.RskMock)
-		btc := new(testmocks.BtcMock)
-		db := testmocks.NewDbMock(hash, quote)
-		sat, _ := new(types.Wei).Add(quote.Value, quote.CallFee).ToSatoshi().Float64()
-		minAmount := btcutil.Amount(uint64(math.Ceil(sat)))
-		expTime := time.Unix(int64(quote.AgreementTimestamp+quote.TimeForDeposit), 0)
-		fedInfo := &connectors.FedInfo{}
+		srv := New(rsk, new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{}, prometheus.NewRegistry())
+		req, err := http.NewRequest("POST", "getQuote", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("couldn't instantiate request. error: %v", err)
+		}
+		w := http2.TestResponseWriter{}
+		srv.getQuoteHandler(&w, req)
+		assert.EqualValues(t, http.StatusBadRequest, w.StatusCode)
+		assert.EqualValues(t, tt.expected, w.Output)
+		rsk.AssertNotCalled(t, "EstimateGas", mock.Anything, mock.Anything, mock.Anything)
+	}
+}
 
-		srv := newServer(rsk, btc, db, func() time.Time {
-			return time.Unix(0, 0)
-		})
-		for _, lp := range providerMocks {
-			rsk.On("GetCollateral", lp.address).Times(1).Return(big.NewInt(10), big.NewInt(10))
-			err := srv.AddProvider(lp)
-			if err != nil {
-				t.Errorf("couldn't add provider. error: %v", err)
-			}
+func testGetQuoteConnectorErrors(t *testing.T) {
+	body := "{\"callContractAddress\":\"0x63C46fBf3183B0a230833a7076128bdf3D5Bc03F\",\"callContractArguments\":\"\"," +
+		"\"valueToTransfer\":250,\"gaslimit\":500000,\"RskRefundAddress\":\"0x2428E03389e9db669698E0Ffa16FD66DC8156b3c\"," +
+		"\"bitcoinRefundAddress\":\"myCqdohiF3cvopyoPMB2rGTrJZx9jJ2ihT\"}"
+	var tests = []struct {
+		err      error
+		status   int
+		expected string
+	}{
+		{fmt.Errorf("error estimating gas: %w", connectors.ErrNodeUnavailable), http.StatusServiceUnavailable,
+			"{\"message\":\"service unavailable; rsk node unreachable\",\"declineReason\":\"NodeUnavailable\"}\n"},
+		{fmt.Errorf("%w: 0x", connectors.ErrInvalidAddress), http.StatusBadRequest, "bad request; invalid address\n"},
+		{fmt.Errorf("error estimating gas: %w", connectors.ErrContractCall), http.StatusInternalServerError, "internal server error\n"},
+	}
+	for _, tt := range tests {
+		rsk := new(testmocks.RskMock)
+		srv := New(rsk, new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{}, prometheus.NewRegistry())
+		rsk.On("GetLBCAddress")
+		rsk.On("GetBridgeAddress")
+		rsk.On("EstimateGas", mock.Anything, mock.Anything, mock.Anything).Return(uint64(0), tt.err)
+		req, err := http.NewRequest("POST", "getQuote", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("couldn't instantiate request. error: %v", err)
 		}
 		w := http2.TestResponseWriter{}
-		body := fmt.Sprintf("{\"quoteHash\":\"%v\"}", hash)
+		srv.getQuoteHandler(&w, req)
+		assert.EqualValues(t, tt.status, w.StatusCode)
+		assert.EqualValues(t, tt.expected, w.Output)
+	}
+}
 
-		btcRefAddr, lpBTCAddr, lbcAddr, err := decodeAddresses(quote.BTCRefundAddr, quote.LPBTCAddr, quote.LBCAddr)
+func testGetQuoteCallReverts(t *testing.T) {
+	body := "{\"callContractAddress\":\"0x63C46fBf3183B0a230833a7076128bdf3D5Bc03F\",\"callContractArguments\":\"\"," +
+		"\"valueToTransfer\":250,\"gaslimit\":500000,\"RskRefundAddress\":\"0x2428E03389e9db669698E0Ffa16FD66DC8156b3c\"," +
+		"\"bitcoinRefundAddress\":\"myCqdohiF3cvopyoPMB2rGTrJZx9jJ2ihT\"}"
+	var tests = []struct {
+		report   bool
+		err      error
+		status   int
+		expected string
+	}{
+		{true, fmt.Errorf("error estimating gas: %w", &connectors.CallRevertError{Reason: "not allowed"}), http.StatusUnprocessableEntity,
+			"{\"message\":\"call would revert: not allowed\",\"declineReason\":\"ContractWouldRevert\"}\n"},
+		{true, &connectors.CallRevertError{}, http.StatusUnprocessableEntity,
+			"{\"message\":\"call would revert\",\"declineReason\":\"ContractWouldRevert\"}\n"},
+		{false, &connectors.CallRevertError{Reason: "not allowed"}, http.StatusInternalServerError, "internal server error\n"},
+		{true, fmt.Errorf("error estimating gas: %w", connectors.ErrNodeUnavailable), http.StatusServiceUnavailable,
+			"{\"message\":\"service unavailable; rsk node unreachable\",\"declineReason\":\"NodeUnavailable\"}\n"},
+	}
+	for _, tt := range tests {
+		rsk := new(testmocks.RskMock)
+		srv := New(rsk, new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{ReportCallReverts: tt.report}, prometheus.NewRegistry())
+		rsk.On("GetLBCAddress")
+		rsk.On("GetBridgeAddress")
+		rsk.On("EstimateGas", mock.Anything, mock.Anything, mock.Anything).Return(uint64(0), tt.err)
+		req, err := http.NewRequest("POST", "getQuote", bytes.NewReader([]byte(body)))
 		if err != nil {
-			t.Errorf("couldn't decode addresses. error: %v", err)
+			t.Fatalf("couldn't instantiate request. error: %v", err)
 		}
-		req, err := http.NewRequest("POST", "acceptQuote", bytes.NewReader([]byte(body)))
+		w := http2.TestResponseWriter{}
+		srv.getQuoteHandler(&w, req)
+		assert.EqualValues(t, tt.status, w.StatusCode)
+		assert.EqualValues(t, tt.expected, w.Output)
+	}
+}
+
+func testGetQuoteFeeTooHigh(t *testing.T) {
+	body := "{\"callContractAddress\":\"0x63C46fBf3183B0a230833a7076128bdf3D5Bc03F\",\"callContractArguments\":\"\"," +
+		"\"valueToTransfer\":250,\"gaslimit\":500000,\"RskRefundAddress\":\"0x2428E03389e9db669698E0Ffa16FD66DC8156b3c\"," +
+		"\"bitcoinRefundAddress\":\"myCqdohiF3cvopyoPMB2rGTrJZx9jJ2ihT\"}"
+	rsk := new(testmocks.RskMock)
+	db := testmocks.NewDbMock("", nil)
+	rsk.On("EstimateGas", mock.Anything, mock.Anything, mock.Anything)
+	rsk.On("GasPrice")
+	rsk.On("GetFedAddress")
+	rsk.On("GetLBCAddress")
+	rsk.On("GetBridgeAddress")
+	rsk.On("GetMinimumLockTxValue").Return(big.NewInt(0), nil)
+	rsk.On("HashQuote", mock.Anything)
+	rsk.On("GetRequiredBridgeConfirmations")
+	db.On("GetQuote", "").Return((*types.Quote)(nil))
+	db.On("InsertQuote", "", mock.Anything)
+
+	getQuote := func(srv *Server) http2.TestResponseWriter {
+		req, err := http.NewRequest("POST", "getQuote?byProvider=true", bytes.NewReader([]byte(body)))
 		if err != nil {
-			t.Errorf("couldn't instantiate request. error: %v", err)
+			t.Fatalf("couldn't instantiate request. error: %v", err)
 		}
-		hashBytes, err := hex.DecodeString(hash)
+		w := http2.TestResponseWriter{}
+		srv.getQuoteHandler(&w, req)
+		return w
+	}
+
+	srv := New(rsk, new(testmocks.BtcMock), db, Config{MaxCallFeeRatio: 0.5}, prometheus.NewRegistry())
+	for _, lp := range []providers.LiquidityProvider{feeProviderMock{providerMocks[0], 200}, feeProviderMock{providerMocks[1], 100}} {
+		rsk.On("GetCollateral", lp.Address()).Return(nil)
+		err := srv.AddProvider(lp)
 		if err != nil {
-			t.Errorf("couldn't decode hash. error: %v", err)
+			t.Fatalf("couldn't add provider. error: %v", err)
 		}
+	}
+	w := getQuote(&srv)
+	assert.EqualValues(t, http.StatusOK, w.StatusCode)
+	var res []map[string]interface{}
+	err := json.Unmarshal([]byte(w.Output), &res)
+	assert.Nil(t, err)
+	if assert.Len(t, res, 1) {
+		assert.EqualValues(t, providerMocks[1].address, res[0]["providerId"])
+	}
+	assert.EqualValues(t, 1, testutil.ToFloat64(srv.metrics.quoteErrors.WithLabelValues(quoteErrorFeeTooHigh)))
 
-		db.On("GetQuote", hash).Times(1).Return(quote, nil)
-		db.On("GetRetainedQuote", hash).Times(1).Return(nil, nil)
-		rsk.On("GasPrice").Times(1)
-		rsk.On("FetchFederationInfo").Times(1).Return(fedInfo, nil)
-		btc.On("GetDerivedBitcoinAddress", fedInfo, btcRefAddr, lbcAddr, lpBTCAddr, hashBytes).Times(1).Return("")
-		btc.On("AddAddressWatcher", "", minAmount, time.Minute, expTime, mock.AnythingOfType("*http.BTCAddressWatcher"), mock.AnythingOfType("func(connectors.AddressWatcher)")).Times(1).Return("")
-		srv.acceptQuoteHandler(&w, req)
-		db.AssertExpectations(t)
-		btc.AssertExpectations(t)
-		rsk.AssertExpectations(t)
-		assert.EqualValues(t, "application/json", w.Header().Get("Content-Type"))
+	srv = New(rsk, new(testmocks.BtcMock), db, Config{MaxCallFee: 150}, prometheus.NewRegistry())
+	err = srv.AddProvider(feeProviderMock{providerMocks[0], 200})
+	if err != nil {
+		t.Fatalf("couldn't add provider. error: %v", err)
 	}
+	w = getQuote(&srv)
+	assert.EqualValues(t, http.StatusBadRequest, w.StatusCode)
+	assert.EqualValues(t, "bad request; call fee too high for the requested value\n", w.Output)
 }
 
-func testInitBtcWatchers(t *testing.T) {
-	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
-	quote := testQuotes[0]
+func testGetQuoteFeeBelowGasCost(t *testing.T) {
+	body := "{\"callContractAddress\":\"0x63C46fBf3183B0a230833a7076128bdf3D5Bc03F\",\"callContractArguments\":\"\"," +
+		"\"valueToTransfer\":250,\"gaslimit\":500000,\"RskRefundAddress\":\"0x2428E03389e9db669698E0Ffa16FD66DC8156b3c\"," +
+		"\"bitcoinRefundAddress\":\"myCqdohiF3cvopyoPMB2rGTrJZx9jJ2ihT\"}"
 	rsk := new(testmocks.RskMock)
-	btc := new(testmocks.BtcMock)
-	db := testmocks.NewDbMock(hash, quote)
-	sat, _ := new(types.Wei).Add(quote.Value, quote.CallFee).ToSatoshi().Float64()
-	minAmount := btcutil.Amount(uint64(math.Ceil(sat)))
-	expTime := time.Unix(int64(quote.AgreementTimestamp+quote.TimeForDeposit), 0)
+	db := testmocks.NewDbMock("", nil)
+	// 10000 gas at 100000 wei
+	rsk.On("EstimateGas", mock.Anything, mock.Anything, mock.Anything)
+	rsk.On("GasPrice")
+	rsk.On("GetFedAddress")
+	rsk.On("GetLBCAddress")
+	rsk.On("GetBridgeAddress")
+	rsk.On("GetMinimumLockTxValue").Return(big.NewInt(0), nil)
+	rsk.On("HashQuote", mock.Anything)
+	rsk.On("GetRequiredBridgeConfirmations")
+	db.On("GetQuote", "").Return((*types.Quote)(nil))
+	db.On("InsertQuote", "", mock.Anything)
 
-	srv := newServer(rsk, btc, db, func() time.Time {
-		return time.Unix(0, 0)
-	})
-	for _, lp := range providerMocks {
-		rsk.On("GetCollateral", lp.address).Times(1).Return(big.NewInt(10), big.NewInt(10))
+	getQuote := func(srv *Server) http2.TestResponseWriter {
+		req, err := http.NewRequest("POST", "getQuote?byProvider=true", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("couldn't instantiate request. error: %v", err)
+		}
+		w := http2.TestResponseWriter{}
+		srv.getQuoteHandler(&w, req)
+		return w
+	}
+
+	srv := New(rsk, new(testmocks.BtcMock), db, Config{RequireGasCoverage: true}, prometheus.NewRegistry())
+	for _, lp := range []providers.LiquidityProvider{feeProviderMock{providerMocks[0], 999999999}, feeProviderMock{providerMocks[1], 1000000000}} {
+		rsk.On("GetCollateral", lp.Address()).Return(nil)
 		err := srv.AddProvider(lp)
 		if err != nil {
-			t.Errorf("couldn't add provider. error: %v", err)
+			t.Fatalf("couldn't add provider. error: %v", err)
 		}
 	}
+	w := getQuote(&srv)
+	assert.EqualValues(t, http.StatusOK, w.StatusCode)
+	var res []map[string]interface{}
+	err := json.Unmarshal([]byte(w.Output), &res)
+	assert.Nil(t, err)
+	if assert.Len(t, res, 1) {
+		assert.EqualValues(t, providerMocks[1].address, res[0]["providerId"])
+	}
+	assert.EqualValues(t, 1, testutil.ToFloat64(srv.metrics.quoteErrors.WithLabelValues(quoteErrorFeeBelowGasCost)))
+	db.AssertNumberOfCalls(t, "InsertQuote", 1)
 
-	db.On("GetRetainedQuotes", []types.RQState{types.RQStateWaitingForDeposit, types.RQStateCallForUserSucceeded}).Times(1).Return([]*types.RetainedQuote{{QuoteHash: hash}})
-	db.On("GetQuote", hash).Times(1).Return(quote)
-	btc.On("AddAddressWatcher", "", minAmount, time.Minute, expTime, mock.AnythingOfType("*http.BTCAddressWatcher"), mock.AnythingOfType("func(connectors.AddressWatcher)")).Times(1).Return("")
-	err := srv.initBtcWatchers()
+	srv = New(rsk, new(testmocks.BtcMock), db, Config{RequireGasCoverage: true}, prometheus.NewRegistry())
+	err = srv.AddProvider(feeProviderMock{providerMocks[0], 999999999})
 	if err != nil {
-		t.Errorf("couldn't init BTC watchers. error: %v", err)
+		t.Fatalf("couldn't add provider. error: %v", err)
 	}
-	db.AssertExpectations(t)
-	btc.AssertExpectations(t)
-	rsk.AssertExpectations(t)
+	w = getQuote(&srv)
+	assert.EqualValues(t, http.StatusServiceUnavailable, w.StatusCode)
+	assert.Contains(t, w.Output, "quotes unavailable; call fee doesn't cover the gas cost")
+
+	// the check is opt-in
+	srv = New(rsk, new(testmocks.BtcMock), db, Config{}, prometheus.NewRegistry())
+	err = srv.AddProvider(feeProviderMock{providerMocks[0], 999999999})
+	if err != nil {
+		t.Fatalf("couldn't add provider. error: %v", err)
+	}
+	w = getQuote(&srv)
+	assert.EqualValues(t, http.StatusOK, w.StatusCode)
 }
 
-func testGetQuoteExpTime(t *testing.T) {
-	quote := types.Quote{AgreementTimestamp: 2, TimeForDeposit: 3}
-	expTime := getQuoteExpTime(&quote)
-	assert.Equal(t, time.Unix(5, 0), expTime)
+func testGetQuoteNoLiquidity(t *testing.T) {
+	body := "{\"callContractAddress\":\"0x63C46fBf3183B0a230833a7076128bdf3D5Bc03F\",\"callContractArguments\":\"\"," +
+		"\"valueToTransfer\":250,\"gaslimit\":500000,\"RskRefundAddress\":\"0x2428E03389e9db669698E0Ffa16FD66DC8156b3c\"," +
+		"\"bitcoinRefundAddress\":\"myCqdohiF3cvopyoPMB2rGTrJZx9jJ2ihT\"}"
+	rsk := new(testmocks.RskMock)
+	db := testmocks.NewDbMock("", nil)
+	rsk.On("EstimateGas", mock.Anything, mock.Anything, mock.Anything)
+	rsk.On("GasPrice")
+	rsk.On("GetFedAddress")
+	rsk.On("GetLBCAddress")
+	rsk.On("GetBridgeAddress")
+	rsk.On("GetMinimumLockTxValue").Return(big.NewInt(0), nil)
+	srv := New(rsk, new(testmocks.BtcMock), db, Config{}, prometheus.NewRegistry())
+	for _, lp := range providerMocks {
+		rsk.On("GetCollateral", lp.Address()).Return(nil)
+		err := srv.AddProvider(drainedProviderMock{lp})
+		if err != nil {
+			t.Fatalf("couldn't add provider. error: %v", err)
+		}
+	}
+
+	req, err := http.NewRequest("POST", "getQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatalf("couldn't instantiate request. error: %v", err)
+	}
+	w := http2.TestResponseWriter{}
+	srv.getQuoteHandler(&w, req)
+	assert.EqualValues(t, http.StatusNotFound, w.StatusCode)
+	assert.EqualValues(t, "{\"message\":\"no quotes available; no provider has liquidity for the requested value\","+
+		"\"declineReason\":\"NoQuotesAvailable\"}\n", w.Output)
+	assert.EqualValues(t, len(providerMocks), testutil.ToFloat64(srv.metrics.quoteErrors.WithLabelValues(quoteErrorNoLiquidity)))
+	db.AssertNotCalled(t, "InsertQuote", mock.Anything, mock.Anything)
 }
 
-func testDecodeAddress(t *testing.T) {
-	_, _, _, err := decodeAddresses("1PRTTaJesdNovgne6Ehcdu1fpEdX7913CK", "1JRRmhqTc87SmLjSHaiJjHyuJfDUc8AQDF", "0xa554d96413FF72E93437C4072438302C38350EE3")
-	assert.Empty(t, err)
+func testCallFeeExceeded(t *testing.T) {
+	var tests = []struct {
+		cfg      Config
+		value    int64
+		fee      int64
+		exceeded bool
+		ratio    float64
+	}{
+		{Config{}, 100, 1000, false, 10},
+		{Config{MaxCallFeeRatio: 0.1}, 100, 10, false, 0.1},
+		{Config{MaxCallFeeRatio: 0.1}, 100, 11, true, 0.11},
+		{Config{MaxCallFeeRatio: 0.1}, 0, 0, false, 0},
+		{Config{MaxCallFeeRatio: 0.1}, 0, 1, true, math.Inf(1)},
+		{Config{MaxCallFee: 50}, 1000, 51, true, 0.051},
+		{Config{MaxCallFee: 50, MaxCallFeeRatio: 0.1}, 1000, 50, false, 0.05},
+	}
+	for _, tt := range tests {
+		srv := New(new(testmocks.RskMock), new(testmocks.BtcMock), testmocks.NewDbMock("", nil), tt.cfg, prometheus.NewRegistry())
+		exceeded, ratio := srv.callFeeExceeded(&types.Quote{Value: types.NewWei(tt.value), CallFee: types.NewWei(tt.fee)})
+		assert.EqualValues(t, tt.exceeded, exceeded, "%+v", tt)
+		assert.EqualValues(t, tt.ratio, ratio, "%+v", tt)
+	}
 }
 
-func testDecodeAddressWithAnInvalidBtcRefundAddr(t *testing.T) {
-	_, _, _, err := decodeAddresses("0xa554d96413FF72E93437C4072438302C38350EE3", "1JRRmhqTc87SmLjSHaiJjHyuJfDUc8AQDF", "0xa554d96413FF72E93437C4072438302C38350EE3")
-	assert.Equal(t, "the provider address is not a valid base58 encoded address. address: 0xa554d96413FF72E93437C4072438302C38350EE3", err.Error())
+func testValidateQuoteRequest(t *testing.T) {
+	valid := QuoteRequest{
+		CallContractAddress:   "0x63C46fBf3183B0a230833a7076128bdf3D5Bc03F",
+		CallContractArguments: "0xa9059cbb",
+		RskRefundAddress:      "0x2428E03389e9db669698E0Ffa16FD66DC8156b3c",
+		BitcoinRefundAddress:  "myCqdohiF3cvopyoPMB2rGTrJZx9jJ2ihT",
+	}
+	var tests = []struct {
+		modify   func(qr *QuoteRequest)
+		expected string
+	}{
+		{func(qr *QuoteRequest) {}, ""},
+		{func(qr *QuoteRequest) { qr.CallContractArguments = "" }, ""},
+		{func(qr *QuoteRequest) { qr.CallContractAddress = "0x63C46f" }, "bad request; invalid callContractAddress"},
+		{func(qr *QuoteRequest) { qr.CallContractArguments = "transfer(0x1)" }, "bad request; callContractArguments must be hex encoded"},
+		{func(qr *QuoteRequest) { qr.CallContractArguments = "a9059cb" }, "bad request; callContractArguments must be hex encoded"},
+		{func(qr *QuoteRequest) { qr.RskRefundAddress = "" }, "bad request; invalid rskRefundAddress"},
+		{func(qr *QuoteRequest) { qr.BitcoinRefundAddress = "0x2428E03389e9db669698E0Ffa16FD66DC8156b3c" }, "bad request; invalid bitcoinRefundAddress"},
+	}
+	for _, tt := range tests {
+		qr := valid
+		tt.modify(&qr)
+		err := validateQuoteRequest(&qr, nil)
+		if tt.expected == "" {
+			assert.Nil(t, err)
+			continue
+		}
+		assert.EqualError(t, err, tt.expected)
+	}
+
+	p2sh := valid
+	p2sh.BitcoinRefundAddress = "2MzQwSSnBHWHqSAqtTVQ6v47XtaisrJa1Vc"
+	assert.Nil(t, validateQuoteRequest(&valid, []string{"P2PKH"}))
+	assert.Nil(t, validateQuoteRequest(&p2sh, []string{"p2pkh", "p2sh"}))
+	assert.EqualError(t, validateQuoteRequest(&p2sh, []string{"p2pkh"}), "bad request; p2sh bitcoinRefundAddress is not accepted, only p2pkh")
 }
 
-func testDecodeAddressWithAnInvalidLpBTCAddrB(t *testing.T) {
-	_, _, _, err := decodeAddresses("1PRTTaJesdNovgne6Ehcdu1fpEdX7913CK", "0xa554d96413FF72E93437C4072438302C38350EE3", "0xa554d96413FF72E93437C4072438302C38350EE3")
-	assert.Equal(t, "the provider address is not a valid base58 encoded address. address: 0xa554d96413FF72E93437C4072438302C38350EE3", err.Error())
+func testGetQuoteRateLimited(t *testing.T) {
+	body := "{\"callContractAddress\":\"0x63C46fBf3183B0a230833a7076128bdf3D5Bc03F\",\"callContractArguments\":\"\"," +
+		"\"valueToTransfer\":250,\"gaslimit\":500000,\"RskRefundAddress\":\"0x2428E03389e9db669698E0Ffa16FD66DC8156b3c\"," +
+		"\"bitcoinRefundAddress\":\"myCqdohiF3cvopyoPMB2rGTrJZx9jJ2ihT\"}"
+	rsk := new(testmocks.RskMock)
+	db := testmocks.NewDbMock("", nil)
+	now := time.Unix(1650000000, 0)
+	cfg := Config{QuoteRateLimits: map[string]QuoteRateLimit{
+		strings.ToUpper(providerMocks[0].address): {Rate: 1, Burst: 1},
+	}}
+	srv := newServer(rsk, new(testmocks.BtcMock), db, cfg, prometheus.NewRegistry(), func() time.Time { return now })
+	for _, lp := range []providers.LiquidityProvider{providerMocks[0], providerMocks[1]} {
+		rsk.On("GetCollateral", lp.Address()).Return(nil)
+		err := srv.AddProvider(lp)
+		if err != nil {
+			t.Fatalf("couldn't add provider. error: %v", err)
+		}
+	}
+	rsk.On("EstimateGas", mock.Anything, mock.Anything, mock.Anything)
+	rsk.On("GasPrice")
+	rsk.On("GetFedAddress")
+	rsk.On("GetLBCAddress")
+	rsk.On("GetBridgeAddress")
+	rsk.On("GetMinimumLockTxValue").Return(big.NewInt(0), nil)
+	rsk.On("HashQuote", mock.Anything)
+	rsk.On("GetRequiredBridgeConfirmations")
+	db.On("GetQuote", "").Return((*types.Quote)(nil))
+	db.On("InsertQuote", "", mock.Anything)
+
+	getQuote := func() []string {
+		req, err := http.NewRequest("POST", "getQuote?byProvider=true", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("couldn't instantiate request. error: %v", err)
+		}
+		w := http2.TestResponseWriter{}
+		srv.getQuoteHandler(&w, req)
+		assert.EqualValues(t, http.StatusOK, w.StatusCode)
+		var res []map[string]interface{}
+		err = json.Unmarshal([]byte(w.Output), &res)
+		assert.Nil(t, err)
+		var ids []string
+		for _, r := range res {
+			ids = append(ids, r["providerId"].(string))
+		}
+		return ids
+	}
+	assert.EqualValues(t, []string{providerMocks[0].address, providerMocks[1].address}, getQuote())
+	// the limited provider is skipped until its bucket refills, while the other one keeps quoting
+	assert.EqualValues(t, []string{providerMocks[1].address}, getQuote())
+	assert.EqualValues(t, 1, testutil.ToFloat64(srv.metrics.quoteErrors.WithLabelValues(quoteErrorRateLimited)))
+	now = now.Add(time.Second)
+	assert.EqualValues(t, []string{providerMocks[0].address, providerMocks[1].address}, getQuote())
+
+	// when no provider can quote, the request is declined
+	srv = newServer(rsk, new(testmocks.BtcMock), db, cfg, prometheus.NewRegistry(), func() time.Time { return now })
+	rsk.On("GetCollateral", providerMocks[0].address).Return(nil)
+	err := srv.AddProvider(providerMocks[0])
+	if err != nil {
+		t.Fatalf("couldn't add provider. error: %v", err)
+	}
+	getQuote()
+	req, err := http.NewRequest("POST", "getQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatalf("couldn't instantiate request. error: %v", err)
+	}
+	w := http2.TestResponseWriter{}
+	srv.getQuoteHandler(&w, req)
+	assert.EqualValues(t, http.StatusServiceUnavailable, w.StatusCode)
+	assert.Contains(t, w.Output, "quotes unavailable; rate limited")
 }
 
-func testDecodeAddressWithAnInvalidLbcAddrB(t *testing.T) {
-	_, _, _, err := decodeAddresses("1PRTTaJesdNovgne6Ehcdu1fpEdX7913CK", "1JRRmhqTc87SmLjSHaiJjHyuJfDUc8AQDF", "1JRRmhqTc87SmLjSHaiJjHyuJfDUc8AQDF")
-	assert.Equal(t, "invalid address: 1JRRmhqTc87SmLjSHaiJjHyuJfDUc8AQDF", err.Error())
+func testQuoteRateLimiter(t *testing.T) {
+	now := time.Unix(1650000000, 0)
+	l := newQuoteRateLimiter(map[string]QuoteRateLimit{
+		"0xa": {Rate: 2, Burst: 3},
+		"0xb": {Rate: 0, Burst: 3},
+	}, func() time.Time { return now })
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.allow("0xA"))
+	}
+	assert.False(t, l.allow("0xa"))
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, l.allow("0xa"))
+	assert.False(t, l.allow("0xa"))
+	// an idle bucket doesn't refill past its burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.allow("0xa"))
+	}
+	assert.False(t, l.allow("0xa"))
+
+	// a zero rate and providers without a limit aren't limited
+	for i := 0; i < 10; i++ {
+		assert.True(t, l.allow("0xb"))
+		assert.True(t, l.allow("0xc"))
+	}
+}
+
+func testClientRateLimiter(t *testing.T) {
+	now := time.Unix(1650000000, 0)
+	l := newClientRateLimiter(ClientRateLimit{Rate: 0.5, Burst: 2}, func() time.Time { return now })
+	h := l.limit(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	request := func(remoteAddr string, forwardedFor string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/getQuote", nil)
+		r.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	assert.EqualValues(t, http.StatusOK, request("10.0.0.1:5000", "").Code)
+	assert.EqualValues(t, http.StatusOK, request("10.0.0.1:5001", "").Code)
+	w := request("10.0.0.1:5002", "")
+	assert.EqualValues(t, http.StatusTooManyRequests, w.Code)
+	assert.EqualValues(t, "2", w.Header().Get("Retry-After"))
+	// X-Forwarded-For is ignored unless forwarding is trusted
+	assert.EqualValues(t, http.StatusTooManyRequests, request("10.0.0.1:5003", "10.0.0.9").Code)
+	assert.EqualValues(t, http.StatusOK, request("10.0.0.2:5000", "").Code)
+	now = now.Add(time.Second)
+	w = request("10.0.0.1:5004", "")
+	assert.EqualValues(t, http.StatusTooManyRequests, w.Code)
+	assert.EqualValues(t, "1", w.Header().Get("Retry-After"))
+	now = now.Add(time.Second)
+	assert.EqualValues(t, http.StatusOK, request("10.0.0.1:5005", "").Code)
+
+	// idle clients are forgotten once their bucket refilled
+	now = now.Add(clientBucketSweepInterval)
+	request("10.0.0.3:5000", "")
+	assert.Len(t, l.buckets, 1)
+
+	l = newClientRateLimiter(ClientRateLimit{Rate: 0.5, Burst: 1, TrustForwarding: true}, func() time.Time { return now })
+	h = l.limit(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	assert.EqualValues(t, http.StatusOK, request("10.0.0.1:5000", "1.1.1.1, 10.0.0.9").Code)
+	assert.EqualValues(t, http.StatusTooManyRequests, request("10.0.0.1:5000", "2.2.2.2, 10.0.0.9").Code)
+	assert.EqualValues(t, http.StatusOK, request("10.0.0.1:5000", "10.0.0.8").Code)
+
+	// a zero rate doesn't limit
+	l = newClientRateLimiter(ClientRateLimit{}, func() time.Time { return now })
+	h = l.limit(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	for i := 0; i < 10; i++ {
+		assert.EqualValues(t, http.StatusOK, request("10.0.0.1:5000", "").Code)
+	}
+	assert.Empty(t, l.buckets)
+}
+
+func testCORS(t *testing.T) {
+	rsk := new(testmocks.RskMock)
+	srv := New(rsk, new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{AllowedOrigins: []string{"https://app.example.com"}}, prometheus.NewRegistry())
+	h := srv.withCORS(srv.newRouter())
+
+	for _, path := range []string{"/getQuote", "/acceptQuote"} {
+		r := httptest.NewRequest(http.MethodOptions, path, nil)
+		r.Header.Set("Origin", "https://app.example.com")
+		r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		r.Header.Set("Access-Control-Request-Headers", "Content-Type")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.EqualValues(t, http.StatusOK, w.Code)
+		assert.EqualValues(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Contains(t, w.Header().Get("Access-Control-Allow-Methods"), http.MethodPost)
+		assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "Content-Type")
+		assert.Empty(t, w.Body.String())
+	}
+
+	// other origins aren't allowed to read the responses
+	r := httptest.NewRequest(http.MethodPost, "/getQuote", bytes.NewReader([]byte("{")))
+	r.Header.Set("Origin", "https://evil.example.com")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.EqualValues(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	r = httptest.NewRequest(http.MethodPost, "/getQuote", bytes.NewReader([]byte("{")))
+	r.Header.Set("Origin", "https://app.example.com")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.EqualValues(t, http.StatusBadRequest, w.Code)
+	assert.EqualValues(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	rsk.AssertNotCalled(t, "EstimateGas", mock.Anything, mock.Anything, mock.Anything)
+
+	// without allowed origins the router is served as is
+	srv = New(rsk, new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{}, prometheus.NewRegistry())
+	router := srv.newRouter()
+	assert.Equal(t, http.Handler(router), srv.withCORS(router))
+}
+
+func testGetQuoteStoreFailure(t *testing.T) {
+	body := "{\"callContractAddress\":\"0x63C46fBf3183B0a230833a7076128bdf3D5Bc03F\",\"callContractArguments\":\"\"," +
+		"\"valueToTransfer\":250,\"gaslimit\":500000,\"RskRefundAddress\":\"0x2428E03389e9db669698E0Ffa16FD66DC8156b3c\"," +
+		"\"bitcoinRefundAddress\":\"myCqdohiF3cvopyoPMB2rGTrJZx9jJ2ihT\"}"
+	for _, tt := range []struct {
+		partialQuotes bool
+		expected      int
+	}{
+		{false, http.StatusInternalServerError},
+		{true, http.StatusOK},
+	} {
+		rsk := new(testmocks.RskMock)
+		db := testmocks.NewDbMock("", nil)
+		srv := New(rsk, new(testmocks.BtcMock), db, Config{PartialQuotes: tt.partialQuotes}, prometheus.NewRegistry())
+		for _, lp := range providerMocks {
+			rsk.On("GetCollateral", lp.address).Return(nil)
+			err := srv.AddProvider(lp)
+			if err != nil {
+				t.Fatalf("couldn't add provider. error: %v", err)
+			}
+		}
+		req, err := http.NewRequest("POST", "getQuote", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("couldn't instantiate request. error: %v", err)
+		}
+		rsk.On("EstimateGas", mock.Anything, mock.Anything, mock.Anything)
+		rsk.On("GasPrice")
+		rsk.On("GetFedAddress")
+		rsk.On("GetLBCAddress")
+		rsk.On("GetBridgeAddress")
+		rsk.On("GetMinimumLockTxValue").Return(big.NewInt(0), nil)
+		rsk.On("HashQuote", mock.Anything)
+		rsk.On("GetRequiredBridgeConfirmations")
+		db.On("GetQuote", "").Return((*types.Quote)(nil))
+		db.On("InsertQuote", "", mock.Anything).Return(errors.New("disk full")).Once()
+		db.On("InsertQuote", "", mock.Anything).Return(nil)
+
+		w := http2.TestResponseWriter{}
+		srv.getQuoteHandler(&w, req)
+		assert.EqualValues(t, tt.expected, w.StatusCode)
+		assert.EqualValues(t, 1, testutil.ToFloat64(srv.metrics.quoteErrors.WithLabelValues(quoteErrorStoreFailed)))
+		assert.EqualValues(t, 0, testutil.ToFloat64(srv.metrics.quoteErrors.WithLabelValues(quoteErrorProviderDeclined)))
+		if tt.partialQuotes {
+			var res []map[string]interface{}
+			err = json.Unmarshal([]byte(w.Output), &res)
+			assert.Nil(t, err)
+			assert.Len(t, res, len(providerMocks)-1)
+		}
+	}
+}
+
+func testGetQuoteGasPriceTooHigh(t *testing.T) {
+	body := "{\"callContractAddress\":\"0x63C46fBf3183B0a230833a7076128bdf3D5Bc03F\",\"callContractArguments\":\"\"," +
+		"\"valueToTransfer\":250,\"gaslimit\":500000,\"RskRefundAddress\":\"0x2428E03389e9db669698E0Ffa16FD66DC8156b3c\"," +
+		"\"bitcoinRefundAddress\":\"myCqdohiF3cvopyoPMB2rGTrJZx9jJ2ihT\"}"
+	rsk := new(testmocks.RskMock)
+	srv := New(rsk, new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{MaxAcceptableGasPrice: 99999}, prometheus.NewRegistry())
+	req, err := http.NewRequest("POST", "getQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatalf("couldn't instantiate request. error: %v", err)
+	}
+	rsk.On("GetLBCAddress")
+	rsk.On("GetBridgeAddress")
+	rsk.On("EstimateGas", mock.Anything, mock.Anything, mock.Anything)
+	rsk.On("GasPrice").Times(1)
+	w := httptest.NewRecorder()
+	srv.getQuoteHandler(w, req)
+	rsk.AssertExpectations(t)
+	rsk.AssertNotCalled(t, "GetFedAddress")
+	assert.EqualValues(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"message":"quotes unavailable; gas price too high"}`, w.Body.String())
+	assert.EqualValues(t, 1, testutil.ToFloat64(srv.metrics.quoteErrors.WithLabelValues(quoteErrorGasTooHigh)))
+	assert.EqualValues(t, 100000, testutil.ToFloat64(srv.metrics.gasPrice))
+	assert.EqualValues(t, 99999, testutil.ToFloat64(srv.metrics.maxGasPrice))
+}
+
+func testGetQuoteContractRefundAddress(t *testing.T) {
+	refundAddr := "0x2428E03389e9db669698E0Ffa16FD66DC8156b3c"
+	body := "{\"callContractAddress\":\"0x63C46fBf3183B0a230833a7076128bdf3D5Bc03F\",\"callContractArguments\":\"\"," +
+		"\"valueToTransfer\":250,\"gaslimit\":500000,\"RskRefundAddress\":\"" + refundAddr + "\"," +
+		"\"bitcoinRefundAddress\":\"myCqdohiF3cvopyoPMB2rGTrJZx9jJ2ihT\"}"
+	rsk := new(testmocks.RskMock)
+	srv := New(rsk, new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{RejectContractRefunds: true}, prometheus.NewRegistry())
+	req, err := http.NewRequest("POST", "getQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatalf("couldn't instantiate request. error: %v", err)
+	}
+	rsk.On("GetLBCAddress")
+	rsk.On("GetBridgeAddress")
+	rsk.On("IsContract", refundAddr).Return(true, nil).Times(1)
+	w := http2.TestResponseWriter{}
+	srv.getQuoteHandler(&w, req)
+	rsk.AssertExpectations(t)
+	rsk.AssertNotCalled(t, "EstimateGas", mock.Anything, mock.Anything, mock.Anything)
+	assert.EqualValues(t, http.StatusBadRequest, w.StatusCode)
+	assert.EqualValues(t, "bad request; rskRefundAddress must not be a contract\n", w.Output)
+}
+
+func testGetQuoteDataToAccount(t *testing.T) {
+	destAddr := "0x63C46fBf3183B0a230833a7076128bdf3D5Bc03F"
+	body := "{\"callContractAddress\":\"" + destAddr + "\",\"callContractArguments\":\"a9059cbb\"," +
+		"\"valueToTransfer\":250,\"gaslimit\":500000,\"RskRefundAddress\":\"0x2428E03389e9db669698E0Ffa16FD66DC8156b3c\"," +
+		"\"bitcoinRefundAddress\":\"myCqdohiF3cvopyoPMB2rGTrJZx9jJ2ihT\"}"
+	rsk := new(testmocks.RskMock)
+	srv := New(rsk, new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{}, prometheus.NewRegistry())
+	req, err := http.NewRequest("POST", "getQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatalf("couldn't instantiate request. error: %v", err)
+	}
+	rsk.On("GetLBCAddress")
+	rsk.On("GetBridgeAddress")
+	rsk.On("IsContract", destAddr).Return(false, nil).Times(1)
+	w := http2.TestResponseWriter{}
+	srv.getQuoteHandler(&w, req)
+	rsk.AssertExpectations(t)
+	rsk.AssertNotCalled(t, "EstimateGas", mock.Anything, mock.Anything, mock.Anything)
+	assert.EqualValues(t, http.StatusBadRequest, w.StatusCode)
+	assert.EqualValues(t, "bad request; callContractArguments given, but callContractAddress has no code\n", w.Output)
+
+	// opting out skips the check
+	rsk = new(testmocks.RskMock)
+	srv = New(rsk, new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{AllowDataToAccounts: true}, prometheus.NewRegistry())
+	req, err = http.NewRequest("POST", "getQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatalf("couldn't instantiate request. error: %v", err)
+	}
+	rsk.On("GetLBCAddress")
+	rsk.On("GetBridgeAddress")
+	rsk.On("EstimateGas", mock.Anything, mock.Anything, mock.Anything)
+	rsk.On("GasPrice")
+	rsk.On("GetFedAddress")
+	rsk.On("GetMinimumLockTxValue").Return(big.NewInt(0), nil)
+	rsk.On("GetRequiredBridgeConfirmations")
+	w = http2.TestResponseWriter{}
+	srv.getQuoteHandler(&w, req)
+	rsk.AssertNotCalled(t, "IsContract", mock.Anything)
+	assert.EqualValues(t, http.StatusOK, w.StatusCode)
+}
+
+func testGetQuoteCallDataTooLarge(t *testing.T) {
+	body := "{\"callContractAddress\":\"0x63C46fBf3183B0a230833a7076128bdf3D5Bc03F\",\"callContractArguments\":\"0xa9059cbb00\"," +
+		"\"valueToTransfer\":250,\"gaslimit\":500000,\"RskRefundAddress\":\"0x2428E03389e9db669698E0Ffa16FD66DC8156b3c\"," +
+		"\"bitcoinRefundAddress\":\"myCqdohiF3cvopyoPMB2rGTrJZx9jJ2ihT\"}"
+	rsk := new(testmocks.RskMock)
+	srv := New(rsk, new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{MaxCallDataSize: 4}, prometheus.NewRegistry())
+	req, err := http.NewRequest("POST", "getQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatalf("couldn't instantiate request. error: %v", err)
+	}
+	w := http2.TestResponseWriter{}
+	srv.getQuoteHandler(&w, req)
+	rsk.AssertNotCalled(t, "IsContract", mock.Anything)
+	rsk.AssertNotCalled(t, "EstimateGas", mock.Anything, mock.Anything, mock.Anything)
+	assert.EqualValues(t, http.StatusRequestEntityTooLarge, w.StatusCode)
+	assert.EqualValues(t, "request entity too large; callContractArguments exceeds 4 bytes\n", w.Output)
+}
+
+func testGetQuoteReservedCallTarget(t *testing.T) {
+	lbcAddr := "0x2ff74F841b95E000625b3A77fed03714874C4fEa"
+	bridgeAddr := "0x0000000000000000000000000000000001000006"
+	for _, addr := range []string{"0x0000000000000000000000000000000000000000", lbcAddr, bridgeAddr} {
+		rsk := new(testmocks.RskMock)
+		btc := new(testmocks.BtcMock)
+		db := testmocks.NewDbMock("", testQuotes[0])
+		srv := New(rsk, btc, db, Config{}, prometheus.NewRegistry())
+		body := fmt.Sprintf("{\"callContractAddress\":\"%v\",\"callContractArguments\":\"\",\"valueToTransfer\":250,"+
+			"\"gaslimit\":500000,\"RskRefundAddress\":\"0x2428E03389e9db669698E0Ffa16FD66DC8156b3c\","+
+			"\"bitcoinRefundAddress\":\"myCqdohiF3cvopyoPMB2rGTrJZx9jJ2ihT\"}", addr)
+		req, err := http.NewRequest("POST", "getQuote", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("couldn't instantiate request. error: %v", err)
+		}
+		w := http2.TestResponseWriter{}
+		rsk.On("GetLBCAddress").Return(lbcAddr).Times(1)
+		rsk.On("GetBridgeAddress").Return(bridgeAddr).Times(1)
+		srv.getQuoteHandler(&w, req)
+		rsk.AssertExpectations(t)
+		assert.EqualValues(t, http.StatusBadRequest, w.StatusCode)
+		assert.EqualValues(t, "bad request; invalid callContractAddress\n", w.Output)
+	}
+}
+
+func testAcceptQuoteComplete(t *testing.T) {
+	for _, quote := range testQuotes {
+		hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+		rsk := new(testmocks.RskMock)
+		btc := new(testmocks.BtcMock)
+		db := testmocks.NewDbMock(hash, quote)
+		sat, _ := new(types.Wei).Add(quote.Value, quote.CallFee).ToSatoshi().Float64()
+		minAmount := btcutil.Amount(uint64(math.Ceil(sat)))
+		expTime := time.Unix(int64(quote.AgreementTimestamp+quote.TimeForDeposit), 0)
+		fedInfo := &connectors.FedInfo{FedAddress: quote.FedBTCAddr}
+
+		srv := newServer(rsk, btc, db, Config{}, prometheus.NewRegistry(), func() time.Time {
+			return time.Unix(0, 0)
+		})
+		for _, lp := range providerMocks {
+			rsk.On("GetCollateral", lp.address).Times(1).Return(big.NewInt(10), big.NewInt(10))
+			err := srv.AddProvider(lp)
+			if err != nil {
+				t.Errorf("couldn't add provider. error: %v", err)
+			}
+		}
+		w := http2.TestResponseWriter{}
+		body := fmt.Sprintf("{\"quoteHash\":\"%v\"}", hash)
+
+		btcRefAddr, lpBTCAddr, lbcAddr, err := decodeAddresses(quote.BTCRefundAddr, quote.LPBTCAddr, quote.LBCAddr)
+		if err != nil {
+			t.Errorf("couldn't decode addresses. error: %v", err)
+		}
+		req, err := http.NewRequest("POST", "acceptQuote", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Errorf("couldn't instantiate request. error: %v", err)
+		}
+		hashBytes, err := hex.DecodeString(hash)
+		if err != nil {
+			t.Errorf("couldn't decode hash. error: %v", err)
+		}
+
+		rsk.On("GetLBCAddress").Return(quote.LBCAddr)
+		db.On("GetQuote", hash).Times(1).Return(quote, nil)
+		rsk.On("GasPrice").Times(1)
+		rsk.On("GetBlockNumber").Times(1).Return(uint64(4000000), nil)
+		db.On("SetAcceptedHeight", hash, uint64(4000000)).Times(1)
+		rsk.On("GetAvailableLiquidity", quote.LPRSKAddr).Times(1).Return(big.NewInt(100000000000000000), nil)
+		db.On("GetRetainedQuote", hash)
+		db.On("GetLockedLiquidity", quote.LPRSKAddr).Times(1)
+		rsk.On("FetchFederationInfo").Times(1).Return(fedInfo, nil)
+		btc.On("GetDerivedBitcoinAddress", fedInfo, btcRefAddr, lbcAddr, lpBTCAddr, hashBytes).Times(1).Return("")
+		btc.On("AddAddressWatcher", "", minAmount, time.Minute, expTime, mock.AnythingOfType("*http.BTCAddressWatcher"), mock.AnythingOfType("func(connectors.AddressWatcher)")).Times(1).Return("")
+		srv.acceptQuoteHandler(&w, req)
+		db.AssertExpectations(t)
+		btc.AssertExpectations(t)
+		rsk.AssertExpectations(t)
+		assert.EqualValues(t, "application/json", w.Header().Get("Content-Type"))
+	}
+}
+
+func testAcceptQuoteIdempotencyKey(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	quote := testQuotes[0]
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock(hash, quote)
+	fedInfo := &connectors.FedInfo{FedAddress: quote.FedBTCAddr}
+	srv := newServer(rsk, btc, db, Config{}, prometheus.NewRegistry(), func() time.Time {
+		return time.Unix(0, 0)
+	})
+	rsk.On("GetCollateral", providerMocks[1].address).Times(1).Return(big.NewInt(10), big.NewInt(10))
+	err := srv.AddProvider(providerMocks[1])
+	if err != nil {
+		t.Fatalf("couldn't add provider. error: %v", err)
+	}
+	accept := func(hash string, key string) http2.TestResponseWriter {
+		req, err := http.NewRequest("POST", "acceptQuote", bytes.NewReader([]byte(fmt.Sprintf("{\"quoteHash\":\"%v\"}", hash))))
+		if err != nil {
+			t.Fatalf("couldn't instantiate request. error: %v", err)
+		}
+		req.Header.Set("Idempotency-Key", key)
+		w := http2.TestResponseWriter{}
+		srv.acceptQuoteHandler(&w, req)
+		return w
+	}
+
+	rsk.On("GetLBCAddress").Return(quote.LBCAddr)
+	db.On("GetQuote", hash).Times(1).Return(quote, nil)
+	rsk.On("GasPrice").Times(1)
+	rsk.On("GetBlockNumber").Times(1).Return(uint64(4000000), nil)
+	db.On("SetAcceptedHeight", hash, uint64(4000000)).Times(1)
+	rsk.On("GetAvailableLiquidity", quote.LPRSKAddr).Times(1).Return(big.NewInt(100000000000000000), nil)
+	db.On("GetRetainedQuote", hash)
+	db.On("GetLockedLiquidity", quote.LPRSKAddr).Times(1)
+	rsk.On("FetchFederationInfo").Times(1).Return(fedInfo, nil)
+	btc.On("GetDerivedBitcoinAddress", fedInfo, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Times(1).Return("2Mx7jaPHtsgJTbqGnjU5UqBpkekHgfigXay")
+	btc.On("AddAddressWatcher", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Times(1).Return("")
+	var stored *storage.IdempotentResponse
+	db.On("GetIdempotentResponse", "retry-1").Return(nil, nil).Once()
+	db.On("InsertIdempotentResponse", mock.AnythingOfType("*storage.IdempotentResponse")).Run(func(args mock.Arguments) {
+		stored = args.Get(0).(*storage.IdempotentResponse)
+	}).Return(nil).Once()
+	w := accept(hash, "retry-1")
+	assert.EqualValues(t, http.StatusOK, w.StatusCode)
+	if assert.NotNil(t, stored) {
+		assert.EqualValues(t, "retry-1", stored.Key)
+		assert.EqualValues(t, hash, stored.QuoteHash)
+		assert.EqualValues(t, w.Output, stored.Response)
+	}
+
+	// retries get the stored response without accepting the quote again
+	db.On("GetIdempotentResponse", "retry-1").Return(stored, nil)
+	retry := accept(hash, "retry-1")
+	assert.EqualValues(t, http.StatusOK, retry.StatusCode)
+	assert.EqualValues(t, w.Output, retry.Output)
+	assert.EqualValues(t, "application/json", retry.Header().Get("Content-Type"))
+
+	w = accept("0000000000000000000000000000000000000000000000000000000000000001", "retry-1")
+	assert.EqualValues(t, http.StatusConflict, w.StatusCode)
+	assert.Contains(t, w.Output, "Idempotency-Key was already used to accept another quote")
+
+	w = accept(hash, "not a valid key")
+	assert.EqualValues(t, http.StatusBadRequest, w.StatusCode)
+	db.AssertExpectations(t)
+	rsk.AssertExpectations(t)
+	btc.AssertExpectations(t)
+}
+
+func testAcceptQuoteDryRun(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	quote := testQuotes[0]
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock(hash, quote)
+	fedInfo := &connectors.FedInfo{FedAddress: quote.FedBTCAddr}
+	srv := newServer(rsk, btc, db, Config{}, prometheus.NewRegistry(), func() time.Time {
+		return time.Unix(0, 0)
+	})
+	rsk.On("GetCollateral", providerMocks[1].address).Times(1).Return(big.NewInt(10), big.NewInt(10))
+	err := srv.AddProvider(providerMocks[1])
+	if err != nil {
+		t.Fatalf("couldn't add provider. error: %v", err)
+	}
+
+	rsk.On("GetLBCAddress").Return(quote.LBCAddr)
+	db.On("GetQuote", hash).Times(2).Return(quote, nil)
+	rsk.On("FetchFederationInfo").Times(2).Return(fedInfo, nil)
+	btc.On("GetDerivedBitcoinAddress", fedInfo, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Times(2).Return("2Mx7jaPHtsgJTbqGnjU5UqBpkekHgfigXay")
+	for i := 0; i < 2; i++ {
+		body := fmt.Sprintf("{\"quoteHash\":\"%v\"}", hash)
+		req, err := http.NewRequest("POST", "acceptQuote?dryRun=true", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("couldn't instantiate request. error: %v", err)
+		}
+		// the key is ignored, so a dry run doesn't take the place of the real accept
+		req.Header.Set("Idempotency-Key", "retry-1")
+		w := http2.TestResponseWriter{}
+		srv.acceptQuoteHandler(&w, req)
+		assert.EqualValues(t, http.StatusOK, w.StatusCode)
+		assert.EqualValues(t, "{\"bitcoinDepositAddressHash\":\"2Mx7jaPHtsgJTbqGnjU5UqBpkekHgfigXay\"}\n", w.Output)
+	}
+	// nothing was signed, retained nor watched
+	db.AssertExpectations(t)
+	rsk.AssertExpectations(t)
+	btc.AssertExpectations(t)
+	assert.EqualValues(t, 0, testutil.ToFloat64(srv.metrics.acceptedQuotes))
+
+	req, err := http.NewRequest("POST", "acceptQuote?dryRun=maybe", bytes.NewReader([]byte(fmt.Sprintf("{\"quoteHash\":\"%v\"}", hash))))
+	if err != nil {
+		t.Fatalf("couldn't instantiate request. error: %v", err)
+	}
+	w := http2.TestResponseWriter{}
+	srv.acceptQuoteHandler(&w, req)
+	assert.EqualValues(t, http.StatusBadRequest, w.StatusCode)
+}
+
+func testAcceptQuoteInsufficientLiquidity(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	quote := testQuotes[0]
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock(hash, quote)
+	fedInfo := &connectors.FedInfo{FedAddress: quote.FedBTCAddr}
+
+	srv := newServer(rsk, btc, db, Config{}, prometheus.NewRegistry(), func() time.Time {
+		return time.Unix(0, 0)
+	})
+	for _, lp := range providerMocks {
+		rsk.On("GetCollateral", lp.address).Times(1).Return(big.NewInt(10), big.NewInt(10))
+		err := srv.AddProvider(lp)
+		if err != nil {
+			t.Errorf("couldn't add provider. error: %v", err)
+		}
+	}
+	w := http2.TestResponseWriter{}
+	body := fmt.Sprintf("{\"quoteHash\":\"%v\"}", hash)
+	req, err := http.NewRequest("POST", "acceptQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Errorf("couldn't instantiate request. error: %v", err)
+	}
+
+	rsk.On("GetLBCAddress").Return(quote.LBCAddr)
+	db.On("GetQuote", hash).Times(1).Return(quote, nil)
+	rsk.On("GasPrice").Times(1)
+	rsk.On("GetBlockNumber").Times(1).Return(uint64(4000000), nil)
+	rsk.On("GetAvailableLiquidity", quote.LPRSKAddr).Times(1).Return(big.NewInt(0), nil)
+	db.On("GetRetainedQuote", hash)
+	db.On("GetLockedLiquidity", quote.LPRSKAddr).Times(1)
+	rsk.On("FetchFederationInfo").Times(1).Return(fedInfo, nil)
+	btc.On("GetDerivedBitcoinAddress", fedInfo, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Times(1).Return("")
+	srv.acceptQuoteHandler(&w, req)
+	db.AssertExpectations(t)
+	btc.AssertExpectations(t)
+	rsk.AssertExpectations(t)
+	assert.EqualValues(t, http.StatusConflict, w.StatusCode)
+	assert.EqualValues(t, "insufficient liquidity\n", w.Output)
+}
+
+func testAcceptQuoteConcurrentlyAccepted(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	quote := testQuotes[0]
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock(hash, quote)
+	fedInfo := &connectors.FedInfo{FedAddress: quote.FedBTCAddr}
+
+	srv := newServer(rsk, btc, db, Config{}, prometheus.NewRegistry(), func() time.Time {
+		return time.Unix(0, 0)
+	})
+	for _, lp := range providerMocks {
+		rsk.On("GetCollateral", lp.address).Times(1).Return(big.NewInt(10), big.NewInt(10))
+		err := srv.AddProvider(lp)
+		if err != nil {
+			t.Errorf("couldn't add provider. error: %v", err)
+		}
+	}
+	w := http2.TestResponseWriter{}
+	body := fmt.Sprintf("{\"quoteHash\":\"%v\"}", hash)
+	req, err := http.NewRequest("POST", "acceptQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Errorf("couldn't instantiate request. error: %v", err)
+	}
+
+	// the record read first isn't accepted, but another accept retained the quote before this one could sign it
+	retained := &types.RetainedQuote{QuoteHash: hash, Signature: "abcd", DepositAddr: "2Mx7jaPHtsgJTbqGnjU5UqBpkekHgfigXay"}
+	rsk.On("GetLBCAddress").Return(quote.LBCAddr)
+	db.On("GetQuote", hash).Times(1).Return(quote, nil)
+	rsk.On("GasPrice").Times(1)
+	rsk.On("GetBlockNumber").Times(1).Return(uint64(4000000), nil)
+	rsk.On("FetchFederationInfo").Times(1).Return(fedInfo, nil)
+	btc.On("GetDerivedBitcoinAddress", fedInfo, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Times(1).Return("")
+	db.On("GetRetainedQuote", hash).Times(1).Return(retained)
+	srv.acceptQuoteHandler(&w, req)
+	db.AssertExpectations(t)
+	btc.AssertExpectations(t)
+	rsk.AssertExpectations(t)
+	rsk.AssertNotCalled(t, "GetAvailableLiquidity", quote.LPRSKAddr)
+	db.AssertNotCalled(t, "SetAcceptedHeight", hash, uint64(4000000))
+	assert.EqualValues(t, "{\"signature\":\"abcd\",\"bitcoinDepositAddressHash\":\"2Mx7jaPHtsgJTbqGnjU5UqBpkekHgfigXay\"}\n", w.Output)
+}
+
+func testAcceptQuoteFederationUnavailable(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	quote := testQuotes[0]
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock(hash, quote)
+
+	srv := newServer(rsk, btc, db, Config{}, prometheus.NewRegistry(), func() time.Time {
+		return time.Unix(0, 0)
+	})
+	w := http2.TestResponseWriter{}
+	body := fmt.Sprintf("{\"quoteHash\":\"%v\"}", hash)
+	req, err := http.NewRequest("POST", "acceptQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Errorf("couldn't instantiate request. error: %v", err)
+	}
+
+	rsk.On("GetLBCAddress").Return(quote.LBCAddr)
+	db.On("GetQuote", hash).Times(1).Return(quote, nil)
+	rsk.On("FetchFederationInfo").Times(1).Return((*connectors.FedInfo)(nil), fmt.Errorf("%w: federation size is 0", connectors.ErrFederationUnavailable))
+	srv.acceptQuoteHandler(&w, req)
+	db.AssertExpectations(t)
+	rsk.AssertExpectations(t)
+	btc.AssertNotCalled(t, "GetDerivedBitcoinAddress", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	assert.EqualValues(t, http.StatusServiceUnavailable, w.StatusCode)
+	assert.EqualValues(t, "federation unavailable\n", w.Output)
+
+	// an unreachable node is worth retrying as well, unlike errors on our side
+	rsk = new(testmocks.RskMock)
+	db = testmocks.NewDbMock(hash, quote)
+	srv = newServer(rsk, btc, db, Config{}, prometheus.NewRegistry(), func() time.Time {
+		return time.Unix(0, 0)
+	})
+	w = http2.TestResponseWriter{}
+	req, err = http.NewRequest("POST", "acceptQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Errorf("couldn't instantiate request. error: %v", err)
+	}
+	rsk.On("GetLBCAddress").Return(quote.LBCAddr)
+	db.On("GetQuote", hash).Times(1).Return(quote, nil)
+	rsk.On("FetchFederationInfo").Times(1).Return((*connectors.FedInfo)(nil), fmt.Errorf("error fetching fed size: %w", connectors.ErrNodeUnavailable))
+	srv.acceptQuoteHandler(&w, req)
+	assert.EqualValues(t, http.StatusServiceUnavailable, w.StatusCode)
+	assert.EqualValues(t, "10", w.Header().Get("Retry-After"))
+	assert.EqualValues(t, "{\"message\":\"service unavailable; rsk node unreachable\",\"declineReason\":\"NodeUnavailable\"}\n", w.Output)
+}
+
+func testAcceptQuoteFederationChanged(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	quote := testQuotes[0]
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock(hash, quote)
+
+	srv := newServer(rsk, btc, db, Config{}, prometheus.NewRegistry(), func() time.Time {
+		return time.Unix(0, 0)
+	})
+	w := http2.TestResponseWriter{}
+	body := fmt.Sprintf("{\"quoteHash\":\"%v\"}", hash)
+	req, err := http.NewRequest("POST", "acceptQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Errorf("couldn't instantiate request. error: %v", err)
+	}
+
+	rsk.On("GetLBCAddress").Return(quote.LBCAddr)
+	db.On("GetQuote", hash).Times(1).Return(quote, nil)
+	rsk.On("FetchFederationInfo").Times(1).Return(&connectors.FedInfo{FedAddress: "2N5muMepJizJE1gR7FbHJU6CD18V3BpNF9p"}, nil)
+	srv.acceptQuoteHandler(&w, req)
+	rsk.AssertExpectations(t)
+	btc.AssertNotCalled(t, "GetDerivedBitcoinAddress", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	assert.EqualValues(t, http.StatusConflict, w.StatusCode)
+	assert.EqualValues(t, "federation changed since quote was issued\n", w.Output)
+
+	// regtest mode goes on with the current federation
+	srv = newServer(rsk, btc, db, Config{RegtestMode: true}, prometheus.NewRegistry(), func() time.Time {
+		return time.Unix(0, 0)
+	})
+	for _, lp := range providerMocks {
+		rsk.On("GetCollateral", lp.address).Times(1).Return(big.NewInt(10), big.NewInt(10))
+		err := srv.AddProvider(lp)
+		if err != nil {
+			t.Fatalf("couldn't add provider. error: %v", err)
+		}
+	}
+	req, err = http.NewRequest("POST", "acceptQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Errorf("couldn't instantiate request. error: %v", err)
+	}
+	w = http2.TestResponseWriter{}
+	rsk.On("GetLBCAddress").Return(quote.LBCAddr)
+	db.On("GetQuote", hash).Times(1).Return(quote, nil)
+	rsk.On("FetchFederationInfo").Times(1).Return(&connectors.FedInfo{FedAddress: "2N5muMepJizJE1gR7FbHJU6CD18V3BpNF9p"}, nil)
+	btc.On("GetDerivedBitcoinAddress", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Times(1).Return("")
+	rsk.On("GasPrice")
+	rsk.On("GetBlockNumber").Return(uint64(4000000), nil)
+	rsk.On("GetAvailableLiquidity", quote.LPRSKAddr).Return(big.NewInt(0), nil)
+	db.On("GetRetainedQuote", hash)
+	db.On("GetLockedLiquidity", quote.LPRSKAddr)
+	srv.acceptQuoteHandler(&w, req)
+	btc.AssertExpectations(t)
+	assert.NotEqualValues(t, "federation changed since quote was issued\n", w.Output)
+}
+
+func testAcceptQuoteForeignLBC(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	quote := testQuotes[0]
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock(hash, quote)
+
+	srv := newServer(rsk, btc, db, Config{}, prometheus.NewRegistry(), func() time.Time {
+		return time.Unix(0, 0)
+	})
+	w := http2.TestResponseWriter{}
+	body := fmt.Sprintf("{\"quoteHash\":\"%v\"}", hash)
+	req, err := http.NewRequest("POST", "acceptQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Errorf("couldn't instantiate request. error: %v", err)
+	}
+
+	rsk.On("GetLBCAddress").Return("0x63C46fBf3183B0a230833a7076128bdf3D5Bc03F")
+	db.On("GetQuote", hash).Times(1).Return(quote, nil)
+	srv.acceptQuoteHandler(&w, req)
+	db.AssertExpectations(t)
+	rsk.AssertNotCalled(t, "FetchFederationInfo")
+	btc.AssertNotCalled(t, "GetDerivedBitcoinAddress", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	assert.EqualValues(t, http.StatusConflict, w.StatusCode)
+	assert.EqualValues(t, "quote was issued for another LBC\n", w.Output)
+}
+
+func testAcceptQuoteWatcherLimit(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	quote := testQuotes[0]
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock(hash, quote)
+
+	srv := newServer(rsk, btc, db, Config{}, prometheus.NewRegistry(), func() time.Time {
+		return time.Unix(0, 0)
+	})
+	srv.watchers["other"] = &BTCAddressWatcher{}
+	w := http2.TestResponseWriter{}
+	body := fmt.Sprintf("{\"quoteHash\":\"%v\"}", hash)
+	req, err := http.NewRequest("POST", "acceptQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Errorf("couldn't instantiate request. error: %v", err)
+	}
+
+	rsk.On("GetLBCAddress").Return(quote.LBCAddr)
+	db.On("GetQuote", hash).Times(1).Return(quote, nil)
+	srv.acceptQuoteHandler(&w, req)
+	db.AssertExpectations(t)
+	rsk.AssertNotCalled(t, "FetchFederationInfo")
+	assert.EqualValues(t, http.StatusServiceUnavailable, w.StatusCode)
+	assert.EqualValues(t, "service unavailable; too many deposits being watched\n", w.Output)
+	assert.EqualValues(t, 0, srv.pendingWatchers)
+
+	delete(srv.watchers, "other")
+	assert.True(t, srv.reserveWatcher())
+	assert.False(t, srv.reserveWatcher())
+	srv.releaseWatcher()
+	assert.True(t, srv.reserveWatcher())
+}
+
+func testAcceptQuoteProviderRotated(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	quote := testQuotes[0]
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock(hash, quote)
+
+	srv := newServer(rsk, btc, db, Config{}, prometheus.NewRegistry(), func() time.Time {
+		return time.Unix(0, 0)
+	})
+	rsk.On("GetCollateral", providerMocks[0].address).Return(nil)
+	err := srv.AddProvider(providerMocks[0])
+	if err != nil {
+		t.Fatalf("couldn't add provider. error: %v", err)
+	}
+	w := http2.TestResponseWriter{}
+	body := fmt.Sprintf("{\"quoteHash\":\"%v\"}", hash)
+	req, err := http.NewRequest("POST", "acceptQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Errorf("couldn't instantiate request. error: %v", err)
+	}
+
+	rsk.On("GetLBCAddress").Return(quote.LBCAddr)
+	db.On("GetQuote", hash).Times(1).Return(quote, nil)
+	rsk.On("FetchFederationInfo").Return(&connectors.FedInfo{FedAddress: quote.FedBTCAddr}, nil)
+	btc.On("GetDerivedBitcoinAddress", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return("")
+	srv.acceptQuoteHandler(&w, req)
+	rsk.AssertNotCalled(t, "GasPrice")
+	db.AssertNotCalled(t, "RetainQuote", mock.Anything)
+	assert.EqualValues(t, http.StatusGone, w.StatusCode)
+	assert.EqualValues(t, "provider key rotated, please request a new quote\n", w.Output)
+}
+
+func testInvalidateQuotes(t *testing.T) {
+	rsk := new(testmocks.RskMock)
+	db := testmocks.NewDbMock("", nil)
+	srv := New(rsk, new(testmocks.BtcMock), db, Config{}, prometheus.NewRegistry())
+	rsk.On("GetCollateral", providerMocks[1].address).Return(nil)
+	err := srv.AddProvider(providerMocks[1])
+	if err != nil {
+		t.Fatalf("couldn't add provider. error: %v", err)
+	}
+	rotatedAddr := "0x5F3b836CA64DA03e613887B46f71D168FC8B5Bdf"
+	db.On("DeleteProviderQuotes", rotatedAddr).Return(int64(3), nil).Times(1)
+
+	for _, tt := range []struct {
+		addr   string
+		code   int
+		output string
+	}{
+		{rotatedAddr, http.StatusOK, "{\"deleted\":3}\n"},
+		{strings.ToLower(providerMocks[1].address), http.StatusConflict, "conflict; provider is still registered\n"},
+		{"123", http.StatusBadRequest, "bad request; invalid providerAddress\n"},
+	} {
+		body := fmt.Sprintf("{\"providerAddress\":\"%v\"}", tt.addr)
+		req, err := http.NewRequest("POST", "admin/invalidateQuotes", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("couldn't instantiate request. error: %v", err)
+		}
+		w := http2.TestResponseWriter{}
+		srv.invalidateQuotesHandler(&w, req)
+		assert.EqualValues(t, tt.code, w.StatusCode, tt.addr)
+		assert.EqualValues(t, tt.output, w.Output, tt.addr)
+	}
+	db.AssertExpectations(t)
+}
+
+func testListQuotes(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	quote := testQuotes[0]
+	db := testmocks.NewDbMock("", nil)
+	srv := New(new(testmocks.RskMock), new(testmocks.BtcMock), db, Config{}, prometheus.NewRegistry())
+	filter := storage.QuoteFilter{LpRskAddr: quote.LPRSKAddr, CreatedAfter: time.Unix(1000, 0)}
+	db.On("ListQuotes", filter, uint(10), uint(20)).Return([]*storage.ListedQuote{{Hash: hash, Quote: *quote}}, 21, nil).Times(1)
+	db.On("ListQuotes", storage.QuoteFilter{}, uint(defaultQuotesPageSize), uint(0)).Return([]*storage.ListedQuote{}, 0, nil).Times(1)
+
+	w := httptest.NewRecorder()
+	srv.newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet,
+		"/quotes?lpRskAddress="+quote.LPRSKAddr+"&createdAfter=1000&limit=10&offset=20", nil))
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	var res struct {
+		Quotes []struct {
+			QuoteHash string      `json:"quoteHash"`
+			Quote     types.Quote `json:"quote"`
+		} `json:"quotes"`
+		Total  int  `json:"total"`
+		Limit  uint `json:"limit"`
+		Offset uint `json:"offset"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &res)
+	assert.Nil(t, err)
+	assert.Len(t, res.Quotes, 1)
+	assert.EqualValues(t, hash, res.Quotes[0].QuoteHash)
+	assert.EqualValues(t, quote.LPRSKAddr, res.Quotes[0].Quote.LPRSKAddr)
+	assert.EqualValues(t, 21, res.Total)
+	assert.EqualValues(t, 10, res.Limit)
+	assert.EqualValues(t, 20, res.Offset)
+
+	w = httptest.NewRecorder()
+	srv.newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/quotes", nil))
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, fmt.Sprintf("{\"quotes\":[],\"total\":0,\"limit\":%v,\"offset\":0}\n", defaultQuotesPageSize), w.Body.String())
+	db.AssertExpectations(t)
+
+	for _, tt := range []struct {
+		query  string
+		output string
+	}{
+		{"?lpRskAddress=0x123", "bad request; invalid lpRskAddress\n"},
+		{"?createdAfter=yesterday", "bad request; createdAfter must be a unix timestamp\n"},
+		{"?limit=0", "bad request; limit must be between 1 and 500\n"},
+		{"?limit=501", "bad request; limit must be between 1 and 500\n"},
+		{"?offset=-1", "bad request; offset must be a non-negative integer\n"},
+	} {
+		w := httptest.NewRecorder()
+		srv.newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/quotes"+tt.query, nil))
+		assert.EqualValues(t, http.StatusBadRequest, w.Code, tt.query)
+		assert.EqualValues(t, tt.output, w.Body.String(), tt.query)
+	}
+}
+
+func testAcceptQuoteDerivationFailure(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	quote := testQuotes[0]
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock(hash, quote)
+	fedInfo := &connectors.FedInfo{FedAddress: quote.FedBTCAddr, FedSize: 1, FedThreshold: 1, PubKeys: []string{"02aa"}}
+
+	srv := newServer(rsk, btc, db, Config{}, prometheus.NewRegistry(), func() time.Time {
+		return time.Unix(0, 0)
+	})
+	w := http2.TestResponseWriter{}
+	body := fmt.Sprintf("{\"quoteHash\":\"%v\"}", hash)
+	req, err := http.NewRequest("POST", "acceptQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Errorf("couldn't instantiate request. error: %v", err)
+	}
+
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	rsk.On("GetLBCAddress").Return(quote.LBCAddr)
+	db.On("GetQuote", hash).Times(1).Return(quote, nil)
+	rsk.On("FetchFederationInfo").Return(fedInfo, nil)
+	btc.On("GetParams")
+	btc.On("GetDerivedBitcoinAddress", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return("", errors.New("invalid redeem script"))
+	srv.acceptQuoteHandler(&w, req)
+	assert.EqualValues(t, http.StatusInternalServerError, w.StatusCode)
+	assert.EqualValues(t, "internal server error\n", w.Output)
+
+	var entry *logrus.Entry
+	for _, e := range hook.AllEntries() {
+		if e.Data["quoteHash"] == hash {
+			entry = e
+		}
+	}
+	if entry == nil {
+		t.Fatalf("derivation failure wasn't logged")
+	}
+	assert.EqualValues(t, logrus.ErrorLevel, entry.Level)
+	assert.Contains(t, entry.Message, "invalid redeem script")
+	assert.EqualValues(t, "testnet3", entry.Data["network"])
+	assert.EqualValues(t, quote.FedBTCAddr, entry.Data["fedAddress"])
+	assert.EqualValues(t, []string{"02aa"}, entry.Data["fedPubKeys"])
+	assert.Contains(t, entry.Data, "derivationValueHash")
+	assert.Contains(t, entry.Data, "btcRefundAddr")
+}
+
+func testAcceptQuoteAlreadyAccepted(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	quote := testQuotes[0]
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock(hash, quote)
+
+	srv := newServer(rsk, btc, db, Config{}, prometheus.NewRegistry(), func() time.Time {
+		return time.Unix(0, 0)
+	})
+	w := http2.TestResponseWriter{}
+	body := fmt.Sprintf("{\"quoteHash\":\"%v\"}", hash)
+	req, err := http.NewRequest("POST", "acceptQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Errorf("couldn't instantiate request. error: %v", err)
+	}
+
+	stored := &storage.RetainedQuote{
+		Quote:          quote,
+		Accepted:       true,
+		State:          types.RQStateWaitingForDeposit,
+		Signature:      "abcd",
+		DepositAddress: "2Mx7jaPHtsgJTbqGnjU5UqBpkekHgfigXay",
+	}
+	rsk.On("GetLBCAddress").Return(quote.LBCAddr)
+	db.On("GetQuote", hash).Times(1).Return(stored)
+	srv.acceptQuoteHandler(&w, req)
+	db.AssertExpectations(t)
+	rsk.AssertNotCalled(t, "FetchFederationInfo")
+	assert.EqualValues(t, "{\"signature\":\"abcd\",\"bitcoinDepositAddressHash\":\"2Mx7jaPHtsgJTbqGnjU5UqBpkekHgfigXay\"}\n", w.Output)
+}
+
+func testAcceptQuoteDeadlineExceeded(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	quote := testQuotes[0]
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock(hash, quote)
+
+	srv := newServer(rsk, btc, db, Config{AcceptQuoteTimeout: 60}, prometheus.NewRegistry(), func() time.Time {
+		return time.Unix(0, 0)
+	})
+	w := http2.TestResponseWriter{}
+	body := fmt.Sprintf("{\"quoteHash\":\"%v\"}", hash)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", "acceptQuote", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Errorf("couldn't instantiate request. error: %v", err)
+	}
+
+	rsk.On("GetLBCAddress").Return(quote.LBCAddr)
+	db.On("GetQuote", hash).Times(1).Return(quote, nil)
+	rsk.On("FetchFederationInfo").Times(1).After(time.Second).Return(&connectors.FedInfo{}, nil)
+	start := time.Now()
+	srv.acceptQuoteHandler(&w, req)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	btc.AssertNotCalled(t, "GetDerivedBitcoinAddress", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	assert.EqualValues(t, http.StatusGatewayTimeout, w.StatusCode)
+	assert.EqualValues(t, "gateway timeout; accept quote deadline exceeded\n", w.Output)
+}
+
+func testAcceptQuoteExpiredWithinClockSkew(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	quote := testQuotes[0]
+	expTime := time.Unix(int64(quote.AgreementTimestamp+quote.TimeForDeposit), 0)
+	body := fmt.Sprintf("{\"quoteHash\":\"%v\"}", hash)
+
+	for _, tt := range []struct {
+		tolerance uint
+		offset    uint
+		expected  int
+	}{
+		{0, 0, http.StatusConflict},
+		{60, 0, http.StatusOK},
+		// the deposit window would open after the tolerance is over
+		{60, 40, http.StatusConflict},
+	} {
+		rsk := new(testmocks.RskMock)
+		btc := new(testmocks.BtcMock)
+		db := testmocks.NewDbMock(hash, quote)
+		cfg := Config{ClockSkewTolerance: tt.tolerance, DepositWindowOffset: tt.offset}
+		srv := newServer(rsk, btc, db, cfg, prometheus.NewRegistry(), func() time.Time {
+			return expTime.Add(30 * time.Second)
+		})
+		for _, lp := range providerMocks {
+			rsk.On("GetCollateral", lp.address).Times(1).Return(big.NewInt(10), big.NewInt(10))
+			err := srv.AddProvider(lp)
+			if err != nil {
+				t.Fatalf("couldn't add provider. error: %v", err)
+			}
+		}
+		req, err := http.NewRequest("POST", "acceptQuote", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("couldn't instantiate request. error: %v", err)
+		}
+		w := http2.TestResponseWriter{}
+		rsk.On("GetLBCAddress").Return(quote.LBCAddr)
+		db.On("GetQuote", hash).Times(1).Return(quote, nil)
+		rsk.On("FetchFederationInfo").Return(&connectors.FedInfo{FedAddress: quote.FedBTCAddr}, nil)
+		btc.On("GetDerivedBitcoinAddress", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return("")
+		rsk.On("GasPrice")
+		rsk.On("GetBlockNumber").Return(uint64(4000000), nil)
+		rsk.On("GetAvailableLiquidity", quote.LPRSKAddr).Return(big.NewInt(0), nil)
+		db.On("GetRetainedQuote", hash)
+		db.On("GetLockedLiquidity", quote.LPRSKAddr)
+		srv.acceptQuoteHandler(&w, req)
+		if tt.expected == http.StatusConflict {
+			assert.EqualValues(t, http.StatusConflict, w.StatusCode)
+			assert.EqualValues(t, "quote expired; its deposit time has elapsed, please request a new quote\n", w.Output)
+			rsk.AssertNotCalled(t, "FetchFederationInfo")
+		} else {
+			assert.EqualValues(t, http.StatusConflict, w.StatusCode)
+			assert.EqualValues(t, "insufficient liquidity\n", w.Output)
+		}
+	}
+}
+
+func testInitBtcWatchers(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	quote := testQuotes[0]
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock(hash, quote)
+	sat, _ := new(types.Wei).Add(quote.Value, quote.CallFee).ToSatoshi().Float64()
+	minAmount := btcutil.Amount(uint64(math.Ceil(sat)))
+	expTime := time.Unix(int64(quote.AgreementTimestamp+quote.TimeForDeposit), 0)
+
+	srv := newServer(rsk, btc, db, Config{}, prometheus.NewRegistry(), func() time.Time {
+		return time.Unix(0, 0)
+	})
+	for _, lp := range providerMocks {
+		rsk.On("GetCollateral", lp.address).Times(1).Return(big.NewInt(10), big.NewInt(10))
+		err := srv.AddProvider(lp)
+		if err != nil {
+			t.Errorf("couldn't add provider. error: %v", err)
+		}
+	}
+
+	db.On("GetRetainedQuotes", []types.RQState{types.RQStateWaitingForDeposit, types.RQStateCallForUserSucceeded}).Times(1).Return([]*types.RetainedQuote{{QuoteHash: hash}})
+	db.On("GetQuote", hash).Times(1).Return(quote)
+	btc.On("AddAddressWatcher", "", minAmount, time.Minute, expTime, mock.AnythingOfType("*http.BTCAddressWatcher"), mock.AnythingOfType("func(connectors.AddressWatcher)")).Times(1).Return("")
+	err := srv.initBtcWatchers()
+	if err != nil {
+		t.Errorf("couldn't init BTC watchers. error: %v", err)
+	}
+	db.AssertExpectations(t)
+	btc.AssertExpectations(t)
+	rsk.AssertExpectations(t)
+}
+
+func testNormalizeQuoteHash(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	for _, in := range []string{hash, "0x" + hash, "0X" + strings.ToUpper(hash)} {
+		res, err := normalizeQuoteHash(in)
+		assert.Nil(t, err)
+		assert.EqualValues(t, hash, res)
+	}
+	for _, in := range []string{"", "0x", hash[:62], hash + "00", "zz" + hash[2:]} {
+		_, err := normalizeQuoteHash(in)
+		assert.NotNil(t, err, in)
+	}
+
+	srv := New(new(testmocks.RskMock), new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{}, prometheus.NewRegistry())
+	req, err := http.NewRequest("POST", "acceptQuote", bytes.NewReader([]byte("{\"quoteHash\":\"0xzz\"}")))
+	if err != nil {
+		t.Fatalf("couldn't instantiate request. error: %v", err)
+	}
+	w := httptest.NewRecorder()
+	srv.acceptQuoteHandler(w, req)
+	assert.EqualValues(t, http.StatusBadRequest, w.Code)
+	assert.EqualValues(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"message":"quoteHash must be 64 hex characters"}`, w.Body.String())
+}
+
+func testGetQuoteExpTime(t *testing.T) {
+	quote := types.Quote{AgreementTimestamp: 2, TimeForDeposit: 3}
+	expTime := getQuoteExpTime(&quote)
+	assert.Equal(t, time.Unix(5, 0), expTime)
+}
+
+func testDecodeAddress(t *testing.T) {
+	_, _, _, err := decodeAddresses("1PRTTaJesdNovgne6Ehcdu1fpEdX7913CK", "1JRRmhqTc87SmLjSHaiJjHyuJfDUc8AQDF", "0xa554d96413FF72E93437C4072438302C38350EE3")
+	assert.Empty(t, err)
+}
+
+func testDecodeAddressWithAnInvalidBtcRefundAddr(t *testing.T) {
+	_, _, _, err := decodeAddresses("0xa554d96413FF72E93437C4072438302C38350EE3", "1JRRmhqTc87SmLjSHaiJjHyuJfDUc8AQDF", "0xa554d96413FF72E93437C4072438302C38350EE3")
+	assert.Equal(t, "the provider address is not a valid base58 encoded address. address: 0xa554d96413FF72E93437C4072438302C38350EE3", err.Error())
+}
+
+func testDecodeAddressWithAnInvalidLpBTCAddrB(t *testing.T) {
+	_, _, _, err := decodeAddresses("1PRTTaJesdNovgne6Ehcdu1fpEdX7913CK", "0xa554d96413FF72E93437C4072438302C38350EE3", "0xa554d96413FF72E93437C4072438302C38350EE3")
+	assert.Equal(t, "the provider address is not a valid base58 encoded address. address: 0xa554d96413FF72E93437C4072438302C38350EE3", err.Error())
+}
+
+func testDecodeAddressWithAnInvalidLbcAddrB(t *testing.T) {
+	_, _, _, err := decodeAddresses("1PRTTaJesdNovgne6Ehcdu1fpEdX7913CK", "1JRRmhqTc87SmLjSHaiJjHyuJfDUc8AQDF", "1JRRmhqTc87SmLjSHaiJjHyuJfDUc8AQDF")
+	assert.Equal(t, "invalid address: 1JRRmhqTc87SmLjSHaiJjHyuJfDUc8AQDF", err.Error())
+}
+
+func testMethodNotAllowed(t *testing.T) {
+	srv := New(new(testmocks.RskMock), new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{}, prometheus.NewRegistry())
+	r := srv.newRouter()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/getQuote", nil)
+	r.ServeHTTP(w, req)
+	assert.EqualValues(t, http.StatusMethodNotAllowed, w.Code)
+	assert.EqualValues(t, "POST", w.Header().Get("Allow"))
+	assert.EqualValues(t, "application/json", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, "{\"message\":\"method GET not allowed; allowed methods: POST\"}\n", w.Body.String())
+}
+
+func testNotFound(t *testing.T) {
+	srv := New(new(testmocks.RskMock), new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{}, prometheus.NewRegistry())
+	r := srv.newRouter()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/unknown", nil)
+	r.ServeHTTP(w, req)
+	assert.EqualValues(t, http.StatusNotFound, w.Code)
+	assert.EqualValues(t, "application/json", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, "{\"message\":\"path not found: /unknown\"}\n", w.Body.String())
+}
+
+func testAcceptQuoteFromTheFuture(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	quote := testQuotes[0]
+	body := fmt.Sprintf("{\"quoteHash\":\"%v\"}", hash)
+
+	for _, tt := range []struct {
+		tolerance uint
+		expected  string
+	}{
+		{60, "quote agreement timestamp is in the future; the clocks of the server instances may be out of sync\n"},
+		{300, "insufficient liquidity\n"},
+		// disabled
+		{0, "insufficient liquidity\n"},
+	} {
+		rsk := new(testmocks.RskMock)
+		btc := new(testmocks.BtcMock)
+		db := testmocks.NewDbMock(hash, quote)
+		srv := newServer(rsk, btc, db, Config{FutureQuoteTolerance: tt.tolerance}, prometheus.NewRegistry(), func() time.Time {
+			return time.Unix(int64(quote.AgreementTimestamp), 0).Add(-120 * time.Second)
+		})
+		for _, lp := range providerMocks {
+			rsk.On("GetCollateral", lp.address).Times(1).Return(big.NewInt(10), big.NewInt(10))
+			err := srv.AddProvider(lp)
+			if err != nil {
+				t.Fatalf("couldn't add provider. error: %v", err)
+			}
+		}
+		req, err := http.NewRequest("POST", "acceptQuote", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("couldn't instantiate request. error: %v", err)
+		}
+		w := http2.TestResponseWriter{}
+		rsk.On("GetLBCAddress").Return(quote.LBCAddr)
+		db.On("GetQuote", hash).Times(1).Return(quote, nil)
+		rsk.On("FetchFederationInfo").Return(&connectors.FedInfo{FedAddress: quote.FedBTCAddr}, nil)
+		btc.On("GetDerivedBitcoinAddress", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return("")
+		rsk.On("GasPrice")
+		rsk.On("GetBlockNumber").Return(uint64(4000000), nil)
+		rsk.On("GetAvailableLiquidity", quote.LPRSKAddr).Return(big.NewInt(0), nil)
+		db.On("GetRetainedQuote", hash)
+		db.On("GetLockedLiquidity", quote.LPRSKAddr)
+		srv.acceptQuoteHandler(&w, req)
+		assert.EqualValues(t, http.StatusConflict, w.StatusCode, tt.tolerance)
+		assert.EqualValues(t, tt.expected, w.Output, tt.tolerance)
+	}
+}
+
+func testAddQuoteExpiration(t *testing.T) {
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock("", testQuotes[0])
+	srv := newServer(rsk, btc, db, Config{QuoteExpiration: true, ClockSkewTolerance: 30}, prometheus.NewRegistry(), time.Now)
+
+	quote := testQuotes[0]
+	expTime := getQuoteExpTime(quote)
+	rsk.On("GetRequiredBridgeConfirmations").Return(int64(10))
+	rsk.On("GetLatestBlockTime").Return(expTime.Add(-100*time.Second), nil).Times(1)
+	res := srv.newQuoteResponses([]*types.Quote{quote})
+	err := srv.addQuoteExpiration(context.Background(), res)
+	assert.Nil(t, err)
+	assert.Len(t, res, 1)
+	assert.Equal(t, quote, res[0].Quote)
+	assert.EqualValues(t, 10, res[0].RequiredBridgeConfirmations)
+	assert.EqualValues(t, 130, res[0].AcceptExpiresInSeconds)
+	assert.EqualValues(t, 100, res[0].DepositExpiresInSeconds)
+
+	rsk.On("GetLatestBlockTime").Return(expTime.Add(10*time.Second), nil).Times(1)
+	res = srv.newQuoteResponses([]*types.Quote{quote})
+	err = srv.addQuoteExpiration(context.Background(), res)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 20, res[0].AcceptExpiresInSeconds)
+	assert.EqualValues(t, 0, res[0].DepositExpiresInSeconds)
+	rsk.AssertExpectations(t)
+
+	// the offset delays the start of the deposit window, not the deadline
+	srv = newServer(rsk, btc, db, Config{QuoteExpiration: true, ClockSkewTolerance: 30, DepositWindowOffset: 40}, prometheus.NewRegistry(), time.Now)
+	rsk.On("GetLatestBlockTime").Return(expTime.Add(-100*time.Second), nil).Times(1)
+	res = srv.newQuoteResponses([]*types.Quote{quote})
+	err = srv.addQuoteExpiration(context.Background(), res)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 90, res[0].AcceptExpiresInSeconds)
+	assert.EqualValues(t, 60, res[0].DepositExpiresInSeconds)
+}
+
+func testSignQuoteRetries(t *testing.T) {
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock("", testQuotes[0])
+	srv := newServer(rsk, btc, db, Config{SignRetries: 2}, prometheus.NewRegistry(), time.Now)
+	var backoffs []time.Duration
+	srv.sleep = func(d time.Duration) { backoffs = append(backoffs, d) }
+
+	p := &flakySignerMock{failures: 2}
+	signB, err := srv.signQuote(p, []byte{}, "", types.NewWei(0))
+	assert.Nil(t, err)
+	assert.EqualValues(t, []byte{1}, signB)
+	assert.EqualValues(t, 3, p.calls)
+	assert.EqualValues(t, []time.Duration{time.Second, 2 * time.Second}, backoffs)
+
+	p = &flakySignerMock{failures: 3}
+	_, err = srv.signQuote(p, []byte{}, "", types.NewWei(0))
+	assert.True(t, errors.Is(err, ErrSigningUnavailable))
+	assert.EqualValues(t, "signing unavailable: signer timeout", err.Error())
+
+	srv = newServer(rsk, btc, db, Config{}, prometheus.NewRegistry(), time.Now)
+	p = &flakySignerMock{failures: 1}
+	_, err = srv.signQuote(p, []byte{}, "", types.NewWei(0))
+	assert.EqualValues(t, "signer timeout", err.Error())
+	assert.EqualValues(t, 1, p.calls)
+}
+
+func testDecodeRequest(t *testing.T) {
+	body := "{\"quoteHash\":\"abc\",\"extra\":1}"
+	for _, tt := range []struct {
+		lenient  []string
+		expected string
+	}{
+		{nil, "json: unknown field \"extra\""},
+		{[]string{"getQuote"}, "json: unknown field \"extra\""},
+		{[]string{"acceptQuote"}, ""},
+	} {
+		srv := New(new(testmocks.RskMock), new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{LenientEndpoints: tt.lenient}, prometheus.NewRegistry())
+		req := acceptReq{}
+		err := srv.decodeRequest(httptest.NewRequest(http.MethodPost, "/acceptQuote", bytes.NewReader([]byte(body))), "acceptQuote", &req)
+		if tt.expected == "" {
+			assert.Nil(t, err)
+			assert.EqualValues(t, "abc", req.QuoteHash)
+		} else {
+			assert.EqualError(t, err, tt.expected)
+		}
+	}
+}
+
+func testStoreQuoteHashCollision(t *testing.T) {
+	hash := ""
+	stored := *testQuotes[0]
+	q := *testQuotes[0]
+	q.LPRSKAddr = providerMocks[0].address
+
+	rsk := new(testmocks.RskMock)
+	db := testmocks.NewDbMock("", nil)
+	srv := New(rsk, new(testmocks.BtcMock), db, Config{}, prometheus.NewRegistry())
+	rsk.On("HashQuote", &q).Return(hash, nil)
+	db.On("GetQuote", hash).Return(&stored)
+	_, err := srv.storeQuote(context.Background(), &q, nil)
+	assert.True(t, errors.Is(err, ErrQuoteHashCollision))
+	db.AssertNotCalled(t, "InsertQuote", hash, &q)
+
+	q.LPRSKAddr = stored.LPRSKAddr
+	_, err = srv.storeQuote(context.Background(), &q, nil)
+	assert.Nil(t, err)
+	db.AssertNotCalled(t, "InsertQuote", hash, &q)
+}
+
+func testCleanExpiredQuotes(t *testing.T) {
+	now := time.Unix(1650000000, 0)
+	cutoff := now.Add(-quoteExpTimeThreshold)
+	db := testmocks.NewDbMock("", nil)
+	srv := newServer(new(testmocks.RskMock), new(testmocks.BtcMock), db, Config{}, prometheus.NewRegistry(), func() time.Time {
+		return now
+	})
+
+	db.On("GetExpiredQuotes", cutoff).Times(1)
+	err := srv.cleanExpiredQuotes()
+	assert.Nil(t, err)
+	db.AssertNotCalled(t, "DeleteExpiredQuotes", cutoff.Unix())
+
+	db = testmocks.NewDbMock("", nil)
+	srv = newServer(new(testmocks.RskMock), new(testmocks.BtcMock), db, Config{}, prometheus.NewRegistry(), func() time.Time {
+		return now
+	})
+	db.On("GetExpiredQuotes", cutoff).Times(1).Return([]string{"555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"})
+	db.On("DeleteExpiredQuotes", cutoff.Unix()).Times(1)
+	err = srv.cleanExpiredQuotes()
+	assert.Nil(t, err)
+	db.AssertExpectations(t)
+}
+
+func testPruneRetainedQuotes(t *testing.T) {
+	now := time.Unix(1650000000, 0)
+	db := testmocks.NewDbMock("", nil)
+	srv := newServer(new(testmocks.RskMock), new(testmocks.BtcMock), db, Config{}, prometheus.NewRegistry(), func() time.Time {
+		return now
+	})
+
+	// accepted quotes are kept forever by default
+	err := srv.pruneRetainedQuotes()
+	assert.Nil(t, err)
+	db.AssertNotCalled(t, "DeleteRetainedQuotes", mock.Anything, mock.Anything)
+
+	db = testmocks.NewDbMock("", nil)
+	cfg := Config{Retention: RetentionConfig{Created: 60, Expired: 3600, Failed: 86400}}
+	srv = newServer(new(testmocks.RskMock), new(testmocks.BtcMock), db, cfg, prometheus.NewRegistry(), func() time.Time {
+		return now
+	})
+	db.On("DeleteRetainedQuotes", []types.RQState{types.RQStateTimeForDepositElapsed}, now.Add(-time.Hour)).Return(int64(2), nil).Times(1)
+	db.On("DeleteRetainedQuotes", []types.RQState{types.RQStateCallForUserFailed, types.RQStateRegisterPegInFailed}, now.Add(-24*time.Hour)).Return(int64(0), nil).Times(1)
+	err = srv.pruneRetainedQuotes()
+	assert.Nil(t, err)
+	db.AssertExpectations(t)
+	db.AssertNumberOfCalls(t, "DeleteRetainedQuotes", 2)
+
+	cutoff := now.Add(-time.Minute)
+	db.On("GetExpiredQuotes", cutoff).Times(1)
+	err = srv.cleanExpiredQuotes()
+	assert.Nil(t, err)
+	db.AssertExpectations(t)
+}
+
+func testQuoteRetentionOnMemoryDB(t *testing.T) {
+	now := time.Unix(1650000000, 0)
+	db := storage.NewMemoryDB()
+	cfg := Config{Retention: RetentionConfig{Expired: 3600}}
+	srv := newServer(new(testmocks.RskMock), new(testmocks.BtcMock), db, cfg, prometheus.NewRegistry(), func() time.Time {
+		return now
+	})
+	// every quote's deposit time elapsed two hours ago
+	q := *testQuotes[0]
+	q.AgreementTimestamp = 1650000000 - 3*3600
+	q.TimeForDeposit = 3600
+	states := map[string]types.RQState{
+		"b": types.RQStateRegisterPegInSucceeded,
+		"c": types.RQStateTimeForDepositElapsed,
+		"d": types.RQStateWaitingForDeposit,
+	}
+	for _, hash := range []string{"a", "b", "c", "d"} {
+		err := db.InsertQuote(hash, &q)
+		assert.Nil(t, err)
+		if state, ok := states[hash]; ok {
+			err = db.RetainQuote(&types.RetainedQuote{QuoteHash: hash, ReqLiq: types.NewWei(1), State: state})
+			assert.Nil(t, err)
+		}
+	}
+
+	err := srv.cleanExpiredQuotes()
+	assert.Nil(t, err)
+	err = srv.pruneRetainedQuotes()
+	assert.Nil(t, err)
+	for hash, kept := range map[string]bool{"a": false, "b": true, "c": false, "d": true} {
+		stored, err := db.GetQuote(hash)
+		assert.Nil(t, err)
+		assert.EqualValues(t, kept, stored != nil, hash)
+	}
+	counts, err := db.CountRetainedQuotes()
+	assert.Nil(t, err)
+	assert.EqualValues(t, map[types.RQState]int{types.RQStateRegisterPegInSucceeded: 1, types.RQStateWaitingForDeposit: 1}, counts)
+}
+
+func testSweepExpiredQuotes(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	quote := testQuotes[0]
+	expTime := getQuoteExpTime(quote)
+	now := expTime.Add(-time.Second)
+	rsk := new(testmocks.RskMock)
+	db := testmocks.NewDbMock(hash, quote)
+	srv := newServer(rsk, new(testmocks.BtcMock), db, Config{}, prometheus.NewRegistry(), func() time.Time {
+		return now
+	})
+	db.On("GetRetainedQuotes", []types.RQState{types.RQStateWaitingForDeposit})
+	db.On("GetQuote", hash)
+	db.On("UpdateRetainedQuoteState", hash, types.RQStateWaitingForDeposit, types.RQStateTimeForDepositElapsed).Times(1)
+
+	err := srv.sweepExpiredQuotes()
+	assert.Nil(t, err)
+	db.AssertNotCalled(t, "UpdateRetainedQuoteState", hash, types.RQStateWaitingForDeposit, types.RQStateTimeForDepositElapsed)
+
+	now = expTime.Add(time.Second)
+	srv.watchers[hash] = &BTCAddressWatcher{}
+	err = srv.sweepExpiredQuotes()
+	assert.Nil(t, err)
+	db.AssertNotCalled(t, "UpdateRetainedQuoteState", hash, types.RQStateWaitingForDeposit, types.RQStateTimeForDepositElapsed)
+
+	delete(srv.watchers, hash)
+	err = srv.sweepExpiredQuotes()
+	assert.Nil(t, err)
+	db.AssertExpectations(t)
+	assert.EqualValues(t, 1, testutil.ToFloat64(srv.metrics.expiredQuotes))
+}
+
+func testServerTiming(t *testing.T) {
+	srv := New(new(testmocks.RskMock), new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{}, prometheus.NewRegistry())
+	timing := srv.newServerTiming()
+	assert.Nil(t, timing)
+	timing.measure("rsk")()
+	w := httptest.NewRecorder()
+	timing.writeHeader(w)
+	assert.Empty(t, w.Header().Get("Server-Timing"))
+
+	srv = New(new(testmocks.RskMock), new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{ServerTiming: true}, prometheus.NewRegistry())
+	timing = srv.newServerTiming()
+	timing.add("rsk", 12*time.Millisecond)
+	timing.add("db", 1500*time.Microsecond)
+	timing.add("rsk", 3*time.Millisecond)
+	w = httptest.NewRecorder()
+	timing.writeHeader(w)
+	assert.EqualValues(t, "rsk;dur=15.000, db;dur=1.500", w.Header().Get("Server-Timing"))
+}
+
+func testMetrics(t *testing.T) {
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock("", testQuotes[0])
+	srv := New(rsk, btc, db, Config{}, prometheus.NewRegistry())
+	other := New(rsk, btc, db, Config{}, prometheus.NewRegistry())
+	srv.metrics.quotes.Add(2)
+	other.metrics.quotes.Add(5)
+
+	w := httptest.NewRecorder()
+	srv.newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "lps_quotes_total 2\n")
+	assert.Contains(t, w.Body.String(), "lps_accepted_quotes_total 0\n")
+
+	w = httptest.NewRecorder()
+	srv.newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/getQuote", strings.NewReader("{")))
+	assert.EqualValues(t, http.StatusBadRequest, w.Code)
+	w = httptest.NewRecorder()
+	srv.newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, w.Body.String(), "lps_quote_requests_total 1\n")
+	assert.Contains(t, w.Body.String(), "lps_handler_duration_seconds_count{handler=\"getQuote\"} 1\n")
+}
+
+func testNodeInfo(t *testing.T) {
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock("", testQuotes[0])
+	srv := New(rsk, btc, db, Config{}, prometheus.NewRegistry())
+
+	info := connectors.NodeInfo{ClientVersion: "RskJ/3.1.0/Linux/Java1.8/IRIS-20a3b9c", ChainId: big.NewInt(31), Network: "testnet"}
+	rsk.On("NodeInfo", mock.Anything).Return(info, nil).Times(1)
+	w := httptest.NewRecorder()
+	srv.newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/node", nil))
+	rsk.AssertExpectations(t)
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, "application/json", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, "{\"clientVersion\":\"RskJ/3.1.0/Linux/Java1.8/IRIS-20a3b9c\",\"chainId\":31,\"network\":\"testnet\"}\n", w.Body.String())
+
+	rsk.On("NodeInfo", mock.Anything).Return(connectors.NodeInfo{}, errors.New("rpc error")).Times(1)
+	w = httptest.NewRecorder()
+	srv.newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/node", nil))
+	assert.EqualValues(t, http.StatusInternalServerError, w.Code)
+	assert.EqualValues(t, "internal server error\n", w.Body.String())
+}
+
+func testProviderManagement(t *testing.T) {
+	rsk := new(testmocks.RskMock)
+	srv := New(rsk, new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{}, prometheus.NewRegistry())
+	for _, lp := range providerMocks {
+		rsk.On("GetCollateral", lp.address).Times(1).Return(big.NewInt(10), big.NewInt(10))
+		err := srv.AddProvider(lp)
+		if err != nil {
+			t.Fatalf("couldn't add provider. error: %v", err)
+		}
+	}
+	snapshot := srv.Providers()
+	assert.Len(t, snapshot, 2)
+
+	err := srv.AddProvider(LiquidityProviderMock{address: strings.ToLower(providerMocks[1].address)})
+	assert.True(t, errors.Is(err, ErrDuplicateProvider))
+	assert.Len(t, srv.Providers(), 2)
+	rsk.AssertExpectations(t)
+
+	assert.True(t, srv.RemoveProvider(strings.ToUpper(providerMocks[0].address)))
+	assert.False(t, srv.RemoveProvider(providerMocks[0].address))
+	assert.EqualValues(t, []providers.LiquidityProvider{providerMocks[1]}, srv.Providers())
+	assert.Nil(t, srv.getProvider(providerMocks[0].address))
+	// snapshots taken before aren't affected
+	assert.EqualValues(t, []providers.LiquidityProvider{providerMocks[0], providerMocks[1]}, snapshot)
+
+	rsk.On("GetCollateral", providerMocks[0].address).Times(1).Return(big.NewInt(10), big.NewInt(10))
+	assert.Nil(t, srv.AddProvider(providerMocks[0]))
+	assert.Len(t, srv.Providers(), 2)
+}
+
+func testProviderBalance(t *testing.T) {
+	rsk := new(testmocks.RskMock)
+	srv := New(rsk, new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{}, prometheus.NewRegistry())
+	for _, lp := range providerMocks[:2] {
+		rsk.On("GetCollateral", lp.address).Return(nil)
+		err := srv.AddProvider(lp)
+		if err != nil {
+			t.Fatalf("couldn't add provider. error: %v", err)
+		}
+	}
+	bal, _ := new(big.Int).SetString("1500000000000000000", 10)
+	rsk.On("GetBalance", providerMocks[0].address).Return(bal, nil)
+	rsk.On("GetBalance", providerMocks[1].address).Return(big.NewInt(0), nil)
+
+	for _, tt := range []struct {
+		query  string
+		code   int
+		output string
+	}{
+		{"", http.StatusOK, fmt.Sprintf("[{\"address\":\"%v\",\"balance\":1500000000000000000,\"rbtc\":\"1.5\"},"+
+			"{\"address\":\"%v\",\"balance\":0,\"rbtc\":\"0\"}]\n", providerMocks[0].address, providerMocks[1].address)},
+		{"?address=" + strings.ToLower(providerMocks[1].address), http.StatusOK,
+			fmt.Sprintf("[{\"address\":\"%v\",\"balance\":0,\"rbtc\":\"0\"}]\n", providerMocks[1].address)},
+		{"?address=0x5F3b836CA64DA03e613887B46f71D168FC8B5Bdf", http.StatusNotFound, "provider not found\n"},
+		{"?address=0x123", http.StatusBadRequest, "bad request; invalid address\n"},
+	} {
+		w := httptest.NewRecorder()
+		srv.newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/providers/balance"+tt.query, nil))
+		assert.EqualValues(t, tt.code, w.Code, tt.query)
+		assert.EqualValues(t, tt.output, w.Body.String(), tt.query)
+	}
+
+	rsk = new(testmocks.RskMock)
+	srv = New(rsk, new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{}, prometheus.NewRegistry())
+	rsk.On("GetCollateral", providerMocks[0].address).Return(nil)
+	err := srv.AddProvider(providerMocks[0])
+	if err != nil {
+		t.Fatalf("couldn't add provider. error: %v", err)
+	}
+	rsk.On("GetBalance", providerMocks[0].address).Return((*big.Int)(nil), fmt.Errorf("error getting balance: %w", connectors.ErrNodeUnavailable))
+	w := httptest.NewRecorder()
+	srv.newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/providers/balance", nil))
+	assert.EqualValues(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func testProviders(t *testing.T) {
+	rsk := new(testmocks.RskMock)
+	srv := New(rsk, new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{}, prometheus.NewRegistry())
+	lps := []providers.LiquidityProvider{
+		limitedProviderMock{providerMocks[0], 600000000000000000, 3000000000000000000},
+		namedProviderMock{providerMocks[1], "Acme"},
+	}
+	for _, lp := range lps {
+		rsk.On("GetCollateral", lp.Address()).Return(nil)
+		err := srv.AddProvider(lp)
+		if err != nil {
+			t.Fatalf("couldn't add provider. error: %v", err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	srv.newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/providers", nil))
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, "application/json", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, fmt.Sprintf("[{\"address\":\"%v\",\"minTransactionValue\":600000000000000000,"+
+		"\"maxTransactionValue\":3000000000000000000,\"callFee\":1000},{\"address\":\"%v\",\"name\":\"Acme\"}]\n",
+		providerMocks[0].address, providerMocks[1].address), w.Body.String())
+}
+
+func testStatus(t *testing.T) {
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock("", testQuotes[0])
+	now := time.Unix(1000, 0)
+	srv := newServer(rsk, btc, db, Config{}, prometheus.NewRegistry(), func() time.Time { return now })
+	lp := providerMocks[1]
+	rsk.On("GetCollateral", lp.address).Times(3)
+	err := srv.AddProvider(lp)
+	if err != nil {
+		t.Fatalf("couldn't add provider: %v", err)
+	}
+
+	info := connectors.NodeInfo{ClientVersion: "RskJ/3.1.0/Linux/Java1.8/IRIS-20a3b9c", ChainId: big.NewInt(31), Network: "testnet"}
+	rsk.On("NodeInfo", mock.Anything).Return(info, nil).Times(2)
+	rsk.On("GetFedSize").Return(15).Times(2)
+	rsk.On("GasPrice").Times(2)
+	rsk.On("GetAvailableLiquidity", lp.address).Return(big.NewInt(500), nil).Times(2)
+	db.On("GetLockedLiquidity", lp.address).Times(2)
+	db.On("GetRetainedQuotes", []types.RQState{types.RQStateWaitingForDeposit, types.RQStateCallForUserSucceeded}).Times(2)
+	db.On("CountRetainedQuotes").Return(map[types.RQState]int{types.RQStateWaitingForDeposit: 1, types.RQStateRegisterPegInSucceeded: 4}, nil).Times(2)
+
+	expected := "{\"node\":{\"clientVersion\":\"RskJ/3.1.0/Linux/Java1.8/IRIS-20a3b9c\",\"chainId\":31,\"network\":\"testnet\"}," +
+		"\"federationSize\":15,\"providers\":[{\"address\":\"0x00d80aA033fb51F191563B08Dc035fA128e942C5\",\"collateral\":10," +
+		"\"minCollateral\":10,\"availableLiquidity\":500,\"lockedLiquidity\":0}],\"pendingQuotes\":{\"0\":1,\"2\":0}," +
+		"\"retainedQuotes\":{\"0\":1,\"4\":4}," +
+		"\"gasPrice\":100000,\"updatedAt\":1000}\n"
+	w := httptest.NewRecorder()
+	srv.newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/status", nil))
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, "application/json", w.Header().Get("Content-Type"))
+	assert.EqualValues(t, expected, w.Body.String())
+
+	// served from the cache until it's stale
+	now = now.Add(statusCacheTTL - time.Second)
+	w = httptest.NewRecorder()
+	srv.newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/status", nil))
+	assert.EqualValues(t, expected, w.Body.String())
+	rsk.AssertNumberOfCalls(t, "NodeInfo", 1)
+
+	now = now.Add(time.Second)
+	w = httptest.NewRecorder()
+	srv.newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/status", nil))
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	rsk.AssertExpectations(t)
+	db.AssertExpectations(t)
+}
+
+func testStartWithoutProviders(t *testing.T) {
+	rsk := new(testmocks.RskMock)
+	btc := new(testmocks.BtcMock)
+	db := testmocks.NewDbMock("", testQuotes[0])
+	srv := New(rsk, btc, db, Config{}, prometheus.NewRegistry())
+
+	err := srv.Start("", 0)
+	assert.True(t, errors.Is(err, ErrNoProviders))
+	db.AssertNotCalled(t, "GetRetainedQuotes", mock.Anything)
+}
+
+func testReady(t *testing.T) {
+	rsk := new(testmocks.RskMock)
+	srv := New(rsk, new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{}, prometheus.NewRegistry())
+	rsk.On("FedCacheStatus").Return(connectors.FedCachePartial)
+
+	w := httptest.NewRecorder()
+	srv.newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.EqualValues(t, http.StatusServiceUnavailable, w.Code)
+	assert.EqualValues(t, "{\"ready\":false,\"federationCache\":\"partial\"}\n", w.Body.String())
+
+	rsk.On("GetCollateral", providerMocks[0].address).Return(big.NewInt(10), big.NewInt(10))
+	err := srv.AddProvider(providerMocks[0])
+	if err != nil {
+		t.Fatalf("couldn't add provider: %v", err)
+	}
+	w = httptest.NewRecorder()
+	srv.newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, "{\"ready\":true,\"federationCache\":\"partial\"}\n", w.Body.String())
+}
+
+func testRequestID(t *testing.T) {
+	srv := New(new(testmocks.RskMock), new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{}, prometheus.NewRegistry())
+	h := withRequestID(srv.newRouter())
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	id := w.Header().Get(requestIDHeader)
+	assert.Len(t, id, 32)
+	assert.EqualValues(t, fmt.Sprintf("{\"message\":\"path not found: /unknown\",\"requestId\":\"%v\"}\n", id), w.Body.String())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	assert.NotEqual(t, id, w.Header().Get(requestIDHeader))
+
+	req := httptest.NewRequest(http.MethodGet, "/unknown", nil)
+	req.Header.Set(requestIDHeader, "lb-1234.abcd")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.EqualValues(t, "lb-1234.abcd", w.Header().Get(requestIDHeader))
+	assert.Contains(t, w.Body.String(), "\"requestId\":\"lb-1234.abcd\"")
+
+	req.Header.Set(requestIDHeader, "bad id\nINFO forged log line")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Len(t, w.Header().Get(requestIDHeader), 32)
+}
+
+func testRequestLogger(t *testing.T) {
+	srv := New(new(testmocks.RskMock), new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{}, prometheus.NewRegistry())
+	h := withRequestID(handlers.CustomLoggingHandler(io.Discard, srv.newRouter(), logAccess))
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.DebugLevel)
+	defer logrus.SetLevel(level)
+
+	req := httptest.NewRequest(http.MethodPost, "/getQuote", strings.NewReader("{"))
+	req.Header.Set(requestIDHeader, "lb-1234.abcd")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.EqualValues(t, http.StatusBadRequest, w.Code)
+
+	entries := hook.AllEntries()
+	if len(entries) < 2 {
+		t.Fatalf("expected the handler and access logs, got %v entries", len(entries))
+	}
+	for _, e := range entries {
+		assert.EqualValues(t, "lb-1234.abcd", e.Data["requestId"], e.Message)
+	}
+	access := hook.LastEntry()
+	assert.EqualValues(t, "request served", access.Message)
+	assert.EqualValues(t, "/getQuote", access.Data["path"])
+	assert.EqualValues(t, http.StatusBadRequest, access.Data["status"])
+
+	assert.NotContains(t, requestLogger(httptest.NewRequest(http.MethodGet, "/readyz", nil)).Data, "requestId")
+}
+
+func testListenAddress(t *testing.T) {
+	addr, err := listenAddress("", 8080)
+	assert.Nil(t, err)
+	assert.Equal(t, ":8080", addr)
+
+	addr, err = listenAddress("127.0.0.1", 8080)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:8080", addr)
+
+	addr, err = listenAddress("::1", 8080)
+	assert.Nil(t, err)
+	assert.Equal(t, "[::1]:8080", addr)
+
+	for _, host := range []string{"127.0.0.1:8080", "not a host", "a..b"} {
+		_, err = listenAddress(host, 8080)
+		assert.True(t, errors.Is(err, ErrInvalidListenAddress), host)
+	}
+}
+
+func testWebhookDelivery(t *testing.T) {
+	secret := "s3cr3t"
+	attempts := 0
+	var received []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received, _ = io.ReadAll(r.Body)
+		assert.EqualValues(t, signWebhookPayload(secret, received), r.Header.Get(webhookSignatureHeader))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	var backoffs []time.Duration
+	n := newWebhookNotifier(WebhookConfig{URL: ts.URL, Secret: secret, MaxRetries: 3}, time.Now)
+	n.sleep = func(d time.Duration) { backoffs = append(backoffs, d) }
+
+	payload := []byte("{\"event\":\"accepted\"}")
+	assert.Nil(t, n.deliver(payload))
+	assert.EqualValues(t, 3, attempts)
+	assert.EqualValues(t, payload, received)
+	assert.EqualValues(t, []time.Duration{time.Second, 2 * time.Second}, backoffs)
+
+	attempts = -10
+	assert.EqualValues(t, "unexpected response status: 503", n.deliver(payload).Error())
+}
+
+func testPendingConfirmations(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	rsk := new(testmocks.RskMock)
+	srv := New(rsk, new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{}, prometheus.NewRegistry())
+	assert.EqualValues(t, defaultRskConfirmations, srv.rskConfirmations())
+
+	pending := &BTCAddressWatcher{rskConfirmations: 6}
+	pending.setPendingTx(&pendingTx{TxHash: "0xabcd", TxType: txTypeCallForUser, Confirmations: 2, Pending: 4})
+	srv.watchers[hash] = pending
+	srv.watchers["other"] = &BTCAddressWatcher{}
+	w := httptest.NewRecorder()
+	srv.newRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/confirmations", nil))
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, fmt.Sprintf("{\"%v\":{\"txHash\":\"0xabcd\",\"txType\":\"callForUser\",\"confirmations\":2,\"pendingConfirmations\":4}}\n", hash), w.Body.String())
+
+	// the transaction is tracked while it's waited for
+	tx := gethTypes.NewTransaction(7, common.HexToAddress(testQuotes[0].LBCAddr), big.NewInt(0), 250000, big.NewInt(60000000), nil)
+	watcher := &BTCAddressWatcher{rsk: rsk, rskConfirmations: 3}
+	rsk.On("WaitForTx", mock.Anything, tx, uint64(3)).Return(true, nil)
+	ok, err := watcher.waitForTx(context.Background(), tx, txTypeRegisterPegIn)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Nil(t, watcher.pendingConfirmations())
+	rsk.AssertExpectations(t)
+}
+
+func testTxFailure(t *testing.T) {
+	tx := gethTypes.NewTransaction(7, common.HexToAddress(testQuotes[0].LBCAddr), big.NewInt(0), 250000, big.NewInt(60000000), nil)
+	err := txFailure(tx, nil)
+	assert.True(t, errors.Is(err, connectors.ErrTxReverted))
+	assert.Contains(t, err.Error(), tx.Hash().Hex())
+
+	err = txFailure(tx, errors.New("operation cancelled"))
+	assert.True(t, errors.Is(err, connectors.ErrTxNotMined))
+	assert.False(t, errors.Is(err, connectors.ErrTxReverted))
+}
+
+func testDepositEvents(t *testing.T) {
+	hash := "555c9cfba7638a40a71a17a34fef0c3e192c1fbf4b311ad6e2ae288e97794228"
+	srv := New(new(testmocks.RskMock), new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{}, prometheus.NewRegistry())
+	ts := httptest.NewServer(srv.newRouter())
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/deposits"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("couldn't connect. error: %v", err)
+	}
+	defer conn.Close()
+	assert.Nil(t, conn.WriteJSON(depositSubscribeReq{QuoteHashes: []string{"0x" + strings.ToUpper(hash)}}))
+	// the subscription is processed asynchronously
+	assert.Eventually(t, func() bool {
+		srv.depositEvents.publish(newDepositEvent("aaaa", "bbbb", 1, 10))
+		srv.depositEvents.publish(newDepositEvent(hash, "abcd", 1, 10))
+		var e depositEvent
+		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		return conn.ReadJSON(&e) == nil && e == depositEvent{Type: depositEventConfirmation, QuoteHash: hash, TxHash: "abcd", Confirmations: 1}
+	}, time.Second, 10*time.Millisecond)
+
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("couldn't connect. error: %v", err)
+	}
+	defer conn.Close()
+	assert.Nil(t, conn.WriteJSON(depositSubscribeReq{QuoteHashes: []string{"abcd"}}))
+	var res errorRes
+	assert.Nil(t, conn.ReadJSON(&res))
+	assert.EqualValues(t, "invalid quote hash: abcd", res.Message)
+
+	assert.EqualValues(t, depositEventReady, newDepositEvent(hash, "abcd", 10, 10).Type)
+	var nilBus *depositEventBus
+	nilBus.publish(newDepositEvent(hash, "abcd", 10, 10))
+}
+
+func testTxSubmittedEvents(t *testing.T) {
+	srv := New(new(testmocks.RskMock), new(testmocks.BtcMock), testmocks.NewDbMock("", nil), Config{}, prometheus.NewRegistry())
+	var received []txSubmittedEvent
+	srv.txEvents.subscribe(func(e txSubmittedEvent) {
+		received = append(received, e)
+	})
+
+	tx := gethTypes.NewTransaction(7, common.HexToAddress(testQuotes[0].LBCAddr), big.NewInt(0), 250000, big.NewInt(60000000), nil)
+	srv.txEvents.publish(newTxSubmittedEvent("abcd", txTypeCallForUser, tx))
+	srv.txEvents.publish(newTxSubmittedEvent("abcd", txTypeRegisterPegIn, tx))
+
+	assert.Len(t, received, 2)
+	assert.EqualValues(t, "abcd", received[0].QuoteHash)
+	assert.EqualValues(t, tx.Hash().Hex(), received[0].TxHash)
+	assert.EqualValues(t, txTypeCallForUser, received[0].TxType)
+	assert.EqualValues(t, big.NewInt(60000000), received[0].GasPrice)
+	assert.EqualValues(t, 7, received[0].Nonce)
+	assert.EqualValues(t, txTypeRegisterPegIn, received[1].TxType)
+	assert.EqualValues(t, 1, testutil.ToFloat64(srv.metrics.submittedTxs.WithLabelValues(txTypeCallForUser)))
+	assert.EqualValues(t, 1, testutil.ToFloat64(srv.metrics.submittedTxs.WithLabelValues(txTypeRegisterPegIn)))
+
+	var nilBus *txEventBus
+	nilBus.publish(newTxSubmittedEvent("abcd", txTypeCallForUser, tx))
+}
+
+func testWebhookEventForState(t *testing.T) {
+	var states = []struct {
+		state    types.RQState
+		expected string
+	}{
+		{types.RQStateWaitingForDeposit, WebhookEventAccepted},
+		{types.RQStateCallForUserSucceeded, WebhookEventCompleted},
+		{types.RQStateRegisterPegInSucceeded, WebhookEventPegInRegistered},
+		{types.RQStateCallForUserFailed, WebhookEventFailed},
+		{types.RQStateRegisterPegInFailed, WebhookEventFailed},
+		{types.RQStateTimeForDepositElapsed, WebhookEventExpired},
+	}
+	for _, tt := range states {
+		event, ok := webhookEventForState(tt.state)
+		assert.True(t, ok)
+		assert.EqualValues(t, tt.expected, event)
+	}
 }
 
 func TestLiquidityProviderServer(t *testing.T) {
@@ -353,11 +2666,75 @@ func TestLiquidityProviderServer(t *testing.T) {
 	t.Run("check health", testCheckHealth)
 	t.Run("get provider should return null when provider not found", testGetProviderByAddressWhenNotFoundShouldReturnNull)
 	t.Run("get quote", testGetQuoteComplete)
+	t.Run("get quote sending data to an account", testGetQuoteDataToAccount)
+	t.Run("get quote with a reserved call target", testGetQuoteReservedCallTarget)
+	t.Run("get quote with too much call data", testGetQuoteCallDataTooLarge)
+	t.Run("get quote with a store failure", testGetQuoteStoreFailure)
+	t.Run("get quote by provider", testGetQuoteByProvider)
+	t.Run("get quote rate limited", testGetQuoteRateLimited)
+	t.Run("validate quote request", testValidateQuoteRequest)
+	t.Run("get quote fee too high", testGetQuoteFeeTooHigh)
+	t.Run("get quote fee below gas cost", testGetQuoteFeeBelowGasCost)
+	t.Run("get quote no liquidity", testGetQuoteNoLiquidity)
+	t.Run("call fee exceeded", testCallFeeExceeded)
+	t.Run("get quote connector errors", testGetQuoteConnectorErrors)
+	t.Run("get quote call reverts", testGetQuoteCallReverts)
+	t.Run("get quote invalid btc refund address", testGetQuoteInvalidBtcRefundAddress)
+	t.Run("quote rate limiter", testQuoteRateLimiter)
+	t.Run("client rate limiter", testClientRateLimiter)
+	t.Run("cors", testCORS)
+	t.Run("get quote with a gas price too high", testGetQuoteGasPriceTooHigh)
+	t.Run("get quote with a contract refund address", testGetQuoteContractRefundAddress)
 	t.Run("accept quote", testAcceptQuoteComplete)
+	t.Run("accept quote with idempotency key", testAcceptQuoteIdempotencyKey)
+	t.Run("accept quote dry run", testAcceptQuoteDryRun)
+	t.Run("accept quote with insufficient liquidity", testAcceptQuoteInsufficientLiquidity)
+	t.Run("accept quote with unavailable federation", testAcceptQuoteFederationUnavailable)
+	t.Run("accept quote past its deadline", testAcceptQuoteDeadlineExceeded)
+	t.Run("accept quote already accepted", testAcceptQuoteAlreadyAccepted)
+	t.Run("accept quote concurrently accepted", testAcceptQuoteConcurrentlyAccepted)
+	t.Run("accept quote foreign LBC", testAcceptQuoteForeignLBC)
+	t.Run("accept quote watcher limit", testAcceptQuoteWatcherLimit)
+	t.Run("accept quote provider rotated", testAcceptQuoteProviderRotated)
+	t.Run("accept quote derivation failure", testAcceptQuoteDerivationFailure)
+	t.Run("invalidate quotes", testInvalidateQuotes)
+	t.Run("accept quote after a federation change", testAcceptQuoteFederationChanged)
+	t.Run("accept expired quote within clock skew tolerance", testAcceptQuoteExpiredWithinClockSkew)
+	t.Run("accept quote from the future", testAcceptQuoteFromTheFuture)
 	t.Run("init BTC watchers", testInitBtcWatchers)
 	t.Run("get quote exp time", testGetQuoteExpTime)
+	t.Run("normalize quote hash", testNormalizeQuoteHash)
 	t.Run("decode address", testDecodeAddress)
 	t.Run("decode address with an invalid btcRefundAddr", testDecodeAddressWithAnInvalidBtcRefundAddr)
 	t.Run("decode address with an invalid lpBTCAddrB", testDecodeAddressWithAnInvalidLpBTCAddrB)
 	t.Run("decode address with an invalid lbcAddrB", testDecodeAddressWithAnInvalidLbcAddrB)
+	t.Run("method not allowed", testMethodNotAllowed)
+	t.Run("not found", testNotFound)
+	t.Run("add quote expiration", testAddQuoteExpiration)
+	t.Run("sign quote retries", testSignQuoteRetries)
+	t.Run("decode request", testDecodeRequest)
+	t.Run("store quote hash collision", testStoreQuoteHashCollision)
+	t.Run("clean expired quotes", testCleanExpiredQuotes)
+	t.Run("prune retained quotes", testPruneRetainedQuotes)
+	t.Run("quote retention on memory db", testQuoteRetentionOnMemoryDB)
+	t.Run("sweep expired quotes", testSweepExpiredQuotes)
+	t.Run("server timing", testServerTiming)
+	t.Run("metrics", testMetrics)
+	t.Run("node info", testNodeInfo)
+	t.Run("provider management", testProviderManagement)
+	t.Run("providers", testProviders)
+	t.Run("provider balance", testProviderBalance)
+	t.Run("list quotes", testListQuotes)
+	t.Run("status", testStatus)
+	t.Run("start without providers", testStartWithoutProviders)
+	t.Run("listen address", testListenAddress)
+	t.Run("request id", testRequestID)
+	t.Run("request logger", testRequestLogger)
+	t.Run("ready", testReady)
+	t.Run("webhook delivery", testWebhookDelivery)
+	t.Run("webhook event for state", testWebhookEventForState)
+	t.Run("tx submitted events", testTxSubmittedEvents)
+	t.Run("deposit events", testDepositEvents)
+	t.Run("pending confirmations", testPendingConfirmations)
+	t.Run("tx failure", testTxFailure)
 }
@@ -0,0 +1,140 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rsksmart/liquidity-provider-server/connectors"
+	"github.com/rsksmart/liquidity-provider/types"
+)
+
+// statusCacheTTL bounds how often the status summary is rebuilt, so the endpoint can back a frequently refreshed
+// dashboard without hammering the nodes
+const statusCacheTTL = 15 * time.Second
+
+type providerStatus struct {
+	Address            string   `json:"address"`
+	Collateral         *big.Int `json:"collateral"`
+	MinCollateral      *big.Int `json:"minCollateral"`
+	AvailableLiquidity *big.Int `json:"availableLiquidity"`
+	LockedLiquidity    *big.Int `json:"lockedLiquidity"`
+}
+
+type serverStatus struct {
+	Node           connectors.NodeInfo `json:"node"`
+	FederationSize int                 `json:"federationSize"`
+	Providers      []providerStatus    `json:"providers"`
+	PendingQuotes  map[string]int      `json:"pendingQuotes"`
+	RetainedQuotes map[string]int      `json:"retainedQuotes"`
+	GasPrice       *big.Int            `json:"gasPrice"`
+	UpdatedAt      int64               `json:"updatedAt"`
+}
+
+func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	status, err := s.cachedStatus(r.Context())
+	if err != nil {
+		logger.Error("error building status summary: ", err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	err = enc.Encode(status)
+	if err != nil {
+		logger.Error("error encoding status summary: ", err.Error())
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
+
+// cachedStatus returns the last status summary, rebuilding it once it's older than statusCacheTTL. Failed builds are
+// not cached.
+func (s *Server) cachedStatus(ctx context.Context) (*serverStatus, error) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	now := s.now()
+	if s.status != nil && now.Sub(time.Unix(s.status.UpdatedAt, 0)) < statusCacheTTL {
+		return s.status, nil
+	}
+	status, err := s.buildStatus(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	s.status = status
+	return status, nil
+}
+
+func (s *Server) buildStatus(ctx context.Context, now time.Time) (*serverStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	info, err := s.rsk.NodeInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving rsk node info: %v", err)
+	}
+	fedSize, err := s.rsk.GetFedSize(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving federation size: %v", err)
+	}
+	gasPrice, err := s.rsk.GasPrice(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving gas price: %v", err)
+	}
+
+	status := &serverStatus{
+		Node:           info,
+		FederationSize: fedSize,
+		Providers:      make([]providerStatus, 0),
+		PendingQuotes:  make(map[string]int),
+		RetainedQuotes: make(map[string]int),
+		GasPrice:       gasPrice,
+		UpdatedAt:      now.Unix(),
+	}
+	for _, p := range s.Providers() {
+		addr := p.Address()
+		col, minCol, err := s.rsk.GetCollateral(ctx, addr)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving collateral of provider %v: %v", addr, err)
+		}
+		liq, err := s.rsk.GetAvailableLiquidity(ctx, addr)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving available liquidity of provider %v: %v", addr, err)
+		}
+		locked, err := s.db.GetLockedLiquidity(addr)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving locked liquidity of provider %v: %v", addr, err)
+		}
+		status.Providers = append(status.Providers, providerStatus{
+			Address:            addr,
+			Collateral:         col,
+			MinCollateral:      minCol,
+			AvailableLiquidity: liq,
+			LockedLiquidity:    locked.AsBigInt(),
+		})
+	}
+
+	pending := []types.RQState{types.RQStateWaitingForDeposit, types.RQStateCallForUserSucceeded}
+	rqs, err := s.db.GetRetainedQuotes(pending)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving pending quotes: %v", err)
+	}
+	for _, state := range pending {
+		status.PendingQuotes[strconv.Itoa(int(state))] = 0
+	}
+	for _, rq := range rqs {
+		status.PendingQuotes[strconv.Itoa(int(rq.State))]++
+	}
+	counts, err := s.db.CountRetainedQuotes()
+	if err != nil {
+		return nil, fmt.Errorf("error counting retained quotes: %v", err)
+	}
+	for state, n := range counts {
+		status.RetainedQuotes[strconv.Itoa(int(state))] = n
+	}
+	return status, nil
+}
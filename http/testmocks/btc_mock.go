@@ -5,6 +5,7 @@ import (
 	"github.com/btcsuite/btcutil"
 	"github.com/rsksmart/liquidity-provider-server/connectors"
 	"github.com/stretchr/testify/mock"
+	"math/big"
 	"time"
 )
 
@@ -32,6 +33,10 @@ func (b *BtcMock) GetParams() chaincfg.Params {
 	return chaincfg.TestNet3Params
 }
 
+func (b *BtcMock) RPCQueueDepth() int64 {
+	return 0
+}
+
 func (b *BtcMock) RemoveAddressWatcher(address string) {
 	b.Called(address)
 }
@@ -55,7 +60,18 @@ func (b *BtcMock) GetBlockNumberByTx(txHash string) (int64, error) {
 	return 0, nil
 }
 
+func (b *BtcMock) BuildRegisterPegInParams(txHash string) ([]byte, []byte, *big.Int, error) {
+	args := b.Called(txHash)
+	if len(args) > 0 {
+		return args.Get(0).([]byte), args.Get(1).([]byte), args.Get(2).(*big.Int), args.Error(3)
+	}
+	return nil, nil, big.NewInt(0), nil
+}
+
 func (b *BtcMock) GetDerivedBitcoinAddress(fedInfo *connectors.FedInfo, userBtcRefundAddr []byte, lbcAddress []byte, lpBtcAddress []byte, derivationArgumentsHash []byte) (string, error) {
-	b.Called(fedInfo, userBtcRefundAddr, lbcAddress, lpBtcAddress, derivationArgumentsHash)
+	args := b.Called(fedInfo, userBtcRefundAddr, lbcAddress, lpBtcAddress, derivationArgumentsHash)
+	if len(args) > 1 {
+		return args.String(0), args.Error(1)
+	}
 	return "", nil
 }
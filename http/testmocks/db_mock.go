@@ -1,6 +1,9 @@
 package testmocks
 
 import (
+	"time"
+
+	"github.com/rsksmart/liquidity-provider-server/storage"
 	"github.com/rsksmart/liquidity-provider/types"
 	"github.com/stretchr/testify/mock"
 )
@@ -29,13 +32,41 @@ func (d *DbMock) Close() error {
 }
 
 func (d *DbMock) InsertQuote(id string, q *types.Quote) error {
-	d.Called(id, q)
+	args := d.Called(id, q)
+	if len(args) > 0 {
+		if err, ok := args.Get(0).(error); ok {
+			return err
+		}
+	}
 	return nil
 }
 
-func (d *DbMock) GetQuote(quoteHash string) (*types.Quote, error) {
-	d.Called(quoteHash)
-	return d.quote, nil
+// GetQuote returns the record given to Return, or a record wrapping the quote given to Return, which is then not
+// accepted
+func (d *DbMock) GetQuote(quoteHash string) (*storage.RetainedQuote, error) {
+	args := d.Called(quoteHash)
+	q := d.quote
+	if len(args) > 0 {
+		if rq, ok := args.Get(0).(*storage.RetainedQuote); ok {
+			return rq, nil
+		}
+		q, _ = args.Get(0).(*types.Quote)
+	}
+	if q == nil {
+		return nil, nil
+	}
+	return &storage.RetainedQuote{Quote: q}, nil
+}
+
+// GetExpiredQuotes returns the hashes given to Return, if any
+func (d *DbMock) GetExpiredQuotes(now time.Time) ([]string, error) {
+	args := d.Called(now)
+	if len(args) > 0 {
+		if hashes, ok := args.Get(0).([]string); ok {
+			return hashes, nil
+		}
+	}
+	return nil, nil
 }
 
 func (d *DbMock) DeleteExpiredQuotes(expTimestamp int64) error {
@@ -43,13 +74,34 @@ func (d *DbMock) DeleteExpiredQuotes(expTimestamp int64) error {
 	return nil
 }
 
+func (d *DbMock) DeleteProviderQuotes(lpRSKAddr string) (int64, error) {
+	args := d.Called(lpRSKAddr)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+// ListQuotes returns the quotes and total given to Return, if any
+func (d *DbMock) ListQuotes(filter storage.QuoteFilter, limit uint, offset uint) ([]*storage.ListedQuote, int, error) {
+	args := d.Called(filter, limit, offset)
+	if len(args) > 0 {
+		quotes, _ := args.Get(0).([]*storage.ListedQuote)
+		return quotes, args.Int(1), args.Error(2)
+	}
+	return nil, 0, nil
+}
+
 func (d *DbMock) RetainQuote(quote *types.RetainedQuote) error {
 	d.Called(quote)
 	return nil
 }
 
+// GetRetainedQuote returns the record given to Return, if any
 func (d *DbMock) GetRetainedQuote(hash string) (*types.RetainedQuote, error) {
-	d.Called(hash)
+	args := d.Called(hash)
+	if len(args) > 0 {
+		if rq, ok := args.Get(0).(*types.RetainedQuote); ok {
+			return rq, nil
+		}
+	}
 	return nil, nil
 }
 
@@ -68,7 +120,60 @@ func (d *DbMock) UpdateRetainedQuoteState(hash string, oldState types.RQState, n
 	return nil
 }
 
-func (d *DbMock) GetLockedLiquidity() (*types.Wei, error) {
-	d.Called()
+func (d *DbMock) SetAcceptedHeight(hash string, height uint64) error {
+	args := d.Called(hash, height)
+	if len(args) > 0 {
+		return args.Error(0)
+	}
+	return nil
+}
+
+func (d *DbMock) GetLockedLiquidity(lpRSKAddr string) (*types.Wei, error) {
+	d.Called(lpRSKAddr)
 	return new(types.Wei), nil
 }
+
+// DeleteRetainedQuotes returns the count given to Return, if any
+func (d *DbMock) DeleteRetainedQuotes(states []types.RQState, before time.Time) (int64, error) {
+	args := d.Called(states, before)
+	if len(args) > 0 {
+		return args.Get(0).(int64), args.Error(1)
+	}
+	return 0, nil
+}
+
+// CountRetainedQuotes returns the counts given to Return, if any
+func (d *DbMock) CountRetainedQuotes() (map[types.RQState]int, error) {
+	args := d.Called()
+	if len(args) > 0 {
+		counts, _ := args.Get(0).(map[types.RQState]int)
+		return counts, args.Error(1)
+	}
+	return map[types.RQState]int{}, nil
+}
+
+// GetIdempotentResponse returns the response given to Return, if any
+func (d *DbMock) GetIdempotentResponse(key string) (*storage.IdempotentResponse, error) {
+	args := d.Called(key)
+	if len(args) > 0 {
+		r, _ := args.Get(0).(*storage.IdempotentResponse)
+		return r, args.Error(1)
+	}
+	return nil, nil
+}
+
+func (d *DbMock) InsertIdempotentResponse(r *storage.IdempotentResponse) error {
+	args := d.Called(r)
+	if len(args) > 0 {
+		return args.Error(0)
+	}
+	return nil
+}
+
+func (d *DbMock) DeleteIdempotentResponses(before time.Time) (int64, error) {
+	args := d.Called(before)
+	if len(args) > 0 {
+		return args.Get(0).(int64), args.Error(1)
+	}
+	return 0, nil
+}
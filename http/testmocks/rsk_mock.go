@@ -4,8 +4,10 @@ import (
 	"context"
 	"github.com/rsksmart/liquidity-provider-server/connectors"
 	"math/big"
+	"time"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
 	gethTypes "github.com/ethereum/go-ethereum/core/types"
 	"github.com/rsksmart/liquidity-provider-server/connectors/bindings"
 	"github.com/rsksmart/liquidity-provider/types"
@@ -16,42 +18,50 @@ type RskMock struct {
 	mock.Mock
 }
 
-func (m *RskMock) GetMinimumLockTxValue() (*big.Int, error) {
+func (m *RskMock) GetMinimumLockTxValue(_ context.Context) (*big.Int, error) {
 	args := m.Called()
 	return args.Get(0).(*big.Int), args.Error(1)
 }
 
-func (m *RskMock) GetLbcBalance(addr string) (*big.Int, error) {
+func (m *RskMock) GetBalance(_ context.Context, addr string) (*big.Int, error) {
 	args := m.Called(addr)
 	return args.Get(0).(*big.Int), args.Error(1)
 }
 
-func (m *RskMock) GetAvailableLiquidity(addr string) (*big.Int, error) {
+func (m *RskMock) GetLbcBalance(_ context.Context, addr string) (*big.Int, error) {
 	args := m.Called(addr)
 	return args.Get(0).(*big.Int), args.Error(1)
 }
 
-func (m *RskMock) GetCollateral(addr string) (*big.Int, *big.Int, error) {
+func (m *RskMock) GetAvailableLiquidity(_ context.Context, addr string) (*big.Int, error) {
+	args := m.Called(addr)
+	return args.Get(0).(*big.Int), args.Error(1)
+}
+
+func (m *RskMock) GetCollateral(_ context.Context, addr string) (*big.Int, *big.Int, error) {
 	m.Called(addr)
 	return big.NewInt(10), big.NewInt(10), nil
 }
 
-func (m *RskMock) RegisterProvider(opts *bind.TransactOpts) error {
+func (m *RskMock) RegisterProvider(_ context.Context, opts *bind.TransactOpts) error {
 	m.Called(opts)
 	return nil
 }
 
-func (m *RskMock) AddCollateral(opts *bind.TransactOpts) error {
+func (m *RskMock) AddCollateral(_ context.Context, opts *bind.TransactOpts) error {
 	m.Called(opts)
 	return nil
 }
 
 func (m *RskMock) GetRequiredBridgeConfirmations() int64 {
-	m.Called()
+	args := m.Called()
+	if len(args) > 0 {
+		return args.Get(0).(int64)
+	}
 	return 0
 }
 
-func (m *RskMock) GetChainId() (*big.Int, error) {
+func (m *RskMock) GetChainId(_ context.Context) (*big.Int, error) {
 	m.Called()
 	return big.NewInt(0), nil
 }
@@ -61,17 +71,17 @@ func (m *RskMock) ParseQuote(q *types.Quote) (bindings.LiquidityBridgeContractQu
 	return bindings.LiquidityBridgeContractQuote{}, nil
 }
 
-func (m *RskMock) RegisterPegIn(opt *bind.TransactOpts, q bindings.LiquidityBridgeContractQuote, signature []byte, tx []byte, pmt []byte, height *big.Int) (*gethTypes.Transaction, error) {
+func (m *RskMock) RegisterPegIn(_ context.Context, opt *bind.TransactOpts, q bindings.LiquidityBridgeContractQuote, signature []byte, tx []byte, pmt []byte, height *big.Int) (*gethTypes.Transaction, error) {
 	m.Called(opt, q, signature, tx, pmt, height)
 	return nil, nil
 }
 
-func (m *RskMock) RegisterPegInWithoutTx(q bindings.LiquidityBridgeContractQuote, signature []byte, tx []byte, pmt []byte, height *big.Int) error {
+func (m *RskMock) RegisterPegInWithoutTx(_ context.Context, q bindings.LiquidityBridgeContractQuote, signature []byte, tx []byte, pmt []byte, height *big.Int) error {
 	m.Called(q, signature, tx, pmt, height)
 	return nil
 }
 
-func (m *RskMock) CallForUser(opt *bind.TransactOpts, q bindings.LiquidityBridgeContractQuote) (*gethTypes.Transaction, error) {
+func (m *RskMock) CallForUser(_ context.Context, opt *bind.TransactOpts, q bindings.LiquidityBridgeContractQuote) (*gethTypes.Transaction, error) {
 	m.Called(opt, q)
 	return nil, nil
 }
@@ -81,53 +91,77 @@ func (m *RskMock) Connect(endpoint string, chainId *big.Int) error {
 	return nil
 }
 
-func (m *RskMock) CheckConnection() error {
+func (m *RskMock) CheckConnection(_ context.Context) error {
 	args := m.Called()
 	return args.Error(0)
 }
 
+func (m *RskMock) HealthCheck(_ context.Context) (bool, error) {
+	args := m.Called()
+	return args.Bool(0), args.Error(1)
+}
+
 func (m *RskMock) Close() {
 	m.Called()
 }
 
-func (m *RskMock) EstimateGas(addr string, value *big.Int, data []byte) (uint64, error) {
-	m.Called(addr, value, data)
+func (m *RskMock) EstimateGas(_ context.Context, addr string, value *big.Int, data []byte) (uint64, error) {
+	args := m.Called(addr, value, data)
+	if len(args) > 1 {
+		return args.Get(0).(uint64), args.Error(1)
+	}
 	return 10000, nil
 }
 
-func (m *RskMock) GasPrice() (*big.Int, error) {
+func (m *RskMock) IsContract(_ context.Context, addr string) (bool, error) {
+	args := m.Called(addr)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *RskMock) GasPrice(_ context.Context) (*big.Int, error) {
 	m.Called()
 	return big.NewInt(100000), nil
 }
-func (m *RskMock) HashQuote(q *types.Quote) (string, error) {
+func (m *RskMock) HashQuote(_ context.Context, q *types.Quote) (string, error) {
 	m.Called(q)
 	return "", nil
 }
-func (m *RskMock) GetFedSize() (int, error) {
+func (m *RskMock) GetFedSize(_ context.Context) (int, error) {
 	args := m.Called()
 	return args.Int(0), nil
 }
-func (m *RskMock) GetFedThreshold() (int, error) {
+func (m *RskMock) GetFedThreshold(_ context.Context) (int, error) {
 	args := m.Called()
 	return args.Int(0), nil
 }
 
-func (m *RskMock) GetFedPublicKey(index int) (string, error) {
+func (m *RskMock) GetFedPublicKey(_ context.Context, index int) (string, error) {
 	args := m.Called(index)
 	return args.String(), nil
 }
-func (m *RskMock) GetFedAddress() (string, error) {
+func (m *RskMock) GetFedAddress(_ context.Context) (string, error) {
 	args := m.Called()
 	return args.String(), nil
 }
-func (m *RskMock) GetActiveFederationCreationBlockHeight() (int, error) {
+func (m *RskMock) GetActiveFederationCreationBlockHeight(_ context.Context) (int, error) {
 	args := m.Called()
 	return args.Int(0), nil
 }
 
 func (m *RskMock) GetLBCAddress() string {
 	args := m.Called()
-	return args.String()
+	if len(args) == 0 {
+		return ""
+	}
+	return args.String(0)
+}
+
+func (m *RskMock) GetBridgeAddress() string {
+	args := m.Called()
+	if len(args) == 0 {
+		return ""
+	}
+	return args.String(0)
 }
 
 func (m *RskMock) GetTxStatus(ctx context.Context, tx *gethTypes.Transaction) (bool, error) {
@@ -135,7 +169,41 @@ func (m *RskMock) GetTxStatus(ctx context.Context, tx *gethTypes.Transaction) (b
 	return false, nil
 }
 
-func (m *RskMock) FetchFederationInfo() (*connectors.FedInfo, error) {
+func (m *RskMock) WaitForTx(ctx context.Context, tx *gethTypes.Transaction, depth uint64, onConfirmation func(confirmations uint64)) (bool, error) {
+	args := m.Called(ctx, tx, depth)
+	if onConfirmation != nil {
+		onConfirmation(depth)
+	}
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *RskMock) WaitForReceipt(ctx context.Context, txHash common.Hash) (*gethTypes.Receipt, error) {
+	args := m.Called(ctx, txHash)
+	r, _ := args.Get(0).(*gethTypes.Receipt)
+	return r, args.Error(1)
+}
+
+func (m *RskMock) FetchFederationInfo(_ context.Context) (*connectors.FedInfo, error) {
 	args := m.Called()
 	return args.Get(0).(*connectors.FedInfo), args.Error(1)
 }
+
+func (m *RskMock) FedCacheStatus() string {
+	args := m.Called()
+	return args.String(0)
+}
+
+func (m *RskMock) GetLatestBlockTime(_ context.Context) (time.Time, error) {
+	args := m.Called()
+	return args.Get(0).(time.Time), args.Error(1)
+}
+
+func (m *RskMock) GetBlockNumber(_ context.Context) (uint64, error) {
+	args := m.Called()
+	return args.Get(0).(uint64), args.Error(1)
+}
+
+func (m *RskMock) NodeInfo(ctx context.Context) (connectors.NodeInfo, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(connectors.NodeInfo), args.Error(1)
+}
@@ -0,0 +1,51 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// serverTiming accumulates the time spent on each backend while handling a request, to be reported in the
+// Server-Timing header. A nil serverTiming is valid and measures nothing.
+type serverTiming struct {
+	phases []string
+	durs   map[string]time.Duration
+}
+
+func (s *Server) newServerTiming() *serverTiming {
+	if !s.cfg.ServerTiming {
+		return nil
+	}
+	return &serverTiming{durs: make(map[string]time.Duration)}
+}
+
+// measure starts timing the given phase; the returned func stops it
+func (t *serverTiming) measure(phase string) func() {
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		t.add(phase, time.Since(start))
+	}
+}
+
+func (t *serverTiming) add(phase string, d time.Duration) {
+	if _, ok := t.durs[phase]; !ok {
+		t.phases = append(t.phases, phase)
+	}
+	t.durs[phase] += d
+}
+
+func (t *serverTiming) writeHeader(w http.ResponseWriter) {
+	if t == nil || len(t.phases) == 0 {
+		return
+	}
+	metrics := make([]string, 0, len(t.phases))
+	for _, p := range t.phases {
+		metrics = append(metrics, fmt.Sprintf("%v;dur=%.3f", p, float64(t.durs[p].Microseconds())/1000))
+	}
+	w.Header().Set("Server-Timing", strings.Join(metrics, ", "))
+}
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"github.com/btcsuite/btcutil"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	gethTypes "github.com/ethereum/go-ethereum/core/types"
 	"github.com/rsksmart/liquidity-provider-server/storage"
 	"math/big"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,17 +20,33 @@ import (
 )
 
 type BTCAddressWatcher struct {
-	hash         string
-	btc          connectors.BTCConnector
-	rsk          connectors.RSKConnector
-	lp           providers.LiquidityProvider
-	db           storage.DBConnector
-	state        types.RQState
-	quote        *types.Quote
-	done         chan struct{}
-	closed       bool
-	signature    []byte
-	sharedLocker sync.Locker
+	hash          string
+	btc           connectors.BTCConnector
+	rsk           connectors.RSKConnector
+	lp            providers.LiquidityProvider
+	db            storage.DBConnector
+	state         types.RQState
+	quote         *types.Quote
+	done          chan struct{}
+	closed        bool
+	signature     []byte
+	sharedLocker  sync.Locker
+	webhook       *webhookNotifier
+	metrics       *metrics
+	txEvents      *txEventBus
+	depositEvents *depositEventBus
+	// RSK confirmations the LBC transactions must reach before the quote moves on
+	rskConfirmations uint64
+	pendingMu        sync.Mutex
+	pending          *pendingTx
+}
+
+// pendingTx is an LBC transaction sent for the quote that hasn't reached the required RSK confirmations yet
+type pendingTx struct {
+	TxHash        string `json:"txHash"`
+	TxType        string `json:"txType"`
+	Confirmations uint64 `json:"confirmations"`
+	Pending       uint64 `json:"pendingConfirmations"`
 }
 
 const (
@@ -38,18 +56,24 @@ const (
 
 func NewBTCAddressWatcher(hash string,
 	btc connectors.BTCConnector, rsk connectors.RSKConnector, provider providers.LiquidityProvider, db storage.DBConnector,
-	q *types.Quote, signature []byte, state types.RQState, sharedLocker sync.Locker) *BTCAddressWatcher {
+	q *types.Quote, signature []byte, state types.RQState, sharedLocker sync.Locker, webhook *webhookNotifier, metrics *metrics,
+	txEvents *txEventBus, depositEvents *depositEventBus, rskConfirmations uint64) *BTCAddressWatcher {
 	watcher := BTCAddressWatcher{
-		hash:         hash,
-		btc:          btc,
-		rsk:          rsk,
-		lp:           provider,
-		db:           db,
-		quote:        q,
-		state:        state,
-		signature:    signature,
-		done:         make(chan struct{}),
-		sharedLocker: sharedLocker,
+		hash:             hash,
+		btc:              btc,
+		rsk:              rsk,
+		lp:               provider,
+		db:               db,
+		quote:            q,
+		state:            state,
+		signature:        signature,
+		done:             make(chan struct{}),
+		sharedLocker:     sharedLocker,
+		webhook:          webhook,
+		metrics:          metrics,
+		txEvents:         txEvents,
+		depositEvents:    depositEvents,
+		rskConfirmations: rskConfirmations,
 	}
 	return &watcher
 }
@@ -60,6 +84,7 @@ func (w *BTCAddressWatcher) OnNewConfirmation(txHash string, confirmations int64
 		return
 	}
 	log.Debugf("processing OnNewConfirmation event for tx %v; confirmations: %v; received amount: %v", txHash, confirmations, amount)
+	w.depositEvents.publish(newDepositEvent(w.hash, txHash, confirmations, w.rsk.GetRequiredBridgeConfirmations()))
 
 	if w.state == types.RQStateWaitingForDeposit && confirmations >= int64(w.quote.Confirmations) {
 		err := w.performCallForUser()
@@ -101,7 +126,7 @@ func (w *BTCAddressWatcher) performCallForUser() error {
 	w.sharedLocker.Lock()
 	defer w.sharedLocker.Unlock()
 
-	lbcBalance, err := w.rsk.GetLbcBalance(w.lp.Address())
+	lbcBalance, err := w.rsk.GetLbcBalance(context.Background(), w.lp.Address())
 	if err != nil {
 		return err
 	}
@@ -119,17 +144,18 @@ func (w *BTCAddressWatcher) performCallForUser() error {
 		From:     q.LiquidityProviderRskAddress,
 		Signer:   w.lp.SignTx,
 	}
-	tx, err := w.rsk.CallForUser(opt, q)
+	tx, err := w.rsk.CallForUser(context.Background(), opt, q)
 	if err != nil {
 		_ = w.closeAndUpdateQuoteState(types.RQStateCallForUserFailed)
 		return err
 	}
+	w.txEvents.publish(newTxSubmittedEvent(w.hash, txTypeCallForUser, tx))
 	ctx, cancel := context.WithTimeout(context.Background(), time.Hour*8760) // timeout is a year
 	defer cancel()
-	s, err := w.rsk.GetTxStatus(ctx, tx)
+	s, err := w.waitForTx(ctx, tx, txTypeCallForUser)
 	if err != nil || !s {
 		_ = w.closeAndUpdateQuoteState(types.RQStateCallForUserFailed)
-		return fmt.Errorf("transaction failed. hash: %v", tx.Hash())
+		return txFailure(tx, err)
 	}
 
 	err = w.updateQuoteState(types.RQStateCallForUserSucceeded)
@@ -152,22 +178,12 @@ func (w *BTCAddressWatcher) performRegisterPegIn(txHash string) error {
 		From:     q.LiquidityProviderRskAddress,
 		Signer:   w.lp.SignTx,
 	}
-	rawTx, err := w.btc.SerializeTx(txHash)
-	if err != nil {
-		_ = w.closeAndUpdateQuoteState(types.RQStateRegisterPegInFailed)
-		return err
-	}
-	pmt, err := w.btc.SerializePMT(txHash)
+	rawTx, pmt, bh, err := w.btc.BuildRegisterPegInParams(txHash)
 	if err != nil {
 		_ = w.closeAndUpdateQuoteState(types.RQStateRegisterPegInFailed)
 		return err
 	}
-	bh, err := w.btc.GetBlockNumberByTx(txHash)
-	if err != nil {
-		_ = w.closeAndUpdateQuoteState(types.RQStateRegisterPegInFailed)
-		return err
-	}
-	err = w.rsk.RegisterPegInWithoutTx(q, w.signature, rawTx, pmt, big.NewInt(bh))
+	err = w.rsk.RegisterPegInWithoutTx(context.Background(), q, w.signature, rawTx, pmt, bh)
 	if err != nil {
 		if strings.Contains(err.Error(), "Failed to validate BTC transaction") {
 			log.Debugf("bridge failed to validate BTC transaction. retrying on next confirmation. tx: %v", txHash)
@@ -176,17 +192,18 @@ func (w *BTCAddressWatcher) performRegisterPegIn(txHash string) error {
 	}
 
 	log.Debugf("calling pegin for tx %v", txHash)
-	tx, err := w.rsk.RegisterPegIn(opt, q, w.signature, rawTx, pmt, big.NewInt(bh))
+	tx, err := w.rsk.RegisterPegIn(context.Background(), opt, q, w.signature, rawTx, pmt, bh)
 	if err != nil {
 		_ = w.closeAndUpdateQuoteState(types.RQStateRegisterPegInFailed)
 		return err
 	}
+	w.txEvents.publish(newTxSubmittedEvent(w.hash, txTypeRegisterPegIn, tx))
 	ctx, cancel := context.WithTimeout(context.Background(), time.Hour*8760) // timeout is a year
 	defer cancel()
-	s, err := w.rsk.GetTxStatus(ctx, tx)
+	s, err := w.waitForTx(ctx, tx, txTypeRegisterPegIn)
 	if err != nil || !s {
 		_ = w.closeAndUpdateQuoteState(types.RQStateRegisterPegInFailed)
-		return fmt.Errorf("transaction failed. hash: %v", tx.Hash())
+		return txFailure(tx, err)
 	}
 
 	err = w.updateQuoteState(types.RQStateRegisterPegInSucceeded)
@@ -200,6 +217,46 @@ func (w *BTCAddressWatcher) performRegisterPegIn(txHash string) error {
 	return nil
 }
 
+// waitForTx waits until the transaction reaches the RSK confirmation depth, since a transaction in a shallow block
+// could still be reorged out, and keeps track of its confirmations meanwhile
+func (w *BTCAddressWatcher) waitForTx(ctx context.Context, tx *gethTypes.Transaction, txType string) (bool, error) {
+	hash := tx.Hash().Hex()
+	w.setPendingTx(&pendingTx{TxHash: hash, TxType: txType, Pending: w.rskConfirmations})
+	defer w.setPendingTx(nil)
+	return w.rsk.WaitForTx(ctx, tx, w.rskConfirmations, func(confirmations uint64) {
+		p := &pendingTx{TxHash: hash, TxType: txType, Confirmations: confirmations}
+		if confirmations < w.rskConfirmations {
+			p.Pending = w.rskConfirmations - confirmations
+		}
+		w.setPendingTx(p)
+	})
+}
+
+// txFailure tells a transaction that never reached its confirmations apart from one that was mined and reverted
+func txFailure(tx *gethTypes.Transaction, err error) error {
+	if err != nil {
+		return fmt.Errorf("%w; hash: %v: %v", connectors.ErrTxNotMined, tx.Hash(), err)
+	}
+	return fmt.Errorf("%w; hash: %v", connectors.ErrTxReverted, tx.Hash())
+}
+
+func (w *BTCAddressWatcher) setPendingTx(p *pendingTx) {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+	w.pending = p
+}
+
+// pendingConfirmations returns the transaction waiting for confirmations, if any
+func (w *BTCAddressWatcher) pendingConfirmations() *pendingTx {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+	if w.pending == nil {
+		return nil
+	}
+	p := *w.pending
+	return &p
+}
+
 func (w *BTCAddressWatcher) updateQuoteState(newState types.RQState) error {
 	err := w.db.UpdateRetainedQuoteState(w.hash, w.state, newState)
 	if err != nil {
@@ -208,6 +265,11 @@ func (w *BTCAddressWatcher) updateQuoteState(newState types.RQState) error {
 	}
 
 	w.state = newState
+	w.webhook.notify(w.hash, newState)
+	w.metrics.stateChanges.WithLabelValues(strconv.Itoa(int(newState))).Inc()
+	if newState == types.RQStateTimeForDepositElapsed {
+		w.metrics.expiredQuotes.Inc()
+	}
 	return nil
 }
 
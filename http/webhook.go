@@ -0,0 +1,142 @@
+package http
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rsksmart/liquidity-provider/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	webhookSignatureHeader = "X-LPS-Signature"
+	webhookTimeout         = 10 * time.Second
+	webhookInitialBackoff  = 1 * time.Second
+	webhookDefaultRetries  = 5
+)
+
+const (
+	WebhookEventAccepted        = "accepted"
+	WebhookEventPegInRegistered = "pegin_registered"
+	WebhookEventCompleted       = "completed"
+	WebhookEventFailed          = "failed"
+	WebhookEventExpired         = "expired"
+)
+
+// WebhookConfig holds the settings for notifying quote state transitions to an external endpoint
+type WebhookConfig struct {
+	URL        string // endpoint the events are POSTed to; webhooks are disabled when empty
+	Secret     string // key used to compute the HMAC-SHA256 signature of each payload
+	MaxRetries uint   // delivery attempts after the first one failed (default: 5)
+}
+
+type webhookEvent struct {
+	Event     string        `json:"event"`
+	QuoteHash string        `json:"quoteHash"`
+	State     types.RQState `json:"state"`
+	Timestamp int64         `json:"timestamp"`
+}
+
+type webhookNotifier struct {
+	cfg    WebhookConfig
+	client *http.Client
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+func newWebhookNotifier(cfg WebhookConfig, now func() time.Time) *webhookNotifier {
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = webhookDefaultRetries
+	}
+	return &webhookNotifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: webhookTimeout},
+		now:    now,
+		sleep:  time.Sleep,
+	}
+}
+
+func webhookEventForState(state types.RQState) (string, bool) {
+	switch state {
+	case types.RQStateWaitingForDeposit:
+		return WebhookEventAccepted, true
+	case types.RQStateCallForUserSucceeded:
+		return WebhookEventCompleted, true
+	case types.RQStateRegisterPegInSucceeded:
+		return WebhookEventPegInRegistered, true
+	case types.RQStateCallForUserFailed, types.RQStateRegisterPegInFailed:
+		return WebhookEventFailed, true
+	case types.RQStateTimeForDepositElapsed:
+		return WebhookEventExpired, true
+	default:
+		return "", false
+	}
+}
+
+// notify delivers the event matching the new state of the quote in the background. It's a no-op when webhooks are
+// not configured.
+func (n *webhookNotifier) notify(hash string, state types.RQState) {
+	if n == nil || n.cfg.URL == "" {
+		return
+	}
+	event, ok := webhookEventForState(state)
+	if !ok {
+		return
+	}
+	payload, err := json.Marshal(webhookEvent{
+		Event:     event,
+		QuoteHash: hash,
+		State:     state,
+		Timestamp: n.now().Unix(),
+	})
+	if err != nil {
+		log.Errorf("error encoding webhook payload; hash: %v; error: %v", hash, err)
+		return
+	}
+	go func() {
+		err := n.deliver(payload)
+		if err != nil {
+			log.Errorf("error delivering webhook; hash: %v; event: %v; error: %v", hash, event, err)
+		}
+	}()
+}
+
+func (n *webhookNotifier) deliver(payload []byte) error {
+	return retryWithBackoff(n.cfg.MaxRetries, webhookInitialBackoff, n.sleep, func() error {
+		err := n.post(payload)
+		if err != nil {
+			log.Debugf("webhook delivery attempt failed: %v", err)
+		}
+		return err
+	})
+}
+
+func (n *webhookNotifier) post(payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, n.cfg.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeader, signWebhookPayload(n.cfg.Secret, payload))
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status: %v", res.StatusCode)
+	}
+	return nil
+}
+
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
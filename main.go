@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/big"
 	"math/rand"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rsksmart/liquidity-provider-server/connectors"
 	"github.com/rsksmart/liquidity-provider-server/http"
 	"github.com/rsksmart/liquidity-provider-server/storage"
@@ -33,6 +37,9 @@ func initLogger() {
 	if cfg.Debug {
 		log.SetLevel(log.DebugLevel)
 	}
+	if cfg.LogJSON {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
 	if cfg.LogFile == "" {
 		return
 	}
@@ -52,7 +59,7 @@ func startServer(rsk *connectors.RSK, btc *connectors.BTC, db *storage.DB) {
 		log.Fatal("cannot create local provider: ", err)
 	}
 
-	srv = http.New(rsk, btc, db)
+	srv = http.New(rsk, btc, db, cfg.Server.Config, nil)
 	log.Debug("registering local provider (this might take a while)")
 	err = srv.AddProvider(lp)
 	if err != nil {
@@ -64,8 +71,11 @@ func startServer(rsk *connectors.RSK, btc *connectors.BTC, db *storage.DB) {
 		port = 8080
 	}
 	go func() {
-		err := srv.Start(port)
+		err := srv.Start(cfg.Server.Host, port)
 
+		if errors.Is(err, http.ErrNoProviders) || errors.Is(err, http.ErrInvalidListenAddress) {
+			log.Fatal("server error: ", err.Error())
+		}
 		if err != nil {
 			log.Error("server error: ", err.Error())
 		}
@@ -90,6 +100,44 @@ func main() {
 		log.Fatal("RSK error: ", err)
 	}
 
+	if cfg.RegtestMode {
+		log.Warn("regtest mode enabled: chain id mismatches and federation changes since quotes were issued are ignored")
+		rsk.EnableRegtestMode()
+		cfg.Server.RegtestMode = true
+	}
+
+	if cfg.RSK.GasEstimationCacheTTL > 0 {
+		rsk.EnableGasEstimationCache(time.Duration(cfg.RSK.GasEstimationCacheTTL) * time.Second)
+	}
+
+	if cfg.RSK.ForceGasEstimation {
+		rsk.ForceGasEstimation()
+	}
+
+	if cfg.RSK.DynamicFees {
+		rsk.EnableDynamicFees()
+	}
+
+	err = rsk.SetGasPricePolicy(cfg.RSK.GasPriceMarkup, new(big.Int).SetUint64(cfg.RSK.MaxGasPrice))
+	if err != nil {
+		log.Fatal("RSK error: ", err)
+	}
+
+	if cfg.RSK.Proxy != "" {
+		err = rsk.UseProxy(cfg.RSK.Proxy)
+		if err != nil {
+			log.Fatal("error configuring RSK proxy: ", err)
+		}
+	}
+
+	// the server exposes the default registry on /metrics
+	err = rsk.EnableMetrics(prometheus.DefaultRegisterer)
+	if err != nil {
+		log.Fatal("error registering RSK metrics: ", err)
+	}
+
+	rsk.SetRetryPolicy(cfg.RSK.Retries, time.Duration(cfg.RSK.RetrySleep)*time.Millisecond, time.Duration(cfg.RSK.MaxRetrySleep)*time.Millisecond)
+
 	err = rsk.Connect(cfg.RSK.Endpoint, cfg.Provider.ChainId)
 	if err != nil {
 		log.Fatal("error connecting to RSK: ", err)
@@ -100,11 +148,52 @@ func main() {
 		log.Fatal("error initializing BTC connector: ", err)
 	}
 
+	err = btc.EnableMetrics(prometheus.DefaultRegisterer)
+	if err != nil {
+		log.Fatal("error registering BTC metrics: ", err)
+	}
+
+	btc.LimitConcurrentCalls(cfg.BTC.MaxCalls)
+	btc.SetReorgSafetyDepth(cfg.BTC.ReorgDepth)
+	btc.SetAdaptivePolling(cfg.BTC.AdaptivePolling)
+	if cfg.BTC.FedAddressType != "" {
+		err = btc.SetFedAddressType(cfg.BTC.FedAddressType)
+		if err != nil {
+			log.Fatal("error initializing BTC connector: ", err)
+		}
+	}
+	if cfg.BTC.Proxy != "" {
+		err = btc.UseProxy(cfg.BTC.Proxy)
+		if err != nil {
+			log.Fatal("error configuring BTC proxy: ", err)
+		}
+	}
 	err = btc.Connect(cfg.BTC.Endpoint, cfg.BTC.Username, cfg.BTC.Password)
 	if err != nil {
 		log.Fatal("error connecting to BTC: ", err)
 	}
 
+	fedAddr, err := rsk.GetFedAddress(context.Background())
+	if err != nil {
+		log.Fatal("error retrieving federation address: ", err)
+	}
+	err = btc.CheckFedAddressNetwork(fedAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = btc.CheckFedAddressType(fedAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.RSK.WarmFedCache {
+		// a partial warmup is completed by the first accept, so it doesn't keep the server from starting
+		err = rsk.WarmFederationCache(context.Background())
+		if err != nil {
+			log.Warn("error warming up federation cache: ", err)
+		}
+	}
+
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
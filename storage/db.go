@@ -3,6 +3,8 @@ package storage
 import (
 	"database/sql"
 	"fmt"
+	"time"
+
 	"github.com/jmoiron/sqlx"
 	"github.com/rsksmart/liquidity-provider/types"
 	log "github.com/sirupsen/logrus"
@@ -18,20 +20,69 @@ type DBConnector interface {
 	Close() error
 
 	InsertQuote(id string, q *types.Quote) error
-	GetQuote(quoteHash string) (*types.Quote, error) // returns nil if not found
+	GetQuote(quoteHash string) (*RetainedQuote, error) // returns nil if not found
+	GetExpiredQuotes(now time.Time) ([]string, error)  // returns the hashes of the quotes that expired before now without being accepted
 	DeleteExpiredQuotes(expTimestamp int64) error
+	DeleteProviderQuotes(lpRSKAddr string) (int64, error)                                // returns the number of deleted quotes
+	ListQuotes(filter QuoteFilter, limit uint, offset uint) ([]*ListedQuote, int, error) // returns a page of quotes, oldest first, and how many match the filter
 
 	RetainQuote(entry *types.RetainedQuote) error
 	GetRetainedQuotes(filter []types.RQState) ([]*types.RetainedQuote, error)
 	GetRetainedQuote(hash string) (*types.RetainedQuote, error) // returns nil if not found
 	UpdateRetainedQuoteState(hash string, oldState types.RQState, newState types.RQState) error
-	GetLockedLiquidity() (*types.Wei, error)
+	SetAcceptedHeight(hash string, height uint64) error
+	GetLockedLiquidity(lpRSKAddr string) (*types.Wei, error)
+	DeleteRetainedQuotes(states []types.RQState, before time.Time) (int64, error) // returns the number of deleted quotes
+	CountRetainedQuotes() (map[types.RQState]int, error)
+
+	GetIdempotentResponse(key string) (*IdempotentResponse, error) // returns nil if not found
+	InsertIdempotentResponse(r *IdempotentResponse) error
+	DeleteIdempotentResponses(before time.Time) (int64, error) // returns the number of deleted responses
 }
 
 type DB struct {
 	db *sqlx.DB
 }
 
+// RetainedQuote is a stored quote along with its acceptance details, which are only set once the quote is accepted
+type RetainedQuote struct {
+	Quote          *types.Quote
+	Accepted       bool
+	State          types.RQState
+	Signature      string
+	DepositAddress string
+	ReqLiq         *types.Wei
+	AcceptedAt     time.Time // zero for quotes accepted before the acceptance time was recorded
+	AcceptedHeight uint64    // RSK block number when the quote was accepted; zero when it wasn't recorded
+}
+
+type retainedQuoteRow struct {
+	types.RetainedQuote
+	AcceptedAt     int64  `db:"accepted_at"`
+	AcceptedHeight uint64 `db:"accepted_height"`
+}
+
+// QuoteFilter narrows down the quotes returned by ListQuotes; zero fields don't filter
+type QuoteFilter struct {
+	LpRskAddr    string
+	CreatedAfter time.Time // compared with the agreement timestamp, which is set when the quote is issued
+}
+
+// ListedQuote is a stored quote along with the hash it was stored under
+type ListedQuote struct {
+	Hash string `db:"hash"`
+	types.Quote
+}
+
+// IdempotentResponse is the response given to the first request made with an idempotency key, which is given again to
+// the requests repeating the key
+type IdempotentResponse struct {
+	Key       string `db:"idempotency_key"`
+	QuoteHash string `db:"quote_hash"`
+	Response  string `db:"response"`
+	CreatedAt int64  `db:"created_at"`
+}
+
 type QuoteHash struct {
 	QuoteHash string `db:"quote_hash"`
 }
@@ -65,10 +116,34 @@ func Connect(dbPath string) (*DB, error) {
 	if _, err := db.Exec(createRetainedQuoteIndexes); err != nil {
 		return nil, err
 	}
+	if _, err := db.Exec(createIdempotencyKeyTable); err != nil {
+		return nil, err
+	}
+	if err := addRetainedQuoteColumn(db, "accepted_at", addRetainedQuoteAcceptedAtColumn); err != nil {
+		return nil, err
+	}
+	if err := addRetainedQuoteColumn(db, "accepted_height", addRetainedQuoteAcceptedHeightColumn); err != nil {
+		return nil, err
+	}
 
 	return &DB{db}, nil
 }
 
+// addRetainedQuoteColumn adds a column to retained quote tables created before it was recorded
+func addRetainedQuoteColumn(db *sqlx.DB, column string, stmt string) error {
+	var columns []string
+	if err := db.Select(&columns, selectRetainedQuoteColumns); err != nil {
+		return err
+	}
+	for _, c := range columns {
+		if c == column {
+			return nil
+		}
+	}
+	_, err := db.Exec(stmt)
+	return err
+}
+
 func (db *DB) Close() error {
 	log.Debug("closing connection to DB")
 	err := db.db.Close()
@@ -91,18 +166,50 @@ func (db *DB) InsertQuote(id string, q *types.Quote) error {
 	return nil
 }
 
-func (db *DB) GetQuote(quoteHash string) (*types.Quote, error) {
+func (db *DB) GetQuote(quoteHash string) (*RetainedQuote, error) {
 	log.Debug("retrieving quote: ", quoteHash)
 	quote := types.Quote{}
 	err := db.db.Get(&quote, selectQuoteByHash, quoteHash)
 	switch err {
 	case nil:
-		return &quote, nil
 	case sql.ErrNoRows:
 		return nil, nil
 	default:
 		return nil, err
 	}
+
+	entry := &RetainedQuote{Quote: &quote}
+	row := retainedQuoteRow{}
+	err = db.db.Get(&row, getRetainedQuoteWithAcceptedAt, quoteHash)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return entry, nil
+	default:
+		return nil, err
+	}
+	entry.Accepted = true
+	entry.State = row.State
+	entry.Signature = row.Signature
+	entry.DepositAddress = row.DepositAddr
+	entry.ReqLiq = row.ReqLiq
+	if row.AcceptedAt > 0 {
+		entry.AcceptedAt = time.Unix(row.AcceptedAt, 0)
+	}
+	entry.AcceptedHeight = row.AcceptedHeight
+	return entry, nil
+}
+
+// GetExpiredQuotes returns the hashes of the quotes whose deposit time elapsed before now and that were never accepted.
+// Accepted quotes are retained for audit, so they're never reported as expired here.
+func (db *DB) GetExpiredQuotes(now time.Time) ([]string, error) {
+	log.Debug("retrieving expired quotes")
+	var hashes []string
+	err := db.db.Select(&hashes, selectExpiredQuotes, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
 }
 
 func (db *DB) DeleteExpiredQuotes(expTimestamp int64) error {
@@ -126,6 +233,41 @@ func (db *DB) DeleteExpiredQuotes(expTimestamp int64) error {
 	return nil
 }
 
+// DeleteProviderQuotes deletes the quotes issued by the provider that weren't accepted, returning how many were deleted
+func (db *DB) DeleteProviderQuotes(lpRSKAddr string) (int64, error) {
+	res, err := db.db.Exec(deleteProviderQuotes, lpRSKAddr)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	log.Infof("deleted %v quote(s) of provider %v", rowsAffected, lpRSKAddr)
+	return rowsAffected, nil
+}
+
+// ListQuotes returns the quotes matching the filter, ordered by agreement timestamp, skipping offset of them and
+// returning at most limit. The total is the number of quotes matching the filter, regardless of the page.
+func (db *DB) ListQuotes(filter QuoteFilter, limit uint, offset uint) ([]*ListedQuote, int, error) {
+	log.Debug("listing quotes: ", filter, "; limit: ", limit, "; offset: ", offset)
+	after := int64(-1)
+	if !filter.CreatedAfter.IsZero() {
+		after = filter.CreatedAfter.Unix()
+	}
+	var total int
+	err := db.db.Get(&total, countQuotes, filter.LpRskAddr, filter.LpRskAddr, after)
+	if err != nil {
+		return nil, 0, err
+	}
+	quotes := []*ListedQuote{}
+	err = db.db.Select(&quotes, selectQuotesPage, filter.LpRskAddr, filter.LpRskAddr, after, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	return quotes, total, nil
+}
+
 func (db *DB) RetainQuote(entry *types.RetainedQuote) error {
 	log.Debug("inserting retained quote:", entry.QuoteHash, "; DepositAddr: ", entry.DepositAddr, "; Signature: ", entry.Signature, "; ReqLiq: ", entry.ReqLiq)
 	query, args, _ := sqlx.Named(insertRetainedQuote, entry)
@@ -138,6 +280,14 @@ func (db *DB) RetainQuote(entry *types.RetainedQuote) error {
 	return nil
 }
 
+// SetAcceptedHeight records the RSK block number at which a retained quote was accepted. Quotes are retained by the
+// provider when signing them, so the height is set separately.
+func (db *DB) SetAcceptedHeight(hash string, height uint64) error {
+	log.Debug("setting accepted height of retained quote: ", hash, "; height: ", height)
+	_, err := db.db.Exec(updateRetainedQuoteAcceptedHeight, height, hash)
+	return err
+}
+
 func (db *DB) GetRetainedQuotes(filter []types.RQState) ([]*types.RetainedQuote, error) {
 	log.Debug("retrieving retained quotes")
 	var retainedQuotes []*types.RetainedQuote
@@ -211,11 +361,74 @@ func (db *DB) UpdateRetainedQuoteState(hash string, oldState types.RQState, newS
 	return nil
 }
 
-func (db *DB) GetLockedLiquidity() (*types.Wei, error) {
-	log.Debug("retrieving locked liquidity")
+// DeleteRetainedQuotes deletes the accepted quotes in any of the given states whose deposit time elapsed before the
+// given time, along with their quote records, returning how many were deleted
+func (db *DB) DeleteRetainedQuotes(states []types.RQState, before time.Time) (int64, error) {
+	log.Debug("deleting retained quotes in states ", states, " whose deposit time elapsed before ", before)
+	query, args, err := sqlx.In(selectPrunableRetainedQuotes, states, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	var hashes []string
+	err = db.db.Select(&hashes, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	if len(hashes) == 0 {
+		return 0, nil
+	}
+
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer func(tx *sqlx.Tx) {
+		_ = tx.Rollback()
+	}(tx)
+	query, args, err = sqlx.In(deleteRetainedQuotesByHash, hashes)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	// the quotes reference nothing, but are referenced by the retained quotes, so they go last
+	query, args, err = sqlx.In(deleteQuotesByHash, hashes)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = tx.Exec(query, args...); err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// CountRetainedQuotes returns how many accepted quotes are stored in each state
+func (db *DB) CountRetainedQuotes() (map[types.RQState]int, error) {
+	var rows []struct {
+		State types.RQState `db:"state"`
+		Count int           `db:"count"`
+	}
+	err := db.db.Select(&rows, countRetainedQuotesByState)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[types.RQState]int, len(rows))
+	for _, r := range rows {
+		counts[r.State] = r.Count
+	}
+	return counts, nil
+}
+
+func (db *DB) GetLockedLiquidity(lpRSKAddr string) (*types.Wei, error) {
+	log.Debug("retrieving locked liquidity for provider: ", lpRSKAddr)
 
 	filter := []types.RQState{types.RQStateWaitingForDeposit, types.RQStateCallForUserFailed}
-	query, args, err := sqlx.In(selectRetainedQuotesReqLiq, filter)
+	query, args, err := sqlx.In(selectRetainedQuotesReqLiq, filter, lpRSKAddr)
 	if err != nil {
 		return nil, err
 	}
@@ -241,3 +454,34 @@ func (db *DB) GetLockedLiquidity() (*types.Wei, error) {
 
 	return lockedLiq, nil
 }
+
+func (db *DB) GetIdempotentResponse(key string) (*IdempotentResponse, error) {
+	log.Debug("retrieving response for idempotency key: ", key)
+	r := IdempotentResponse{}
+	err := db.db.Get(&r, selectIdempotentResponse, key)
+	switch err {
+	case nil:
+		return &r, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// InsertIdempotentResponse stores the response given under an idempotency key. Keys can't be reused, so it fails if the
+// key is already stored.
+func (db *DB) InsertIdempotentResponse(r *IdempotentResponse) error {
+	log.Debug("inserting response for idempotency key: ", r.Key, "; quote: ", r.QuoteHash)
+	_, err := db.db.NamedExec(insertIdempotentResponse, r)
+	return err
+}
+
+// DeleteIdempotentResponses deletes the responses stored before the given time, returning how many were deleted
+func (db *DB) DeleteIdempotentResponses(before time.Time) (int64, error) {
+	res, err := db.db.Exec(deleteIdempotentResponses, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
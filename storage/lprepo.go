@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"context"
+
 	"github.com/rsksmart/liquidity-provider-server/connectors"
 	"github.com/rsksmart/liquidity-provider/providers"
 	"github.com/rsksmart/liquidity-provider/types"
@@ -28,11 +30,11 @@ func (r *LPRepository) HasRetainedQuote(hash string) (bool, error) {
 }
 
 func (r *LPRepository) HasLiquidity(lp providers.LiquidityProvider, wei *types.Wei) (bool, error) {
-	availableLiq, err := r.rsk.GetAvailableLiquidity(lp.Address())
+	availableLiq, err := r.rsk.GetAvailableLiquidity(context.Background(), lp.Address())
 	if err != nil {
 		return false, err
 	}
-	lockedLiq, err := r.db.GetLockedLiquidity()
+	lockedLiq, err := r.db.GetLockedLiquidity(lp.Address())
 	if err != nil {
 		return false, err
 	}
@@ -0,0 +1,295 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rsksmart/liquidity-provider/types"
+)
+
+// MemoryDB is a DBConnector that keeps everything in memory, for tests that need a database that behaves like the
+// real one without touching the disk. Records are lost once it's dropped.
+type MemoryDB struct {
+	mu       sync.RWMutex
+	quotes   map[string]types.Quote
+	retained map[string]*memoryRetainedQuote
+	keys     map[string]IdempotentResponse
+}
+
+type memoryRetainedQuote struct {
+	types.RetainedQuote
+	acceptedAt     time.Time
+	acceptedHeight uint64
+}
+
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		quotes:   make(map[string]types.Quote),
+		retained: make(map[string]*memoryRetainedQuote),
+		keys:     make(map[string]IdempotentResponse),
+	}
+}
+
+func (db *MemoryDB) CheckConnection() error {
+	return nil
+}
+
+func (db *MemoryDB) Close() error {
+	return nil
+}
+
+func (db *MemoryDB) InsertQuote(id string, q *types.Quote) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.quotes[id]; ok {
+		return fmt.Errorf("quote already stored: %v", id)
+	}
+	db.quotes[id] = *q
+	return nil
+}
+
+func (db *MemoryDB) GetQuote(quoteHash string) (*RetainedQuote, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	q, ok := db.quotes[quoteHash]
+	if !ok {
+		return nil, nil
+	}
+	entry := &RetainedQuote{Quote: &q}
+	rq, ok := db.retained[quoteHash]
+	if !ok {
+		return entry, nil
+	}
+	entry.Accepted = true
+	entry.State = rq.State
+	entry.Signature = rq.Signature
+	entry.DepositAddress = rq.DepositAddr
+	entry.ReqLiq = rq.ReqLiq
+	entry.AcceptedAt = rq.acceptedAt
+	entry.AcceptedHeight = rq.acceptedHeight
+	return entry, nil
+}
+
+func (db *MemoryDB) GetExpiredQuotes(now time.Time) ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var hashes []string
+	for hash := range db.expiredQuotes(now.Unix()) {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes, nil
+}
+
+func (db *MemoryDB) DeleteExpiredQuotes(expTimestamp int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for hash := range db.expiredQuotes(expTimestamp) {
+		delete(db.quotes, hash)
+	}
+	return nil
+}
+
+// expiredQuotes returns the quotes that weren't accepted and whose deposit time elapsed before the timestamp
+func (db *MemoryDB) expiredQuotes(timestamp int64) map[string]struct{} {
+	expired := make(map[string]struct{})
+	for hash, q := range db.quotes {
+		if _, ok := db.retained[hash]; !ok && depositDeadline(&q) < timestamp {
+			expired[hash] = struct{}{}
+		}
+	}
+	return expired
+}
+
+func (db *MemoryDB) DeleteProviderQuotes(lpRSKAddr string) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var n int64
+	for hash, q := range db.quotes {
+		if _, ok := db.retained[hash]; !ok && strings.EqualFold(q.LPRSKAddr, lpRSKAddr) {
+			delete(db.quotes, hash)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (db *MemoryDB) ListQuotes(filter QuoteFilter, limit uint, offset uint) ([]*ListedQuote, int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	quotes := []*ListedQuote{}
+	for hash, q := range db.quotes {
+		if filter.LpRskAddr != "" && !strings.EqualFold(q.LPRSKAddr, filter.LpRskAddr) {
+			continue
+		}
+		if !filter.CreatedAfter.IsZero() && int64(q.AgreementTimestamp) <= filter.CreatedAfter.Unix() {
+			continue
+		}
+		quotes = append(quotes, &ListedQuote{Hash: hash, Quote: q})
+	}
+	sort.Slice(quotes, func(i, j int) bool {
+		if quotes[i].AgreementTimestamp != quotes[j].AgreementTimestamp {
+			return quotes[i].AgreementTimestamp < quotes[j].AgreementTimestamp
+		}
+		return quotes[i].Hash < quotes[j].Hash
+	})
+	total := len(quotes)
+	if offset >= uint(total) {
+		return []*ListedQuote{}, total, nil
+	}
+	quotes = quotes[offset:]
+	if limit < uint(len(quotes)) {
+		quotes = quotes[:limit]
+	}
+	return quotes, total, nil
+}
+
+func (db *MemoryDB) RetainQuote(entry *types.RetainedQuote) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.quotes[entry.QuoteHash]; !ok {
+		return fmt.Errorf("no quote stored under hash: %v", entry.QuoteHash)
+	}
+	if _, ok := db.retained[entry.QuoteHash]; ok {
+		return fmt.Errorf("quote already retained: %v", entry.QuoteHash)
+	}
+	db.retained[entry.QuoteHash] = &memoryRetainedQuote{
+		RetainedQuote: *entry,
+		acceptedAt:    time.Unix(time.Now().Unix(), 0),
+	}
+	return nil
+}
+
+func (db *MemoryDB) GetRetainedQuotes(filter []types.RQState) ([]*types.RetainedQuote, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var retainedQuotes []*types.RetainedQuote
+	for _, rq := range db.retained {
+		if hasState(filter, rq.State) {
+			entry := rq.RetainedQuote
+			retainedQuotes = append(retainedQuotes, &entry)
+		}
+	}
+	sort.Slice(retainedQuotes, func(i, j int) bool {
+		return retainedQuotes[i].QuoteHash < retainedQuotes[j].QuoteHash
+	})
+	return retainedQuotes, nil
+}
+
+func (db *MemoryDB) GetRetainedQuote(hash string) (*types.RetainedQuote, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	rq, ok := db.retained[hash]
+	if !ok {
+		return nil, nil
+	}
+	entry := rq.RetainedQuote
+	return &entry, nil
+}
+
+func (db *MemoryDB) UpdateRetainedQuoteState(hash string, oldState types.RQState, newState types.RQState) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rq, ok := db.retained[hash]
+	if !ok || rq.State != oldState {
+		return fmt.Errorf("error updating retained quote: %v; oldState: %v; newState: %v", hash, oldState, newState)
+	}
+	rq.State = newState
+	return nil
+}
+
+func (db *MemoryDB) SetAcceptedHeight(hash string, height uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if rq, ok := db.retained[hash]; ok {
+		rq.acceptedHeight = height
+	}
+	return nil
+}
+
+func (db *MemoryDB) GetLockedLiquidity(lpRSKAddr string) (*types.Wei, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	filter := []types.RQState{types.RQStateWaitingForDeposit, types.RQStateCallForUserFailed}
+	lockedLiq := types.NewWei(0)
+	for hash, rq := range db.retained {
+		if hasState(filter, rq.State) && strings.EqualFold(db.quotes[hash].LPRSKAddr, lpRSKAddr) {
+			lockedLiq.Add(lockedLiq, rq.ReqLiq)
+		}
+	}
+	return lockedLiq, nil
+}
+
+func (db *MemoryDB) DeleteRetainedQuotes(states []types.RQState, before time.Time) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var n int64
+	for hash, rq := range db.retained {
+		q := db.quotes[hash]
+		if hasState(states, rq.State) && depositDeadline(&q) < before.Unix() {
+			delete(db.retained, hash)
+			delete(db.quotes, hash)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (db *MemoryDB) CountRetainedQuotes() (map[types.RQState]int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	counts := make(map[types.RQState]int)
+	for _, rq := range db.retained {
+		counts[rq.State]++
+	}
+	return counts, nil
+}
+
+func (db *MemoryDB) GetIdempotentResponse(key string) (*IdempotentResponse, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	r, ok := db.keys[key]
+	if !ok {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+func (db *MemoryDB) InsertIdempotentResponse(r *IdempotentResponse) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.keys[r.Key]; ok {
+		return fmt.Errorf("idempotency key already stored: %v", r.Key)
+	}
+	db.keys[r.Key] = *r
+	return nil
+}
+
+func (db *MemoryDB) DeleteIdempotentResponses(before time.Time) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var n int64
+	for key, r := range db.keys {
+		if r.CreatedAt < before.Unix() {
+			delete(db.keys, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func depositDeadline(q *types.Quote) int64 {
+	return int64(q.AgreementTimestamp) + int64(q.TimeForDeposit)
+}
+
+func hasState(states []types.RQState, state types.RQState) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
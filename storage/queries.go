@@ -69,12 +69,58 @@ VALUES (
 )
 `
 
+const selectExpiredQuotes = `
+SELECT hash FROM quotes
+WHERE hash NOT IN (SELECT quote_hash FROM retained_quotes)
+AND agreement_timestamp + time_for_deposit < ?
+`
+
 const deleteExpiredQuotes = `
 DELETE FROM quotes
 WHERE hash NOT IN (SELECT quote_hash FROM retained_quotes)
 AND agreement_timestamp + time_for_deposit < ?
 `
 
+const deleteProviderQuotes = `
+DELETE FROM quotes
+WHERE hash NOT IN (SELECT quote_hash FROM retained_quotes)
+AND LOWER(lp_rsk_addr) = LOWER(?)
+`
+
+const countQuotes = `
+SELECT COUNT(*) FROM quotes
+WHERE (? = '' OR LOWER(lp_rsk_addr) = LOWER(?))
+AND agreement_timestamp > ?
+`
+
+const selectQuotesPage = `
+SELECT
+	hash,
+	fed_addr,
+	lbc_addr,
+	lp_rsk_addr,
+	btc_refund_addr,
+	rsk_refund_addr,
+	lp_btc_addr,
+	call_fee,
+	penalty_fee,
+	contract_addr,
+	data,
+	gas_limit,
+	nonce,
+	value,
+	agreement_timestamp,
+	time_for_deposit,
+	call_time,
+	confirmations,
+	call_on_register
+FROM quotes
+WHERE (? = '' OR LOWER(lp_rsk_addr) = LOWER(?))
+AND agreement_timestamp > ?
+ORDER BY agreement_timestamp, hash
+LIMIT ? OFFSET ?
+`
+
 const getRetainedQuote = `
 SELECT
 	quote_hash,
@@ -86,23 +132,44 @@ FROM retained_quotes
 WHERE quote_hash = ?
 LIMIT 1`
 
+const getRetainedQuoteWithAcceptedAt = `
+SELECT
+	quote_hash,
+	deposit_addr,
+	signature,
+	req_liq,
+	state,
+	accepted_at,
+	accepted_height
+FROM retained_quotes
+WHERE quote_hash = ?
+LIMIT 1`
+
 const insertRetainedQuote = `
 INSERT INTO retained_quotes (
     quote_hash,
 	deposit_addr,
 	signature,
 	req_liq,
-	state
+	state,
+	accepted_at
 )
 VALUES (
     :quote_hash,
 	:deposit_addr,
 	:signature,
 	:req_liq,
-	:state
+	:state,
+	CAST(strftime('%s', 'now') AS INTEGER)
 )
 `
 
+const updateRetainedQuoteAcceptedHeight = `
+UPDATE retained_quotes
+SET accepted_height = ?
+WHERE quote_hash = ?
+`
+
 const updateRetainedQuoteState = `
 UPDATE retained_quotes
 SET state = :new_state
@@ -122,7 +189,64 @@ WHERE state IN (?)
 
 const selectRetainedQuotesReqLiq = `
 SELECT
-	req_liq
+	rq.req_liq
+FROM retained_quotes rq
+JOIN quotes q ON q.hash = rq.quote_hash
+WHERE rq.state IN (?) AND LOWER(q.lp_rsk_addr) = LOWER(?)
+`
+
+const selectPrunableRetainedQuotes = `
+SELECT
+	rq.quote_hash
+FROM retained_quotes rq
+JOIN quotes q ON q.hash = rq.quote_hash
+WHERE rq.state IN (?) AND q.agreement_timestamp + q.time_for_deposit < ?
+`
+
+const deleteRetainedQuotesByHash = `
+DELETE FROM retained_quotes
+WHERE quote_hash IN (?)
+`
+
+const deleteQuotesByHash = `
+DELETE FROM quotes
+WHERE hash IN (?)
+`
+
+const countRetainedQuotesByState = `
+SELECT
+	state,
+	COUNT(*) AS count
 FROM retained_quotes
-WHERE state IN (?)
+GROUP BY state
+`
+
+const selectIdempotentResponse = `
+SELECT
+	idempotency_key,
+	quote_hash,
+	response,
+	created_at
+FROM idempotency_keys
+WHERE idempotency_key = ?
+LIMIT 1`
+
+const insertIdempotentResponse = `
+INSERT INTO idempotency_keys (
+	idempotency_key,
+	quote_hash,
+	response,
+	created_at
+)
+VALUES (
+	:idempotency_key,
+	:quote_hash,
+	:response,
+	:created_at
+)
+`
+
+const deleteIdempotentResponses = `
+DELETE FROM idempotency_keys
+WHERE created_at < ?
 `
@@ -35,6 +35,8 @@ CREATE TABLE IF NOT EXISTS retained_quotes (
 	signature TEXT NOT NULL,
 	req_liq TEXT NOT NULL,
 	state INTEGER NOT NULL,
+	accepted_at INTEGER NOT NULL DEFAULT 0,
+	accepted_height INTEGER NOT NULL DEFAULT 0,
 	FOREIGN KEY(quote_hash) REFERENCES quotes(hash)
 )
 `
@@ -43,3 +45,24 @@ const createRetainedQuoteIndexes = `
 CREATE INDEX IF NOT EXISTS retained_quotes_state_idx
 ON retained_quotes (state)
 `
+
+const selectRetainedQuoteColumns = `
+SELECT name FROM pragma_table_info('retained_quotes')
+`
+
+const addRetainedQuoteAcceptedAtColumn = `
+ALTER TABLE retained_quotes ADD COLUMN accepted_at INTEGER NOT NULL DEFAULT 0
+`
+
+const addRetainedQuoteAcceptedHeightColumn = `
+ALTER TABLE retained_quotes ADD COLUMN accepted_height INTEGER NOT NULL DEFAULT 0
+`
+
+const createIdempotencyKeyTable = `
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	idempotency_key TEXT PRIMARY KEY NOT NULL,
+	quote_hash TEXT NOT NULL,
+	response TEXT NOT NULL,
+	created_at INTEGER NOT NULL
+)
+`